@@ -8,7 +8,6 @@ import (
 
 	"github.com/aws/aws-lambda-go/lambda"
 
-	"github.com/martinbaillie/ocistow/pkg/backend"
 	"github.com/martinbaillie/ocistow/pkg/config"
 	"github.com/martinbaillie/ocistow/pkg/service"
 	"github.com/martinbaillie/ocistow/pkg/transport"
@@ -21,7 +20,12 @@ func run(argv []string, out *os.File) error {
 		return fmt.Errorf("parsing config: %w", err)
 	}
 
-	svc := service.NewService(backend.NewAWS(*cfg.AWSKMSKeyARN, *cfg.AWSRegion, *cfg.AWSXray))
+	b, err := cfg.NewBackend()
+	if err != nil {
+		return err
+	}
+
+	svc := service.NewService(b)
 
 	if *cfg.AWSXray {
 		svc = service.NewAWSXrayMiddleware()(svc)
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
 
-	"github.com/martinbaillie/ocistow/pkg/backend"
 	"github.com/martinbaillie/ocistow/pkg/config"
 	"github.com/martinbaillie/ocistow/pkg/service"
 	"github.com/martinbaillie/ocistow/pkg/transport"
@@ -18,12 +21,32 @@ func run(argv []string, out *os.File) error {
 	src := cfg.String("source", "", "source image")
 	dst := cfg.String("destination", "", "destination image")
 	annotations := cfg.StringMap("annotations", "destination image annotations (key=value)")
+	attestations := cfg.KeyValueSlice("attestations", "destination image attestation (predicateType=JSON or path to it, repeatable)")
+	vex := cfg.StringSlice("vex", "paths to OpenVEX documents of the destination image (comma separated)")
+	resignRepos := cfg.StringSlice("resign-repositories", "repositories to re-sign the images of that -resign-old-key signed, rather than copying (comma separated)")
+	resignOldKey := cfg.String("resign-old-key", "", "ref of the key to re-sign the signatures of, [<signer>:]<key>")
+	resignNewKey := cfg.String("resign-new-key", "", "ref of the key to re-sign with (default the signing or routed key)")
+	resignRemoveOld := cfg.Bool("resign-remove-old", false, "whether to remove the old key's signatures once re-signed")
+	resignCheckpoint := cfg.String("resign-checkpoint", "", "path of a file of the images re-signed so far, to skip when resuming")
+	unsign := cfg.Bool("unsign", false, "whether to remove the destination image's signatures rather than copying")
+	unsignKey := cfg.String("unsign-key", "", "ref of the key to remove the signatures of (default the signing or routed key)")
+	unsignAll := cfg.Bool("unsign-all", false, "whether to remove all the destination image's signatures, whatever their key")
+	unsignReason := cfg.String("unsign-reason", "", "reason to record in a signed revocation record of the removed signatures (default no record)")
+	refreshRepos := cfg.StringSlice("refresh-repositories", "repositories to refresh the expiring signatures of, rather than copying (comma separated)")
+	refreshWithin := cfg.Duration("refresh-within", 24*time.Hour, "how soon signatures must expire to be refreshed")
+	refreshExpired := cfg.Bool("refresh-expired", false, "whether to refresh signatures that have already expired too")
+	refreshInterval := cfg.Duration("refresh-interval", 0, "how often to refresh signatures in the background (default once)")
 
 	if err := cfg.Parse(argv[1:]); err != nil {
 		return fmt.Errorf("parsing config: %w", err)
 	}
 
-	svc := service.NewService(backend.NewAWS(*cfg.AWSKMSKeyARN, *cfg.AWSRegion, *cfg.AWSXray))
+	b, err := cfg.NewBackend()
+	if err != nil {
+		return err
+	}
+
+	svc := service.NewService(b)
 
 	if *cfg.AWSXray {
 		svc = service.NewAWSXrayMiddleware()(svc)
@@ -31,7 +54,80 @@ func run(argv []string, out *os.File) error {
 
 	svc = service.NewContextLoggerMiddleware()(svc)
 
-	return transport.NewCLI(cfg, svc).Stow(*src, *dst, *annotations)
+	if len(*resignRepos) > 0 {
+		return transport.NewCLI(cfg, svc).Resign(transport.ResignRequest{
+			Repositories: *resignRepos,
+			OldKey:       *resignOldKey,
+			NewKey:       *resignNewKey,
+			RemoveOld:    *resignRemoveOld,
+			Checkpoint:   *resignCheckpoint,
+		})
+	}
+
+	if len(*refreshRepos) > 0 {
+		return transport.NewCLI(cfg, svc).Refresh(transport.RefreshRequest{
+			Repositories: *refreshRepos,
+			Within:       *refreshWithin,
+			Expired:      *refreshExpired,
+			Interval:     *refreshInterval,
+		})
+	}
+
+	if *unsign {
+		return transport.NewCLI(cfg, svc).Unsign(transport.UnsignRequest{
+			DstImgRef: *dst,
+			Key:       *unsignKey,
+			All:       *unsignAll,
+			Reason:    *unsignReason,
+		})
+	}
+
+	req := transport.StowRequest{
+		SrcImgRef:   *src,
+		DstImgRef:   *dst,
+		Annotations: *annotations,
+	}
+
+	for _, a := range *attestations {
+		predicate, err := readPredicate(a.Value)
+		if err != nil {
+			return fmt.Errorf("reading %q attestation predicate: %w", a.Key, err)
+		}
+
+		req.Attestations = append(req.Attestations, transport.StowAttestation{
+			PredicateType: a.Key,
+			Predicate:     predicate,
+		})
+	}
+
+	for _, path := range *vex {
+		doc, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading VEX document: %w", err)
+		}
+
+		req.VEX = append(req.VEX, doc)
+	}
+
+	return transport.NewCLI(cfg, svc).Stow(req)
+}
+
+// readPredicate returns the given JSON predicate, reading it from file if it is
+// instead given as a path, as requests only take predicates inline.
+func readPredicate(p string) (json.RawMessage, error) {
+	b := []byte(p)
+	if trimmed := strings.TrimSpace(p); !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		var err error
+		if b, err = ioutil.ReadFile(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("%q is not JSON", p)
+	}
+
+	return b, nil
 }
 
 func main() {
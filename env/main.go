@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk"
 	"github.com/aws/aws-cdk-go/awscdk/awsiam"
@@ -15,6 +16,7 @@ import (
 	"github.com/aws/jsii-runtime-go"
 
 	"github.com/martinbaillie/ocistow/pkg/config"
+	"github.com/martinbaillie/ocistow/pkg/service"
 )
 
 func main() {
@@ -35,6 +37,11 @@ func run(argv []string, out *os.File, cwd string) error {
 		return fmt.Errorf("parsing config: %w", err)
 	}
 
+	keyARNs, err := kmsKeyARNs(cfg)
+	if err != nil {
+		return fmt.Errorf("reading key routes: %w", err)
+	}
+
 	app := awscdk.NewApp(nil)
 
 	tracing := awslambda.Tracing_DISABLED
@@ -55,9 +62,55 @@ func run(argv []string, out *os.File, cwd string) error {
 			Architectures: &[]awslambda.Architecture{awslambda.Architecture_ARM_64()},
 			MemorySize:    jsii.Number(10240),
 			Environment: &map[string]*string{
-				"DEBUG":           jsii.String(strconv.FormatBool(*cfg.Debug)),
-				"AWS_XRAY":        jsii.String(strconv.FormatBool(*cfg.AWSXray)),
-				"AWS_KMS_KEY_ARN": cfg.AWSKMSKeyARN,
+				"DEBUG":    jsii.String(strconv.FormatBool(*cfg.Debug)),
+				"AWS_XRAY": jsii.String(strconv.FormatBool(*cfg.AWSXray)),
+
+				"BACKEND":         cfg.Backend,
+				"SIGNER":          cfg.Signer,
+				"KEY_ROUTES":      cfg.KeyRoutes,
+				"CO_SIGNING_KEYS": jsii.String(cfg.CoSigningKeys.String()),
+
+				"AWS_KMS_KEY_ARN":  flagValue(cfg, "aws-kms-key-arn"),
+				"AWS_ECR_ENDPOINT": flagValue(cfg, "aws-ecr-endpoint"),
+				"LOCAL_KEY":        flagValue(cfg, "local-key"),
+
+				"VAULT_ADDRESS":      flagValue(cfg, "vault-address"),
+				"VAULT_TRANSIT_PATH": flagValue(cfg, "vault-transit-path"),
+				"VAULT_KEY":          flagValue(cfg, "vault-key"),
+				"VAULT_AUTH":         flagValue(cfg, "vault-auth"),
+				"VAULT_AUTH_PATH":    flagValue(cfg, "vault-auth-path"),
+				"VAULT_ROLE":         flagValue(cfg, "vault-role"),
+				"VAULT_SECRET":       flagValue(cfg, "vault-secret"),
+
+				"GENERIC_REGISTRY": flagValue(cfg, "generic-registry"),
+				"GENERIC_USERNAME": flagValue(cfg, "generic-username"),
+
+				"CONVERT_MEDIA_TYPES": cfg.ConvertMediaTypes,
+				"LAYER_COMPRESSION":   cfg.LayerCompression,
+				"SOCI_INDEX":          jsii.String(strconv.FormatBool(*cfg.SOCIIndex)),
+				"SOCI_MIN_LAYER_SIZE": jsii.String(strconv.FormatInt(*cfg.SOCIMinLayerSize, 10)),
+
+				"ESTARGZ":                   jsii.String(strconv.FormatBool(*cfg.Estargz)),
+				"ESTARGZ_PRIORITIZED_FILES": jsii.String(cfg.EstargzPrioritizedFiles.String()),
+
+				"ENCRYPT_RECIPIENTS": jsii.String(cfg.EncryptRecipients.String()),
+				"ENCRYPT_LAYERS":     jsii.String(cfg.EncryptLayers.String()),
+				"DECRYPT_KEYS":       jsii.String(cfg.DecryptKeys.String()),
+
+				"VERIFY":               jsii.String(strconv.FormatBool(*cfg.Verify)),
+				"POLICY":               cfg.Policy,
+				"INSPECT":              cfg.Inspect,
+				"INSPECT_ALLOW":        jsii.String(cfg.InspectAllow.String()),
+				"PROVENANCE":           jsii.String(strconv.FormatBool(*cfg.Provenance)),
+				"SBOM":                 cfg.SBOM,
+				"SCAN_FINDINGS":        jsii.String(strconv.FormatBool(*cfg.ScanFindings)),
+				"SCAN_TIMEOUT":         jsii.String(cfg.ScanTimeout.String()),
+				"SIGNATURE_REFERRERS":  jsii.String(strconv.FormatBool(*cfg.SignatureReferrers)),
+				"SIGNATURE_REPOSITORY": cfg.SignatureRepository,
+				"SIGNATURE_SUFFIX":     cfg.SignatureSuffix,
+				"SIGNATURE_REPLACE":    jsii.String(strconv.FormatBool(*cfg.SignatureReplace)),
+				"SIGNATURE_VALIDITY":   jsii.String(cfg.SignatureValidity.String()),
+				"SIGNATURE_UNBOUNDED":  jsii.String(strconv.FormatBool(*cfg.SignatureUnbounded)),
 			},
 			Code: awslambda.AssetCode_FromAsset(
 				jsii.String(cwd),
@@ -101,7 +154,7 @@ func run(argv []string, out *os.File, cwd string) error {
 					"kms:DescribeKey",
 					"kms:GetPublicKey",
 				),
-				Resources: jsii.Strings(*cfg.AWSKMSKeyARN),
+				Resources: jsii.Strings(keyARNs...),
 			},
 		),
 	)
@@ -149,3 +202,35 @@ func (lgb *localGoBundler) TryBundle(outputDir *string, options *awscdk.Bundling
 
 	return jsii.Bool(true)
 }
+
+// flagValue returns the value of the flag, such as one registered by a backend
+// rather than the config itself.
+func flagValue(cfg *config.Config, name string) *string {
+	return jsii.String(cfg.Lookup(name).Value.String())
+}
+
+// kmsKeyARNs returns the AWS KMS keys that are signed with: the signing key and
+// any AWS routed (given inline) or co-signing keys.
+func kmsKeyARNs(cfg *config.Config) ([]string, error) {
+	arns := []string{*flagValue(cfg, "aws-kms-key-arn")}
+	keyRefs := *cfg.CoSigningKeys
+
+	if strings.HasPrefix(strings.TrimSpace(*cfg.KeyRoutes), "[") {
+		routes, err := service.ParseKeyRoutes([]byte(*cfg.KeyRoutes))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range routes {
+			keyRefs = append(keyRefs, r.Key)
+		}
+	}
+
+	for _, keyRef := range keyRefs {
+		if keyRef = strings.TrimPrefix(keyRef, "aws:"); strings.HasPrefix(keyRef, "arn:aws:kms:") {
+			arns = append(arns, keyRef)
+		}
+	}
+
+	return arns, nil
+}
@@ -9,9 +9,19 @@ require (
 	github.com/aws/aws-xray-sdk-go v1.6.0
 	github.com/aws/jsii-runtime-go v1.40.0
 	github.com/awslabs/amazon-ecr-credential-helper/ecr-login v0.0.0-20210811173920-b94b92fdcb69
+	github.com/containerd/stargz-snapshotter/estargz v0.8.0
+	github.com/containers/ocicrypt v1.1.2
 	github.com/docker/docker-credential-helpers v0.6.4 // indirect
+	github.com/google/flatbuffers v1.12.1
 	github.com/google/go-containerregistry v0.6.1-0.20210922191434-34b7f00d7a60
+	github.com/hashicorp/vault/api v1.1.1
+	github.com/in-toto/in-toto-golang v0.2.1-0.20210806133539-f50646681592
+	github.com/jmespath/go-jmespath v0.4.0
+	github.com/klauspost/compress v1.13.5
 	github.com/mattn/go-isatty v0.0.12
+	github.com/miekg/pkcs11 v1.0.3
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.2-0.20210730191737-8e42a01fb1b7
 	github.com/peterbourgon/ff/v3 v3.1.0
 	github.com/rs/zerolog v1.25.0
 	github.com/sigstore/cosign v1.2.2-0.20210927173526-874644ea81a4
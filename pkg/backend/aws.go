@@ -2,6 +2,8 @@ package backend
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/sigstore/sigstore/pkg/signature"
 
 	ecrlogin "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
@@ -22,18 +25,42 @@ import (
 
 const sigStoreKMSPrefix = "awskms:///"
 
-func NewAWS(kmsKeyARN, region string, xrayEnabled bool) Backend {
+var ErrNoKMSKey = errors.New("no AWS KMS key to sign with (-aws-kms-key-arn)")
+
+func init() {
+	Register("aws", KindSigner|KindRegistry, func(fs *flag.FlagSet) Factory {
+		kmsKeyARN := fs.String("aws-kms-key-arn", "", "AWS KMS key ARN to use for signing")
+		region := fs.String("aws-region", "", "AWS region to use for operations")
+		ecrEndpoint := fs.String("aws-ecr-endpoint", "", "AWS ECR API endpoint override, e.g. of a local fake")
+
+		return func(registry Backend, key string, o Options) (Backend, error) {
+			if key == "" {
+				key = *kmsKeyARN
+			}
+
+			b := NewAWS(key, *region, *ecrEndpoint, o.Xray)
+			if registry != nil {
+				return &signingBackend{Backend: registry, signer: b}, nil
+			}
+
+			return b, nil
+		}
+	})
+}
+
+// NewAWS returns the AWS backend, which signs with an AWS KMS key and
+// authenticates to ECR registries.
+func NewAWS(kmsKeyARN, region, ecrEndpoint string, xrayEnabled bool) Backend {
 	a := &awsBackend{
 		xrayEnabled: xrayEnabled,
-		kmsKeyARN:   kmsKeyARN,
+		keyRef:      kmsKeyARN,
 		region:      region,
-		remoteOpts: []remote.Option{
-			remote.WithAuthFromKeychain(&ecrAuthenticatedKeychain{}),
-		},
+		ecrEndpoint: ecrEndpoint,
+		keychain:    &ecrAuthenticatedKeychain{},
 	}
 
-	if !strings.HasPrefix(a.kmsKeyARN, sigStoreKMSPrefix) {
-		a.kmsKeyARN = sigStoreKMSPrefix + a.kmsKeyARN
+	if a.keyRef != "" && !strings.HasPrefix(a.keyRef, sigStoreKMSPrefix) {
+		a.keyRef = sigStoreKMSPrefix + a.keyRef
 	}
 
 	// FIXME: Shouldn't use the default transport here.
@@ -42,20 +69,31 @@ func NewAWS(kmsKeyARN, region string, xrayEnabled bool) Backend {
 		transport = xray.RoundTripper(transport)
 	}
 
-	a.remoteOpts = append(a.remoteOpts, remote.WithTransport(transport))
+	a.transport = transport
+	a.remoteOpts = []remote.Option{
+		remote.WithAuthFromKeychain(a.keychain),
+		remote.WithTransport(a.transport),
+	}
 
 	return a
 }
 
 type awsBackend struct {
 	xrayEnabled bool
-	kmsKeyARN   string
+	keyRef      string
 	region      string
+	ecrEndpoint string
 
+	keychain   authn.Keychain
+	transport  http.RoundTripper
 	remoteOpts []remote.Option
 }
 
 func (ab *awsBackend) SignerVerifier(ctx context.Context) (k signature.SignerVerifier, err error) {
+	if ab.keyRef == "" {
+		return nil, ErrNoKMSKey
+	}
+
 	// Can't easily take control of the transport or the AWS session used in
 	// this library in order to configure a region or Xray inject. Instead use
 	// the process environment to influence the AWS region and wrap the call
@@ -66,20 +104,36 @@ func (ab *awsBackend) SignerVerifier(ctx context.Context) (k signature.SignerVer
 
 	if ab.xrayEnabled {
 		xray.Capture(ctx, "Getting KMS signing key", func(ctxKMS context.Context) error {
-			k, err = cosig.SignerVerifierFromKeyRef(ctxKMS, ab.kmsKeyARN, nil)
+			k, err = cosig.SignerVerifierFromKeyRef(ctxKMS, ab.keyRef, nil)
 			return nil // Discard as k/err are outside this closure.
 		})
 	} else {
-		k, err = cosig.SignerVerifierFromKeyRef(ctx, ab.kmsKeyARN, nil)
+		k, err = cosig.SignerVerifierFromKeyRef(ctx, ab.keyRef, nil)
 	}
 
 	return k, err
 }
 
+// KeySignerVerifier returns the signer of another AWS KMS key.
+func (ab *awsBackend) KeySignerVerifier(ctx context.Context, keyRef string) (signature.SignerVerifier, error) {
+	return NewAWS(keyRef, ab.region, ab.ecrEndpoint, ab.xrayEnabled).SignerVerifier(ctx)
+}
+
 func (ab *awsBackend) RemoteOpts(ctx context.Context) []remote.Option {
 	return append([]remote.Option{remote.WithContext(ctx)}, ab.remoteOpts...)
 }
 
+func (ab *awsBackend) RegistryTransport(
+	ctx context.Context, repo name.Repository, scopes ...string,
+) (http.RoundTripper, error) {
+	auth, err := ab.keychain.Resolve(repo)
+	if err != nil {
+		return nil, fmt.Errorf("resolving registry credentials: %w", err)
+	}
+
+	return transport.NewWithContext(ctx, repo.Registry, auth, ab.transport, scopes)
+}
+
 // ecrAuthenticatedKeychain implements authentication for just ECR and
 // everything else is considered anonymous.
 //
@@ -2,7 +2,9 @@ package backend
 
 import (
 	"context"
+	"net/http"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/sigstore/sigstore/pkg/signature"
 )
@@ -14,6 +16,17 @@ type Backend interface {
 	// Signing key.
 	SignerVerifier(context.Context) (signature.SignerVerifier, error)
 
+	// Signing key of a key ref ([<signer>:]<key>), e.g. to co-sign with.
+	KeySignerVerifier(ctx context.Context, keyRef string) (signature.SignerVerifier, error)
+
 	// Authentication, request information.
 	RemoteOpts(context.Context) []remote.Option
+
+	// Authenticated transport for registry APIs that the Go container
+	// registry libraries don't (yet) cover, such as the OCI referrers API.
+	RegistryTransport(ctx context.Context, repo name.Repository, scopes ...string) (http.RoundTripper, error)
+
+	// Vulnerability scan findings of an image by its registry, for registries
+	// that scan images.
+	ScanFindings(ctx context.Context, img name.Digest) (*ScanFindings, error)
 }
@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/jsonrpc"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// ECR basic scanning is backed by Clair and enhanced scanning by Amazon
+	// Inspector.
+	ecrBasicScannerURI    = "https://docs.aws.amazon.com/AmazonECR/latest/userguide/image-scanning-basic.html"
+	ecrEnhancedScannerURI = "https://docs.aws.amazon.com/inspector/latest/user/scanning-ecr.html"
+
+	// Statuses of enhanced scans that the SDK (as vendored) predates.
+	ecrScanStatusActive  = "ACTIVE"
+	ecrScanStatusPending = "PENDING"
+)
+
+var ecrRegistryRegex = regexp.MustCompile(
+	`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`,
+)
+
+// ecrScanFindings is a page of ECR's DescribeImageScanFindings output, decoded
+// as is rather than through the SDK's own types, which predate enhanced
+// scanning.
+type ecrScanFindings struct {
+	ImageScanStatus struct {
+		Status      string `json:"status"`
+		Description string `json:"description"`
+	} `json:"imageScanStatus"`
+
+	ImageScanFindings struct {
+		ImageScanCompletedAt         float64          `json:"imageScanCompletedAt,omitempty"`
+		VulnerabilitySourceUpdatedAt float64          `json:"vulnerabilitySourceUpdatedAt,omitempty"`
+		FindingSeverityCounts        map[string]int64 `json:"findingSeverityCounts"`
+		Findings                     []interface{}    `json:"findings,omitempty"`
+		EnhancedFindings             []interface{}    `json:"enhancedFindings,omitempty"`
+	} `json:"imageScanFindings"`
+
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+func (ab *awsBackend) ScanFindings(ctx context.Context, img name.Digest) (*ScanFindings, error) {
+	input := &ecr.DescribeImageScanFindingsInput{
+		RepositoryName: aws.String(img.Context().RepositoryStr()),
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(img.DigestStr())},
+		MaxResults:     aws.Int64(1000),
+	}
+
+	cfg := &aws.Config{}
+
+	if m := ecrRegistryRegex.FindStringSubmatch(img.RegistryStr()); m != nil {
+		input.RegistryId = aws.String(m[1])
+		cfg.Region = aws.String(m[2])
+	} else if ab.ecrEndpoint == "" {
+		return nil, fmt.Errorf("%w: %q is not an ECR registry", ErrScanUnsupported, img.RegistryStr())
+	} else if ab.region != "" {
+		cfg.Region = aws.String(ab.region)
+	}
+
+	// NOTE: An endpoint override allows for a local fake of the ECR API.
+	if ab.ecrEndpoint != "" {
+		cfg.Endpoint = aws.String(ab.ecrEndpoint)
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS session: %w", err)
+	}
+
+	client := ecr.New(sess)
+	if ab.xrayEnabled {
+		xray.AWS(client.Client)
+	}
+
+	var all ecrScanFindings
+
+	for {
+		var page ecrScanFindings
+
+		req, _ := client.DescribeImageScanFindingsRequest(input)
+		req.Data = &page
+		req.Handlers.Unmarshal.Swap(jsonrpc.UnmarshalHandler.Name, request.NamedHandler{
+			Name: "ocistow.ecr.UnmarshalScanFindings",
+			Fn:   unmarshalECRScanFindings,
+		})
+		req.SetContext(ctx)
+
+		if err := req.Send(); err != nil {
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeScanNotFoundException {
+				return nil, fmt.Errorf("%w: %s", ErrScanNotFound, aerr.Message())
+			}
+
+			return nil, fmt.Errorf("describing scan findings of %q: %w", img, err)
+		}
+
+		switch status := page.ImageScanStatus; status.Status {
+		case ecr.ScanStatusComplete, ecrScanStatusActive:
+		case ecr.ScanStatusInProgress, ecrScanStatusPending:
+			return nil, ErrScanInProgress
+		case ecr.ScanStatusFailed:
+			return nil, fmt.Errorf("%w: %s", ErrScanFailed, status.Description)
+		default:
+			return nil, fmt.Errorf("%w: %s (%s)", ErrScanFailed, status.Status, status.Description)
+		}
+
+		findings := all.ImageScanFindings
+		all = page
+		all.ImageScanFindings.Findings = append(findings.Findings, page.ImageScanFindings.Findings...)
+		all.ImageScanFindings.EnhancedFindings = append(
+			findings.EnhancedFindings, page.ImageScanFindings.EnhancedFindings...,
+		)
+
+		if page.NextToken == "" {
+			break
+		}
+
+		input.NextToken = aws.String(page.NextToken)
+	}
+
+	all.NextToken = ""
+
+	f := &ScanFindings{
+		ScannerURI:  ecrBasicScannerURI,
+		DatabaseURI: ecrBasicScannerURI,
+		Findings:    all.ImageScanFindings,
+	}
+
+	if all.ImageScanStatus.Status == ecrScanStatusActive || len(all.ImageScanFindings.EnhancedFindings) > 0 {
+		f.ScannerURI, f.DatabaseURI = ecrEnhancedScannerURI, ecrEnhancedScannerURI
+	}
+
+	if t := all.ImageScanFindings.VulnerabilitySourceUpdatedAt; t != 0 {
+		f.DatabaseVersion = epochTime(t).Format(time.RFC3339)
+	}
+
+	// NOTE: ECR doesn't report when scans start, and enhanced scans are
+	// continuous, so the findings are as of when they were last updated.
+	f.FinishedOn = time.Now().UTC()
+	if t := all.ImageScanFindings.ImageScanCompletedAt; t != 0 {
+		f.FinishedOn = epochTime(t)
+	}
+
+	f.StartedOn = f.FinishedOn
+
+	return f, nil
+}
+
+func unmarshalECRScanFindings(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+
+	if err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data); err != nil {
+		r.Error = awserr.New(request.ErrCodeSerialization, "failed decoding ECR scan findings", err)
+	}
+}
+
+// epochTime returns the time of fractional seconds since the Unix epoch, as
+// AWS JSON APIs represent timestamps.
+func epochTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+}
@@ -0,0 +1,164 @@
+//go:build integration
+// +build integration
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/martinbaillie/ocistow/pkg/ecrfake"
+)
+
+// testECRFake returns an AWS backend of a local fake of the ECR API, whose
+// requests are signed with fake credentials.
+func testECRFake(t *testing.T) (Backend, *ecrfake.Server) {
+	t.Helper()
+
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDOCISTOWTEST",
+		"AWS_SECRET_ACCESS_KEY": "ocistow-test",
+	} {
+		prev, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, prev)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+
+	fake := ecrfake.New()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return NewAWS("", "us-east-1", srv.URL, false), fake
+}
+
+// testFindings returns n findings, named by their kind and index.
+func testFindings(kind string, n int) []json.RawMessage {
+	findings := make([]json.RawMessage, n)
+	for i := range findings {
+		findings[i] = json.RawMessage(fmt.Sprintf(`{"name":"%s-%d","severity":"HIGH"}`, kind, i))
+	}
+
+	return findings
+}
+
+func TestECRScanFindingsPaging(t *testing.T) {
+	b, fake := testECRFake(t)
+
+	img, err := name.NewDigest(fmt.Sprintf("localhost:5000/team/app@sha256:%064x", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	// More findings than a page (of 1000) holds, spanning the basic and
+	// enhanced findings.
+	fake.SetScan("team/app", img.DigestStr(), ecrfake.Scan{
+		Status:                       "ACTIVE",
+		CompletedAt:                  completed,
+		VulnerabilitySourceUpdatedAt: completed.Add(-time.Hour),
+		Findings:                     testFindings("basic", 1500),
+		EnhancedFindings:             testFindings("enhanced", 1200),
+	})
+
+	f, err := b.ScanFindings(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.ScannerURI != ecrEnhancedScannerURI {
+		t.Errorf("scanner %q, want %q", f.ScannerURI, ecrEnhancedScannerURI)
+	}
+
+	if !f.FinishedOn.Equal(completed) || !f.StartedOn.Equal(completed) {
+		t.Errorf("scanned %s to %s, want %s", f.StartedOn, f.FinishedOn, completed)
+	}
+
+	if want := completed.Add(-time.Hour).Format(time.RFC3339); f.DatabaseVersion != want {
+		t.Errorf("database version %q, want %q", f.DatabaseVersion, want)
+	}
+
+	raw, err := json.Marshal(f.Findings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var findings struct {
+		FindingSeverityCounts map[string]int64        `json:"findingSeverityCounts"`
+		Findings              []struct{ Name string } `json:"findings"`
+		EnhancedFindings      []struct{ Name string } `json:"enhancedFindings"`
+	}
+
+	if err := json.Unmarshal(raw, &findings); err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, tc := range map[string]struct {
+		got  []struct{ Name string }
+		want int
+	}{
+		"basic":    {findings.Findings, 1500},
+		"enhanced": {findings.EnhancedFindings, 1200},
+	} {
+		if len(tc.got) != tc.want {
+			t.Errorf("%d %s findings, want %d", len(tc.got), kind, tc.want)
+			continue
+		}
+
+		for i, finding := range tc.got {
+			if want := fmt.Sprintf("%s-%d", kind, i); finding.Name != want {
+				t.Errorf("%s finding %d is %q, want %q", kind, i, finding.Name, want)
+				break
+			}
+		}
+	}
+
+	if got := findings.FindingSeverityCounts["HIGH"]; got != 2700 {
+		t.Errorf("%d HIGH findings counted, want 2700", got)
+	}
+}
+
+func TestECRScanFindingsStatus(t *testing.T) {
+	b, fake := testECRFake(t)
+
+	for i, tc := range []struct {
+		status string
+		want   error
+	}{
+		{"IN_PROGRESS", ErrScanInProgress},
+		{"PENDING", ErrScanInProgress},
+		{"FAILED", ErrScanFailed},
+		{"", ErrScanNotFound},
+	} {
+		img, err := name.NewDigest(fmt.Sprintf("localhost:5000/team/app@sha256:%064x", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.status != "" {
+			fake.SetScan(img.Context().RepositoryStr(), img.DigestStr(), ecrfake.Scan{
+				Status:   tc.status,
+				Findings: testFindings("basic", 1),
+			})
+		}
+
+		if _, err := b.ScanFindings(context.Background(), img); !errors.Is(err, tc.want) {
+			t.Errorf("scan %q: error %v, want %v", tc.status, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+var ErrInvalidGenericConfig = errors.New("invalid generic backend config")
+
+func init() {
+	Register("generic", KindRegistry, func(fs *flag.FlagSet) Factory {
+		var c GenericConfig
+
+		fs.StringVar(&c.Registry, "generic-registry", "", "registry to authenticate to with -generic-username, e.g. harbor.example.com")
+		fs.StringVar(&c.Username, "generic-username", "", "registry username")
+		fs.StringVar(&c.Password, "generic-password", "", "registry password: file://<path>, env://<name> or the password")
+
+		return func(_ Backend, _ string, o Options) (Backend, error) {
+			return NewGeneric(c, o.Xray)
+		}
+	})
+}
+
+// GenericConfig is the configuration of the generic backend's registry
+// credentials.
+type GenericConfig struct {
+	// Registry to authenticate to as Username with Password, which may be
+	// given by source, as per the PKCS#11 PIN. Other registries (or all
+	// registries, when not given) are authenticated to as per the Docker
+	// config, i.e. that of $DOCKER_CONFIG or ~/.docker, and its credential
+	// helpers.
+	Registry string
+	Username string
+	Password string
+}
+
+func (c *GenericConfig) validate() error {
+	if (c.Registry == "") != (c.Username == "") {
+		return fmt.Errorf("%w: a registry requires a username, and vice versa", ErrInvalidGenericConfig)
+	}
+
+	return nil
+}
+
+// NewGeneric returns the generic backend, which authenticates to any
+// registry, but neither signs (being only a registry backend) nor gets scan
+// findings.
+func NewGeneric(c GenericConfig, xrayEnabled bool) (Backend, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	g := &genericBackend{keychain: authn.DefaultKeychain}
+
+	if c.Registry != "" {
+		reg, err := name.NewRegistry(c.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidGenericConfig, err)
+		}
+
+		c.Registry = reg.RegistryStr()
+		g.keychain = authn.NewMultiKeychain(&staticKeychain{cfg: c}, authn.DefaultKeychain)
+	}
+
+	// FIXME: Shouldn't use the default transport here.
+	g.transport = http.DefaultTransport
+	if xrayEnabled {
+		g.transport = xray.RoundTripper(g.transport)
+	}
+
+	return g, nil
+}
+
+type genericBackend struct {
+	keychain  authn.Keychain
+	transport http.RoundTripper
+}
+
+func (gb *genericBackend) SignerVerifier(context.Context) (signature.SignerVerifier, error) {
+	return nil, fmt.Errorf("%w: generic", ErrNoSigner)
+}
+
+func (gb *genericBackend) KeySignerVerifier(context.Context, string) (signature.SignerVerifier, error) {
+	return nil, fmt.Errorf("%w: generic", ErrNoSigner)
+}
+
+func (gb *genericBackend) RemoteOpts(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(gb.keychain),
+		remote.WithTransport(gb.transport),
+	}
+}
+
+func (gb *genericBackend) RegistryTransport(
+	ctx context.Context, repo name.Repository, scopes ...string,
+) (http.RoundTripper, error) {
+	auth, err := gb.keychain.Resolve(repo)
+	if err != nil {
+		return nil, fmt.Errorf("resolving registry credentials: %w", err)
+	}
+
+	return transport.NewWithContext(ctx, repo.Registry, auth, gb.transport, scopes)
+}
+
+func (gb *genericBackend) ScanFindings(context.Context, name.Digest) (*ScanFindings, error) {
+	return nil, ErrScanUnsupported
+}
+
+// staticKeychain authenticates to just the configured registry, with its
+// configured credentials.
+type staticKeychain struct{ cfg GenericConfig }
+
+var _ (authn.Keychain) = (*staticKeychain)(nil)
+
+func (k *staticKeychain) Resolve(r authn.Resource) (authn.Authenticator, error) {
+	if r.RegistryStr() != k.cfg.Registry {
+		return authn.Anonymous, nil
+	}
+
+	password, err := readSecret(k.cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("reading registry password: %w", err)
+	}
+
+	return authn.FromConfig(authn.AuthConfig{Username: k.cfg.Username, Password: password}), nil
+}
@@ -0,0 +1,43 @@
+//go:build integration
+// +build integration
+
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// testSignVerify signs a message and verifies its signature, both with the
+// signer and (as cosign would) a verifier of only its public key, and that a
+// signature of another message does not verify.
+func testSignVerify(t *testing.T, sv signature.SignerVerifier, pub crypto.PublicKey) {
+	t.Helper()
+
+	message := []byte(`{"critical":{"identity":{"docker-reference":"example.com/app"}}}`)
+
+	sig, err := sv.SignMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sv.VerifySignature(bytes.NewReader(sig), bytes.NewReader(message)); err != nil {
+		t.Errorf("verifying with the signer: %s", err)
+	}
+
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(message)); err != nil {
+		t.Errorf("verifying with the public key: %s", err)
+	}
+
+	if err := verifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(append(message, ' '))); err == nil {
+		t.Error("signature of another message verified")
+	}
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+const (
+	fileKeyPrefix = "file://"
+	envKeyPrefix  = "env://"
+
+	// keyPasswordEnv is the environment variable of the password of encrypted
+	// (cosign) private keys, as per cosign.
+	keyPasswordEnv = "COSIGN_PASSWORD"
+
+	encryptedCosignPrivateKeyPEMType = "ENCRYPTED COSIGN PRIVATE KEY"
+)
+
+var (
+	ErrInvalidKey          = errors.New("invalid private key")
+	ErrKeyPasswordRequired = errors.New("encrypted private key requires a password (" + keyPasswordEnv + ")")
+)
+
+func init() {
+	Register("local", KindSigner, func(fs *flag.FlagSet) Factory {
+		key := fs.String("local-key", "", "signing key: file://<path> or env://<name> of a PEM private key")
+
+		return func(registry Backend, keyRef string, _ Options) (Backend, error) {
+			if keyRef == "" {
+				keyRef = *key
+			}
+
+			return NewLocal(registry, keyRef)
+		}
+	})
+}
+
+// NewLocal returns a backend that signs with a private key held locally, and
+// otherwise defers to the registry backend. The key ref is that of a PEM
+// private key in a file (file://<path>) or environment variable (env://<name>).
+func NewLocal(registry Backend, keyRef string) (Backend, error) {
+	if !strings.HasPrefix(keyRef, fileKeyPrefix) && !strings.HasPrefix(keyRef, envKeyPrefix) {
+		return nil, fmt.Errorf("%w: unsupported key ref %q", ErrInvalidKey, keyRef)
+	}
+
+	return &localBackend{Backend: registry, keyRef: keyRef}, nil
+}
+
+type localBackend struct {
+	Backend
+	keyRef string
+}
+
+func (lb *localBackend) SignerVerifier(context.Context) (signature.SignerVerifier, error) {
+	return localSignerVerifier(lb.keyRef)
+}
+
+// localSignerVerifier returns the signer of the private key of the local key
+// ref: a PEM private key in a file (file://<path>) or environment variable
+// (env://<name>).
+func localSignerVerifier(keyRef string) (signature.SignerVerifier, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(keyRef, fileKeyPrefix):
+		if b, err = ioutil.ReadFile(strings.TrimPrefix(keyRef, fileKeyPrefix)); err != nil {
+			return nil, fmt.Errorf("reading private key: %w", err)
+		}
+	case strings.HasPrefix(keyRef, envKeyPrefix):
+		name := strings.TrimPrefix(keyRef, envKeyPrefix)
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: environment variable %q is not set", ErrInvalidKey, name)
+		}
+
+		b = []byte(v)
+	default:
+		return nil, fmt.Errorf("%w: unsupported key ref %q", ErrInvalidKey, keyRef)
+	}
+
+	priv, err := parsePrivateKey(b, []byte(os.Getenv(keyPasswordEnv)))
+	if err != nil {
+		return nil, err
+	}
+
+	return signature.LoadSignerVerifier(priv, crypto.SHA256)
+}
+
+// readSecret returns the secret of the ref: from a file (file://<path>) or
+// environment variable (env://<name>), or the ref itself otherwise.
+func readSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, fileKeyPrefix):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(ref, fileKeyPrefix))
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(b)), nil
+	case strings.HasPrefix(ref, envKeyPrefix):
+		name := strings.TrimPrefix(ref, envKeyPrefix)
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+
+		return v, nil
+	}
+
+	return ref, nil
+}
+
+// parsePrivateKey parses a PEM private key: an encrypted cosign key (with the
+// password, which may be empty), or an unencrypted PKCS#8 (ECDSA, RSA or Ed25519), SEC 1 (ECDSA)
+// or PKCS#1 (RSA) key.
+func parsePrivateKey(b, password []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", ErrInvalidKey)
+	}
+
+	var (
+		priv crypto.PrivateKey
+		err  error
+	)
+
+	switch block.Type {
+	case encryptedCosignPrivateKeyPEMType, string(cryptoutils.EncryptedSigstorePrivateKeyPEMType):
+		// Without a password, the key may yet be encrypted with an empty
+		// one, as cosign allows, though only a non-nil password decrypts.
+		priv, err = cryptoutils.UnmarshalPEMToPrivateKey(b, func(bool) ([]byte, error) {
+			return append([]byte{}, password...), nil
+		})
+
+		if err != nil && len(password) == 0 {
+			return nil, ErrKeyPasswordRequired
+		}
+	case string(cryptoutils.PrivateKeyPEMType):
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unsupported PEM type %q", ErrInvalidKey, block.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+
+	return priv, nil
+}
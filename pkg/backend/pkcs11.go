@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+var (
+	ErrInvalidPKCS11Config = errors.New("invalid PKCS#11 config")
+	ErrPKCS11Unsupported   = errors.New("PKCS#11 support requires a build with cgo and the pkcs11 build tag")
+	ErrPKCS11KeyNotFound   = errors.New("PKCS#11 key not found")
+)
+
+func init() {
+	Register("pkcs11", KindSigner, func(fs *flag.FlagSet) Factory {
+		var c PKCS11Config
+
+		fs.StringVar(&c.ModulePath, "pkcs11-module", "", "PKCS#11 module (shared library) path of the token, e.g. an HSM")
+		fs.IntVar(&c.Slot, "pkcs11-slot", -1, "PKCS#11 slot ID of the token, or -1 to find it by -pkcs11-token-label")
+		fs.StringVar(&c.TokenLabel, "pkcs11-token-label", "", "PKCS#11 token label")
+		fs.StringVar(&c.KeyLabel, "pkcs11-key-label", "", "PKCS#11 signing key label")
+		fs.StringVar(&c.PIN, "pkcs11-pin", "", "PKCS#11 user PIN: file://<path>, env://<name> or the PIN")
+
+		return func(registry Backend, key string, _ Options) (Backend, error) {
+			c := c
+			if key != "" {
+				c.KeyLabel = key
+			}
+
+			return NewPKCS11(registry, c)
+		}
+	})
+}
+
+// PKCS11Config is the configuration of a PKCS#11 signing key (e.g. in an HSM,
+// or SoftHSM for testing).
+type PKCS11Config struct {
+	// ModulePath is the path of the PKCS#11 module (shared library) of the
+	// token, e.g. /usr/lib/softhsm/libsofthsm2.so.
+	ModulePath string
+	// Slot is the ID of the slot of the token. When negative, the token is
+	// instead found by its TokenLabel.
+	Slot       int
+	TokenLabel string
+	// KeyLabel is the label of the private key, and of its public key.
+	KeyLabel string
+	// PIN is the user PIN of the token: from a file (file://<path>) or
+	// environment variable (env://<name>), or the PIN itself. Tokens without a
+	// PIN are not logged into.
+	PIN string
+}
+
+func (c *PKCS11Config) validate() error {
+	switch {
+	case c.ModulePath == "":
+		return fmt.Errorf("%w: no module path", ErrInvalidPKCS11Config)
+	case c.Slot < 0 && c.TokenLabel == "":
+		return fmt.Errorf("%w: neither a slot nor a token label", ErrInvalidPKCS11Config)
+	case c.KeyLabel == "":
+		return fmt.Errorf("%w: no key label", ErrInvalidPKCS11Config)
+	}
+
+	return nil
+}
+
+// pin returns the PIN, reading it from its source.
+func (c *PKCS11Config) pin() (string, error) {
+	pin, err := readSecret(c.PIN)
+	if err != nil {
+		return "", fmt.Errorf("reading PKCS#11 PIN: %w", err)
+	}
+
+	return pin, nil
+}
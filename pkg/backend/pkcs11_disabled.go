@@ -0,0 +1,10 @@
+//go:build !pkcs11 || !cgo
+// +build !pkcs11 !cgo
+
+package backend
+
+// NewPKCS11 returns ErrPKCS11Unsupported, as PKCS#11 support depends on cgo
+// and the pkcs11 build tag.
+func NewPKCS11(registry Backend, c PKCS11Config) (Backend, error) {
+	return nil, ErrPKCS11Unsupported
+}
@@ -0,0 +1,354 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// sha256DigestInfoPrefix is the DER prefix of the PKCS#1 v1.5 DigestInfo of a
+// SHA-256 digest, which the CKM_RSA_PKCS mechanism expects the caller to add.
+var sha256DigestInfoPrefix = []byte{
+	0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+}
+
+var namedCurves = []struct {
+	oid   asn1.ObjectIdentifier
+	curve elliptic.Curve
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, elliptic.P256()},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 34}, elliptic.P384()},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 35}, elliptic.P521()},
+}
+
+// NewPKCS11 returns a backend that signs with a PKCS#11 key, and otherwise
+// defers to the registry backend (e.g. for registry authentication). The
+// token is only opened on first use, after which its session is reused.
+func NewPKCS11(registry Backend, c PKCS11Config) (Backend, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return &pkcs11Backend{Backend: registry, cfg: c}, nil
+}
+
+type pkcs11Backend struct {
+	Backend
+	cfg PKCS11Config
+
+	mu sync.Mutex
+	sv *pkcs11SignerVerifier
+}
+
+func (pb *pkcs11Backend) SignerVerifier(context.Context) (signature.SignerVerifier, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.sv == nil {
+		sv, err := openPKCS11(pb.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		pb.sv = sv
+	}
+
+	return pb.sv, nil
+}
+
+// openPKCS11 opens a logged in session of the token of the config and finds
+// its key.
+func openPKCS11(c PKCS11Config) (*pkcs11SignerVerifier, error) {
+	p := pkcs11.New(c.ModulePath)
+	if p == nil {
+		return nil, fmt.Errorf("%w: cannot load module %q", ErrInvalidPKCS11Config, c.ModulePath)
+	}
+
+	if err := p.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, fmt.Errorf("initialising PKCS#11 module: %w", err)
+	}
+
+	slot, err := findPKCS11Slot(p, c)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("opening PKCS#11 session: %w", err)
+	}
+
+	pin, err := c.pin()
+	if err != nil {
+		return nil, err
+	}
+
+	if pin != "" {
+		if err := p.Login(session, pkcs11.CKU_USER, pin); err != nil &&
+			err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, fmt.Errorf("logging into PKCS#11 token: %w", err)
+		}
+	}
+
+	key, err := findPKCS11Object(p, session, pkcs11.CKO_PRIVATE_KEY, c.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := pkcs11PublicKey(p, session, c.KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("loading PKCS#11 public key: %w", err)
+	}
+
+	return &pkcs11SignerVerifier{
+		Verifier: verifier,
+		ctx:      p,
+		session:  session,
+		key:      key,
+		pub:      pub,
+	}, nil
+}
+
+func findPKCS11Slot(p *pkcs11.Ctx, c PKCS11Config) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("listing PKCS#11 slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		if c.Slot >= 0 {
+			if slot == uint(c.Slot) {
+				return slot, nil
+			}
+
+			continue
+		}
+
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("getting PKCS#11 token info: %w", err)
+		}
+
+		// Token labels are padded with spaces.
+		if strings.TrimRight(info.Label, " \x00") == c.TokenLabel {
+			return slot, nil
+		}
+	}
+
+	if c.Slot >= 0 {
+		return 0, fmt.Errorf("%w: no token in slot %d", ErrInvalidPKCS11Config, c.Slot)
+	}
+
+	return 0, fmt.Errorf("%w: no token labelled %q", ErrInvalidPKCS11Config, c.TokenLabel)
+}
+
+func findPKCS11Object(p *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	if err := p.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}); err != nil {
+		return 0, fmt.Errorf("finding PKCS#11 key: %w", err)
+	}
+
+	objects, _, err := p.FindObjects(session, 1)
+	if finalErr := p.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("finding PKCS#11 key: %w", err)
+	}
+
+	if len(objects) == 0 {
+		kind := "private"
+		if class == pkcs11.CKO_PUBLIC_KEY {
+			kind = "public"
+		}
+
+		return 0, fmt.Errorf("%w: no %s key labelled %q", ErrPKCS11KeyNotFound, kind, label)
+	}
+
+	return objects[0], nil
+}
+
+// pkcs11PublicKey returns the (ECDSA or RSA) public key of the label.
+func pkcs11PublicKey(p *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (crypto.PublicKey, error) {
+	obj, err := findPKCS11Object(p, session, pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := p.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting PKCS#11 key type: %w", err)
+	}
+
+	switch keyType := bytesToUint(attrs[0].Value); keyType {
+	case pkcs11.CKK_EC:
+		if attrs, err = p.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		}); err != nil {
+			return nil, fmt.Errorf("getting PKCS#11 EC public key: %w", err)
+		}
+
+		return parseECPublicKey(attrs[0].Value, attrs[1].Value)
+	case pkcs11.CKK_RSA:
+		if attrs, err = p.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		}); err != nil {
+			return nil, fmt.Errorf("getting PKCS#11 RSA public key: %w", err)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported PKCS#11 key type %#x", ErrInvalidKey, keyType)
+	}
+}
+
+// parseECPublicKey parses the DER encoded named curve and (optionally DER
+// wrapped, uncompressed) point of a PKCS#11 EC public key.
+func parseECPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("%w: EC params: %s", ErrInvalidKey, err)
+	}
+
+	var curve elliptic.Curve
+
+	for _, c := range namedCurves {
+		if c.oid.Equal(oid) {
+			curve = c.curve
+		}
+	}
+
+	if curve == nil {
+		return nil, fmt.Errorf("%w: unsupported curve %s", ErrInvalidKey, oid)
+	}
+
+	// Tokens differ on whether the point is wrapped in an octet string.
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, fmt.Errorf("%w: invalid EC point", ErrInvalidKey)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// bytesToUint decodes a (native, i.e. little endian on supported platforms)
+// CK_ULONG attribute value.
+func bytesToUint(b []byte) uint {
+	var u uint
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint(b[i])
+	}
+
+	return u
+}
+
+// pkcs11SignerVerifier signs with a PKCS#11 private key, and verifies with its
+// public key.
+type pkcs11SignerVerifier struct {
+	signature.Verifier
+
+	// mu serialises use of the session, which PKCS#11 does not allow
+	// concurrently.
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+var _ (signature.SignerVerifier) = (*pkcs11SignerVerifier)(nil)
+
+func (sv *pkcs11SignerVerifier) PublicKey(...signature.PublicKeyOption) (crypto.PublicKey, error) {
+	return sv.pub, nil
+}
+
+// SignMessage signs the SHA-256 digest of the message: as an ASN.1 DER
+// signature for ECDSA keys, as per Go (and cosign), or PKCS#1 v1.5 for RSA.
+func (sv *pkcs11SignerVerifier) SignMessage(message io.Reader, _ ...signature.SignOption) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+
+	digest := h.Sum(nil)
+
+	var (
+		mechanism uint
+		data      []byte
+	)
+
+	switch sv.pub.(type) {
+	case *ecdsa.PublicKey:
+		mechanism, data = pkcs11.CKM_ECDSA, digest
+	case *rsa.PublicKey:
+		mechanism, data = pkcs11.CKM_RSA_PKCS, append(append([]byte{}, sha256DigestInfoPrefix...), digest...)
+	}
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if err := sv.ctx.SignInit(sv.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, sv.key); err != nil {
+		return nil, fmt.Errorf("signing with PKCS#11 key: %w", err)
+	}
+
+	sig, err := sv.ctx.Sign(sv.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("signing with PKCS#11 key: %w", err)
+	}
+
+	if mechanism == pkcs11.CKM_ECDSA {
+		return ecdsaSignatureDER(sig)
+	}
+
+	return sig, nil
+}
+
+// ecdsaSignatureDER converts a PKCS#11 ECDSA signature (r and s concatenated)
+// to ASN.1 DER.
+func ecdsaSignatureDER(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, fmt.Errorf("%w: malformed PKCS#11 ECDSA signature", ErrInvalidKey)
+	}
+
+	n := len(sig) / 2
+
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(sig[:n]),
+		S: new(big.Int).SetBytes(sig[n:]),
+	})
+}
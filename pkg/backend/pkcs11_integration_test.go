@@ -0,0 +1,165 @@
+//go:build integration && pkcs11 && cgo
+// +build integration,pkcs11,cgo
+
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// testPKCS11Config returns the config of a token to test against, e.g. of
+// SoftHSM:
+//
+//	softhsm2-util --init-token --free --label ocistow-test --pin 1234 --so-pin 1234
+//	OCISTOW_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so \
+//	OCISTOW_TEST_PKCS11_TOKEN_LABEL=ocistow-test OCISTOW_TEST_PKCS11_PIN=1234 \
+//	go test -tags integration,pkcs11 ./pkg/backend
+func testPKCS11Config(t *testing.T) PKCS11Config {
+	t.Helper()
+
+	c := PKCS11Config{
+		ModulePath: os.Getenv("OCISTOW_TEST_PKCS11_MODULE"),
+		Slot:       -1,
+		TokenLabel: os.Getenv("OCISTOW_TEST_PKCS11_TOKEN_LABEL"),
+		PIN:        os.Getenv("OCISTOW_TEST_PKCS11_PIN"),
+	}
+
+	if c.ModulePath == "" || c.TokenLabel == "" {
+		t.Skip("OCISTOW_TEST_PKCS11_MODULE and OCISTOW_TEST_PKCS11_TOKEN_LABEL are not set")
+	}
+
+	return c
+}
+
+// generatePKCS11Key generates a key pair of the label in the token, which is
+// destroyed once the test is done.
+func generatePKCS11Key(t *testing.T, c PKCS11Config, label string, mechanism uint, attrs []*pkcs11.Attribute) {
+	t.Helper()
+
+	p := pkcs11.New(c.ModulePath)
+	if p == nil {
+		t.Fatalf("loading module %q", c.ModulePath)
+	}
+
+	if err := p.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		t.Fatal(err)
+	}
+
+	slot, err := findPKCS11Slot(p, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Login(session, pkcs11.CKU_USER, c.PIN); err != nil &&
+		err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		t.Fatal(err)
+	}
+
+	common := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	pub, priv, err := p.GenerateKeyPair(
+		session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)},
+		append(append([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true)}, common...), attrs...),
+		append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		}, common...),
+	)
+	if err != nil {
+		t.Fatalf("generating key pair %q: %s", label, err)
+	}
+
+	t.Cleanup(func() {
+		p.DestroyObject(session, pub)
+		p.DestroyObject(session, priv)
+		p.CloseSession(session)
+	})
+}
+
+func TestPKCS11SignVerify(t *testing.T) {
+	c := testPKCS11Config(t)
+
+	p256, err := asn1.Marshal(namedCurves[0].oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		mechanism uint
+		attrs     []*pkcs11.Attribute
+		check     func(crypto.PublicKey) bool
+	}{
+		{
+			name:      "ecdsa-p256",
+			mechanism: pkcs11.CKM_EC_KEY_PAIR_GEN,
+			attrs:     []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256)},
+			check: func(pub crypto.PublicKey) bool {
+				k, ok := pub.(*ecdsa.PublicKey)
+				return ok && k.Curve == namedCurves[0].curve
+			},
+		},
+		{
+			name:      "rsa-2048",
+			mechanism: pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN,
+			attrs: []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			},
+			check: func(pub crypto.PublicKey) bool {
+				k, ok := pub.(*rsa.PublicKey)
+				return ok && k.N.BitLen() == 2048
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			c := c
+			c.KeyLabel = fmt.Sprintf("ocistow-test-%s-%d", tc.name, time.Now().UnixNano())
+
+			generatePKCS11Key(t, c, c.KeyLabel, tc.mechanism, tc.attrs)
+
+			b, err := NewPKCS11(nil, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sv, err := b.SignerVerifier(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pub, err := sv.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.check(pub) {
+				t.Fatalf("public key is a %T", pub)
+			}
+
+			testSignVerify(t, sv, pub)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// Kind is what a backend provides: signing, registry access (authentication
+// and scan findings) or both.
+type Kind int
+
+const (
+	KindSigner Kind = 1 << iota
+	KindRegistry
+)
+
+func (k Kind) String() string {
+	if k == KindSigner {
+		return "signer"
+	}
+
+	return "registry"
+}
+
+var (
+	ErrUnknownBackend = errors.New("unknown backend")
+	ErrNoSigner       = errors.New("backend does not sign")
+)
+
+// Options are those common to all backends.
+type Options struct {
+	Xray bool
+}
+
+// Factory makes a backend from the flags it registered. Signer backends are
+// given the registry backend to defer everything but signing to, whereas
+// registry backends are given nil. Signer backends may also be given the key to
+// sign with, rather than that of their flags.
+type Factory func(registry Backend, key string, o Options) (Backend, error)
+
+// RegisterFunc registers a backend's flags, named with the backend's name as
+// their prefix, returning its factory. The factory validates the flags.
+type RegisterFunc func(fs *flag.FlagSet) Factory
+
+type registration struct {
+	kind     Kind
+	register RegisterFunc
+}
+
+var registrations = map[string]registration{}
+
+// Register registers a backend by name. It panics if the name is already
+// registered, as it is meant to be called by backends' init.
+func Register(name string, kind Kind, register RegisterFunc) {
+	if _, ok := registrations[name]; ok {
+		panic("backend: " + name + " registered twice")
+	}
+
+	registrations[name] = registration{kind: kind, register: register}
+}
+
+// Names returns the names of the registered backends of the kind.
+func Names(kind Kind) []string {
+	var names []string
+
+	for name, r := range registrations {
+		if r.kind&kind != 0 {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Registry is the registered backends, whose flags are registered on a flag
+// set.
+type Registry struct {
+	factories map[string]Factory
+}
+
+// RegisterFlags registers the flags of all the registered backends on the
+// flag set.
+func RegisterFlags(fs *flag.FlagSet) *Registry {
+	r := &Registry{factories: make(map[string]Factory, len(registrations))}
+
+	for name, reg := range registrations {
+		r.factories[name] = reg.register(fs)
+	}
+
+	return r
+}
+
+// New returns the backend that signs with the named signer backend, and
+// otherwise defers to the named registry backend (which may be the same).
+func (r *Registry) New(registryName, signerName string, o Options) (Backend, error) {
+	factory, err := r.factory(registryName, KindRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := factory(nil, "", o)
+	if err != nil {
+		return nil, fmt.Errorf("configuring %s backend: %w", registryName, err)
+	}
+
+	kb := &keyedBackend{
+		Backend:  registry,
+		r:        r,
+		registry: registry,
+		signer:   signerName,
+		o:        o,
+		signers:  make(map[string]Backend),
+	}
+
+	if signerName == "" || (signerName == registryName && registrations[signerName].kind&KindSigner != 0) {
+		kb.signer = registryName
+
+		return kb, nil
+	}
+
+	if factory, err = r.factory(signerName, KindSigner); err != nil {
+		return nil, err
+	}
+
+	if kb.Backend, err = factory(registry, "", o); err != nil {
+		return nil, fmt.Errorf("configuring %s backend: %w", signerName, err)
+	}
+
+	return kb, nil
+}
+
+func (r *Registry) factory(name string, kind Kind) (Factory, error) {
+	factory, ok := r.factories[name]
+	if !ok || registrations[name].kind&kind == 0 {
+		return nil, fmt.Errorf("%w: %q is not a %s backend (%v)", ErrUnknownBackend, name, kind, Names(kind))
+	}
+
+	return factory, nil
+}
+
+// keyedBackend signs with the keys of key refs by the signer backends they
+// name, or else the signer backend.
+type keyedBackend struct {
+	Backend
+	r        *Registry
+	registry Backend
+	signer   string
+	o        Options
+
+	mu sync.Mutex
+	// signers are the backends of the key refs signed with so far, so that
+	// e.g. their sessions are reused.
+	signers map[string]Backend
+}
+
+func (kb *keyedBackend) KeySignerVerifier(ctx context.Context, keyRef string) (signature.SignerVerifier, error) {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	b, ok := kb.signers[keyRef]
+	if !ok {
+		name, key := kb.signer, keyRef
+		if i := strings.Index(keyRef, ":"); i > 0 {
+			if r, ok := registrations[keyRef[:i]]; ok && r.kind&KindSigner != 0 {
+				name, key = keyRef[:i], keyRef[i+1:]
+			}
+		}
+
+		factory, err := kb.r.factory(name, KindSigner)
+		if err != nil {
+			return nil, err
+		}
+
+		if b, err = factory(kb.registry, key, kb.o); err != nil {
+			return nil, fmt.Errorf("configuring %s backend of key %q: %w", name, keyRef, err)
+		}
+
+		kb.signers[keyRef] = b
+	}
+
+	return b.SignerVerifier(ctx)
+}
+
+// signingBackend signs with the signer backend, and otherwise defers to the
+// registry backend.
+type signingBackend struct {
+	Backend
+	signer Backend
+}
+
+func (sb *signingBackend) SignerVerifier(ctx context.Context) (signature.SignerVerifier, error) {
+	return sb.signer.SignerVerifier(ctx)
+}
@@ -0,0 +1,29 @@
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrScanNotFound    = errors.New("image scan not found")
+	ErrScanInProgress  = errors.New("image scan in progress")
+	ErrScanFailed      = errors.New("image scan failed")
+	ErrScanUnsupported = errors.New("image scans unsupported")
+)
+
+// ScanFindings are the findings of a registry's vulnerability scan of an
+// image.
+type ScanFindings struct {
+	// Scanner that found them and the vulnerability database it used.
+	ScannerURI      string
+	ScannerVersion  string
+	DatabaseURI     string
+	DatabaseVersion string
+
+	StartedOn  time.Time
+	FinishedOn time.Time
+
+	// Findings as reported by the scanner, in its own format.
+	Findings interface{}
+}
@@ -0,0 +1,360 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// VaultAuth is a Vault auth method.
+type VaultAuth string
+
+const (
+	// VaultAuthToken authenticates with a Vault token.
+	VaultAuthToken VaultAuth = "token"
+	// VaultAuthAppRole logs in with an AppRole role and secret ID.
+	VaultAuthAppRole VaultAuth = "approle"
+	// VaultAuthKubernetes logs in with a Kubernetes role and service account
+	// token.
+	VaultAuthKubernetes VaultAuth = "kubernetes"
+
+	// DefaultVaultTransitPath is the default mount path of the transit engine.
+	DefaultVaultTransitPath = "transit"
+
+	kubernetesServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// vaultTokenRenewalMargin is how long before a logged in token expires that
+	// it is replaced.
+	vaultTokenRenewalMargin = time.Minute
+)
+
+var (
+	ErrInvalidVaultConfig = errors.New("invalid Vault config")
+	ErrVaultResponse      = errors.New("unexpected Vault response")
+)
+
+func init() {
+	Register("vault", KindSigner, func(fs *flag.FlagSet) Factory {
+		var c VaultConfig
+
+		fs.StringVar(&c.Address, "vault-address", "", "Vault address (default $VAULT_ADDR)")
+		fs.StringVar(&c.TransitPath, "vault-transit-path", DefaultVaultTransitPath, "Vault transit engine mount path")
+		fs.StringVar(&c.Key, "vault-key", "", "Vault transit key to sign with")
+		fs.StringVar((*string)(&c.Auth), "vault-auth", string(VaultAuthToken), "Vault auth method (token|approle|kubernetes)")
+		fs.StringVar(&c.AuthPath, "vault-auth-path", "", "Vault auth method mount path (default the auth method)")
+		fs.StringVar(&c.Token, "vault-token", "", "Vault token of token auth: file://<path>, env://<name> or the token")
+		fs.StringVar(&c.Role, "vault-role", "", "Vault AppRole role ID or Kubernetes role")
+		fs.StringVar(&c.Secret, "vault-secret", "", "Vault AppRole secret ID or Kubernetes service account token: file://<path>, env://<name> or the secret")
+
+		return func(registry Backend, key string, _ Options) (Backend, error) {
+			c := c
+			if key != "" {
+				c.Key = key
+			}
+
+			return NewVault(registry, c)
+		}
+	})
+}
+
+// VaultConfig is the configuration of a Vault transit signing key.
+type VaultConfig struct {
+	// Address of Vault, which defaults to VAULT_ADDR (as do its TLS settings
+	// to their usual environment variables).
+	Address string
+	// TransitPath is the mount path of the transit engine (default "transit").
+	TransitPath string
+	// Key is the name of the transit key (ECDSA, RSA or Ed25519).
+	Key string
+
+	// Auth is the auth method (default "token"), mounted at AuthPath (default
+	// the name of the method).
+	Auth     VaultAuth
+	AuthPath string
+	// Token is the Vault token of token auth, which defaults to VAULT_TOKEN.
+	Token string
+	// Role is the AppRole role ID, or Kubernetes role.
+	Role string
+	// Secret is the AppRole secret ID, or Kubernetes service account token
+	// (default that of the pod).
+	Secret string
+}
+
+func (c *VaultConfig) validate() error {
+	if c.Key == "" {
+		return fmt.Errorf("%w: no key", ErrInvalidVaultConfig)
+	}
+
+	switch c.Auth {
+	case "", VaultAuthToken:
+	case VaultAuthAppRole:
+		if c.Role == "" || c.Secret == "" {
+			return fmt.Errorf("%w: AppRole auth requires a role and secret ID", ErrInvalidVaultConfig)
+		}
+	case VaultAuthKubernetes:
+		if c.Role == "" {
+			return fmt.Errorf("%w: Kubernetes auth requires a role", ErrInvalidVaultConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported auth method %q", ErrInvalidVaultConfig, c.Auth)
+	}
+
+	return nil
+}
+
+// NewVault returns a backend that signs with a Vault transit key, and
+// otherwise defers to the registry backend (e.g. for registry
+// authentication). Secrets of the config may be given by source, as per the
+// PKCS#11 PIN.
+func NewVault(registry Backend, c VaultConfig) (Backend, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.TransitPath == "" {
+		c.TransitPath = DefaultVaultTransitPath
+	}
+
+	if c.Auth == "" {
+		c.Auth = VaultAuthToken
+	}
+
+	if c.AuthPath == "" {
+		c.AuthPath = string(c.Auth)
+	}
+
+	if c.Auth == VaultAuthKubernetes && c.Secret == "" {
+		c.Secret = fileKeyPrefix + kubernetesServiceAccountTokenPath
+	}
+
+	vc := vault.DefaultConfig()
+	if vc.Error != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidVaultConfig, vc.Error)
+	}
+
+	if c.Address != "" {
+		vc.Address = c.Address
+	}
+
+	client, err := vault.NewClient(vc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidVaultConfig, err)
+	}
+
+	return &vaultBackend{Backend: registry, cfg: c, client: client}, nil
+}
+
+type vaultBackend struct {
+	Backend
+	cfg VaultConfig
+
+	mu          sync.Mutex
+	client      *vault.Client
+	tokenExpiry time.Time
+}
+
+func (vb *vaultBackend) SignerVerifier(ctx context.Context) (signature.SignerVerifier, error) {
+	vb.mu.Lock()
+	defer vb.mu.Unlock()
+
+	if err := vb.authenticate(); err != nil {
+		return nil, err
+	}
+
+	return newVaultSignerVerifier(vb.client, vb.cfg.TransitPath, vb.cfg.Key)
+}
+
+// authenticate sets the client's token, logging in afresh if its last login
+// has (nearly) expired.
+func (vb *vaultBackend) authenticate() error {
+	if vb.cfg.Auth == VaultAuthToken {
+		if vb.cfg.Token != "" {
+			token, err := readSecret(vb.cfg.Token)
+			if err != nil {
+				return fmt.Errorf("reading Vault token: %w", err)
+			}
+
+			vb.client.SetToken(token)
+		}
+
+		if vb.client.Token() == "" {
+			return fmt.Errorf("%w: no token", ErrInvalidVaultConfig)
+		}
+
+		return nil
+	}
+
+	if vb.client.Token() != "" && time.Now().Add(vaultTokenRenewalMargin).Before(vb.tokenExpiry) {
+		return nil
+	}
+
+	secret, err := readSecret(vb.cfg.Secret)
+	if err != nil {
+		return fmt.Errorf("reading Vault %s secret: %w", vb.cfg.Auth, err)
+	}
+
+	login := map[string]interface{}{"role": vb.cfg.Role, "jwt": secret}
+	if vb.cfg.Auth == VaultAuthAppRole {
+		login = map[string]interface{}{"role_id": vb.cfg.Role, "secret_id": secret}
+	}
+
+	// Logging in must not use a previous (expired) token.
+	vb.client.ClearToken()
+
+	s, err := vb.client.Logical().Write("auth/"+vb.cfg.AuthPath+"/login", login)
+	if err != nil {
+		return fmt.Errorf("logging into Vault: %w", err)
+	}
+
+	if s == nil || s.Auth == nil || s.Auth.ClientToken == "" {
+		return fmt.Errorf("%w: no token from login", ErrVaultResponse)
+	}
+
+	vb.client.SetToken(s.Auth.ClientToken)
+	vb.tokenExpiry = time.Now().Add(time.Duration(s.Auth.LeaseDuration) * time.Second)
+
+	return nil
+}
+
+// vaultSignerVerifier signs with the latest version of a Vault transit key,
+// and verifies with its public key.
+type vaultSignerVerifier struct {
+	signature.Verifier
+
+	client *vault.Client
+	path   string
+	key    string
+	// version is that of the key, whose public key is pub, so that a
+	// rotation of the key does not sign with another.
+	version json.Number
+	pub     crypto.PublicKey
+}
+
+var _ (signature.SignerVerifier) = (*vaultSignerVerifier)(nil)
+
+func newVaultSignerVerifier(client *vault.Client, transitPath, key string) (*vaultSignerVerifier, error) {
+	s, err := client.Logical().Read(transitPath + "/keys/" + key)
+	if err != nil {
+		return nil, fmt.Errorf("reading Vault transit key %q: %w", key, err)
+	}
+
+	if s == nil {
+		return nil, fmt.Errorf("%w: no transit key %q", ErrInvalidVaultConfig, key)
+	}
+
+	version, pub, err := vaultPublicKey(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("reading Vault transit key %q: %w", key, err)
+	}
+
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("loading Vault transit public key: %w", err)
+	}
+
+	return &vaultSignerVerifier{
+		Verifier: verifier,
+		client:   client,
+		path:     transitPath,
+		key:      key,
+		version:  version,
+		pub:      pub,
+	}, nil
+}
+
+// vaultPublicKey returns the latest version of a transit key, and its public
+// key, from its description.
+func vaultPublicKey(data map[string]interface{}) (json.Number, crypto.PublicKey, error) {
+	latest, ok := data["latest_version"].(json.Number)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: no latest version", ErrVaultResponse)
+	}
+
+	keys, _ := data["keys"].(map[string]interface{})
+	version, _ := keys[latest.String()].(map[string]interface{})
+
+	public, _ := version["public_key"].(string)
+	if public == "" {
+		return "", nil, fmt.Errorf("%w: not an asymmetric key", ErrInvalidKey)
+	}
+
+	// Ed25519 public keys are given raw (base64), rather than as PEM.
+	if data["type"] == "ed25519" {
+		b, err := base64.StdEncoding.DecodeString(public)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return "", nil, fmt.Errorf("%w: malformed Ed25519 public key", ErrVaultResponse)
+		}
+
+		return latest, ed25519.PublicKey(b), nil
+	}
+
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(public))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+
+	return latest, pub, nil
+}
+
+func (sv *vaultSignerVerifier) PublicKey(...signature.PublicKeyOption) (crypto.PublicKey, error) {
+	return sv.pub, nil
+}
+
+// SignMessage signs the message (or rather its SHA-256 digest, but for
+// Ed25519) as per Go (and cosign): ASN.1 DER ECDSA or PKCS#1 v1.5 RSA
+// signatures.
+func (sv *vaultSignerVerifier) SignMessage(message io.Reader, _ ...signature.SignOption) ([]byte, error) {
+	b, err := ioutil.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+
+	req := map[string]interface{}{"key_version": sv.version}
+
+	if _, ok := sv.pub.(ed25519.PublicKey); ok {
+		req["input"] = base64.StdEncoding.EncodeToString(b)
+	} else {
+		digest := sha256.Sum256(b)
+
+		req["input"] = base64.StdEncoding.EncodeToString(digest[:])
+		req["prehashed"] = true
+		req["hash_algorithm"] = "sha2-256"
+		req["signature_algorithm"] = "pkcs1v15"
+		req["marshaling_algorithm"] = "asn1"
+	}
+
+	s, err := sv.client.Logical().Write(sv.path+"/sign/"+sv.key, req)
+	if err != nil {
+		return nil, fmt.Errorf("signing with Vault transit key %q: %w", sv.key, err)
+	}
+
+	if s == nil {
+		return nil, fmt.Errorf("%w: no signature", ErrVaultResponse)
+	}
+
+	sig, _ := s.Data["signature"].(string)
+
+	// Signatures are of the form vault:v<version>:<base64>.
+	parts := strings.SplitN(sig, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("%w: malformed signature", ErrVaultResponse)
+	}
+
+	return base64.StdEncoding.DecodeString(parts[2])
+}
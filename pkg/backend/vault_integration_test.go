@@ -0,0 +1,216 @@
+//go:build integration
+// +build integration
+
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// testVaultClient returns a client of a Vault (dev) server to test against,
+// with its transit engine enabled at the default path:
+//
+//	vault server -dev -dev-root-token-id=root &
+//	VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=root \
+//	go test -tags integration ./pkg/backend
+func testVaultClient(t *testing.T) *vault.Client {
+	t.Helper()
+
+	if os.Getenv("VAULT_ADDR") == "" || os.Getenv("VAULT_TOKEN") == "" {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN are not set")
+	}
+
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := mounts[DefaultVaultTransitPath+"/"]; !ok {
+		if err := client.Sys().Mount(DefaultVaultTransitPath, &vault.MountInput{Type: "transit"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return client
+}
+
+// createVaultKey creates a transit key of the type, which is deleted once the
+// test is done.
+func createVaultKey(t *testing.T, client *vault.Client, keyType string) string {
+	t.Helper()
+
+	key := fmt.Sprintf("ocistow-test-%s-%d", keyType, time.Now().UnixNano())
+	path := DefaultVaultTransitPath + "/keys/" + key
+
+	if _, err := client.Logical().Write(path, map[string]interface{}{"type": keyType}); err != nil {
+		t.Fatalf("creating transit key %q: %s", key, err)
+	}
+
+	t.Cleanup(func() {
+		client.Logical().Write(path+"/config", map[string]interface{}{"deletion_allowed": true})
+		client.Logical().Delete(path)
+	})
+
+	return key
+}
+
+func TestVaultSignVerify(t *testing.T) {
+	client := testVaultClient(t)
+
+	for _, tc := range []struct {
+		keyType string
+		check   func(crypto.PublicKey) bool
+	}{
+		{"ecdsa-p256", func(pub crypto.PublicKey) bool { _, ok := pub.(*ecdsa.PublicKey); return ok }},
+		{"rsa-2048", func(pub crypto.PublicKey) bool { _, ok := pub.(*rsa.PublicKey); return ok }},
+		{"ed25519", func(pub crypto.PublicKey) bool { _, ok := pub.(ed25519.PublicKey); return ok }},
+	} {
+		tc := tc
+
+		t.Run(tc.keyType, func(t *testing.T) {
+			key := createVaultKey(t, client, tc.keyType)
+
+			b, err := NewVault(nil, VaultConfig{Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sv, err := b.SignerVerifier(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pub, err := sv.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.check(pub) {
+				t.Fatalf("public key is a %T", pub)
+			}
+
+			testSignVerify(t, sv, pub)
+
+			// A rotation of the key must not change the key that is signed
+			// with until the signer is next asked for.
+			if _, err := client.Logical().Write(DefaultVaultTransitPath+"/keys/"+key+"/rotate", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			testSignVerify(t, sv, pub)
+
+			rotated, err := b.SignerVerifier(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rotatedPub, err := rotated.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reflect.DeepEqual(pub, rotatedPub) {
+				t.Error("public key of the rotated key is unchanged")
+			}
+
+			testSignVerify(t, rotated, rotatedPub)
+		})
+	}
+}
+
+func TestVaultAppRoleSignVerify(t *testing.T) {
+	client := testVaultClient(t)
+	key := createVaultKey(t, client, "ecdsa-p256")
+
+	auths, err := client.Sys().ListAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := auths[string(VaultAuthAppRole)+"/"]; !ok {
+		if err := client.Sys().EnableAuthWithOptions(string(VaultAuthAppRole), &vault.EnableAuthOptions{
+			Type: string(VaultAuthAppRole),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := fmt.Sprintf(`
+path "%[1]s/keys/%[2]s" { capabilities = ["read"] }
+path "%[1]s/sign/%[2]s" { capabilities = ["update"] }
+`, DefaultVaultTransitPath, key)
+
+	if err := client.Sys().PutPolicy(key, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Sys().DeletePolicy(key) })
+
+	role := "auth/" + string(VaultAuthAppRole) + "/role/" + key
+
+	if _, err := client.Logical().Write(role, map[string]interface{}{
+		"token_policies": key,
+		"token_ttl":      "5m",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Logical().Delete(role) })
+
+	roleID, err := client.Logical().Read(role + "/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretID, err := client.Logical().Write(role+"/secret-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("OCISTOW_TEST_VAULT_SECRET_ID", secretID.Data["secret_id"].(string))
+	defer os.Unsetenv("OCISTOW_TEST_VAULT_SECRET_ID")
+
+	// The backend must log in itself, rather than use the environment's
+	// token.
+	token := os.Getenv("VAULT_TOKEN")
+	os.Unsetenv("VAULT_TOKEN")
+	defer os.Setenv("VAULT_TOKEN", token)
+
+	b, err := NewVault(nil, VaultConfig{
+		Key:    key,
+		Auth:   VaultAuthAppRole,
+		Role:   roleID.Data["role_id"].(string),
+		Secret: envKeyPrefix + "OCISTOW_TEST_VAULT_SECRET_ID",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sv, err := b.SignerVerifier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := sv.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSignVerify(t, sv, pub)
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 
+	"github.com/martinbaillie/ocistow/pkg/backend"
+	"github.com/martinbaillie/ocistow/pkg/soci"
+
 	ff "github.com/peterbourgon/ff/v3"
 )
 
@@ -26,12 +30,46 @@ type Config struct {
 
 	Debug *bool
 
-	Copy *bool
-	Sign *bool
+	Copy   *bool
+	Sign   *bool
+	Verify *bool
+
+	Policy       *string
+	Inspect      *string
+	InspectAllow *StringSlice
+
+	Provenance   *bool
+	SBOM         *string
+	ScanFindings *bool
+	ScanTimeout  *time.Duration
+
+	SignatureReferrers  *bool
+	SignatureRepository *string
+	SignatureSuffix     *string
+	SignatureReplace    *bool
+	SignatureValidity   *time.Duration
+	SignatureUnbounded  *bool
+
+	ConvertMediaTypes *string
+	LayerCompression  *string
+	SOCIIndex         *bool
+	SOCIMinLayerSize  *int64
+
+	Estargz                 *bool
+	EstargzPrioritizedFiles *StringSlice
 
-	AWSXray      *bool
-	AWSKMSKeyARN *string
-	AWSRegion    *string
+	EncryptRecipients *StringSlice
+	EncryptLayers     *StringSlice
+	DecryptKeys       *StringSlice
+
+	Backend       *string
+	Signer        *string
+	KeyRoutes     *string
+	CoSigningKeys *StringSlice
+
+	AWSXray *bool
+
+	backends *backend.Registry
 }
 
 func (c *Config) Parse(argv []string) error {
@@ -39,15 +77,52 @@ func (c *Config) Parse(argv []string) error {
 
 	c.Copy = c.Bool("copy", true, "whether to copy the image")
 	c.Sign = c.Bool("sign", true, "whether to sign the image")
+	c.Verify = c.Bool("verify", false, "whether to verify the image signature")
+
+	c.Policy = c.String("policy", "", "promotion policy of JMESPath deny rules to enforce when copying (JSON or path to it)")
+	c.Inspect = c.String("inspect", "", "inspect copied image layers for secrets and unsafe files, and block|annotate|attest findings")
+	c.InspectAllow = c.StringSlice("inspect-allow", "path globs, optionally rule: qualified, of layer inspection findings to ignore (comma separated)")
+
+	c.Provenance = c.Bool("provenance", false, "whether to attest the SLSA provenance of copied images")
+	c.SBOM = c.String("sbom", "", "generate an SBOM of copied images to attest (spdx|cyclonedx)")
+	c.ScanFindings = c.Bool("scan-findings", false, "whether to attest the registry's vulnerability scan findings of the image")
+	c.ScanTimeout = c.Duration("scan-timeout", 5*time.Minute, "how long to wait for the registry to finish scanning the image")
+
+	c.SignatureReferrers = c.Bool("signature-referrers", false, "whether to store signatures as OCI 1.1 referrers rather than cosign tags")
+	c.SignatureRepository = c.String("signature-repository", os.Getenv("COSIGN_REPOSITORY"), "repository to store signatures in rather than alongside the image")
+	c.SignatureSuffix = c.String("signature-suffix", "", "signature tag suffix, where {tag} is replaced by the image tag (default \".sig\")")
+	c.SignatureValidity = c.Duration("signature-validity", 0, "how long signatures claim to be valid for, enforced by -verify (default forever)")
+	c.SignatureUnbounded = c.Bool("signature-unbounded", false, "whether -verify accepts signatures that claim no expiry despite -signature-validity, e.g. legacy ones")
+	c.SignatureReplace = c.Bool("signature-replace", false, "whether signing replaces earlier signatures by the same key rather than adding to them")
+
+	c.ConvertMediaTypes = c.String("convert-media-types", "", "convert image media types when copying (oci|docker)")
+	c.LayerCompression = c.String("layer-compression", "", "recompress image layers when copying (gzip|zstd)")
+	c.SOCIIndex = c.Bool("soci-index", false, "whether to generate a SOCI index for lazy loading when copying")
+	c.SOCIMinLayerSize = c.Int64("soci-min-layer-size", soci.DefaultMinLayerSize, "minimum layer size in bytes to include in a SOCI index")
+	c.Estargz = c.Bool("estargz", false, "whether to convert image layers to eStargz for lazy loading when copying")
+	c.EstargzPrioritizedFiles = c.StringSlice("estargz-prioritized-files", "files to prioritise for prefetching in eStargz layers (comma separated)")
+	c.EncryptRecipients = c.StringSlice("encrypt-recipients", "PEM public keys (or paths to them) to encrypt image layers for when copying (comma separated)")
+	c.EncryptLayers = c.StringSlice("encrypt-layers", "indexes of the image layers to encrypt, negative from the top (comma separated, default all)")
+	c.DecryptKeys = c.StringSlice("decrypt-keys", "PEM private keys (or paths to them) to decrypt encrypted image layers with when copying (comma separated)")
+
+	c.Backend = c.String("backend", "aws", fmt.Sprintf("registry backend, for authentication and scan findings (%s)", strings.Join(backend.Names(backend.KindRegistry), "|")))
+	c.Signer = c.String("signer", "aws", fmt.Sprintf("signing backend (%s)", strings.Join(backend.Names(backend.KindSigner), "|")))
+	c.KeyRoutes = c.String("key-routes", "", "routes of destination repository (and annotation) patterns to the keys that sign them (JSON or path to it)")
+	c.CoSigningKeys = c.StringSlice("co-signing-keys", "refs of keys to co-sign with, [<signer>:]<key> e.g. vault:security (comma separated)")
+	c.backends = backend.RegisterFlags(c.FlagSet)
 
 	_, xrayDefault := os.LookupEnv("AWS_XRAY_DAEMON_ADDRESS")
 	c.AWSXray = c.Bool("aws-xray", xrayDefault, "whether to enable AWS Xray tracing")
-	c.AWSKMSKeyARN = c.String("aws-kms-key-arn", "", "AWS KMS key ARN to use for signing")
-	c.AWSRegion = c.String("aws-region", "", "AWS region to use for operations")
 
 	return ff.Parse(c.FlagSet, argv, ff.WithEnvVarNoPrefix())
 }
 
+// NewBackend returns the configured backend: that which signs with the signer
+// backend, and otherwise defers to the registry backend.
+func (c *Config) NewBackend() (backend.Backend, error) {
+	return c.backends.New(*c.Backend, *c.Signer, backend.Options{Xray: *c.AWSXray})
+}
+
 func (c *Config) StringMap(name string, usage string) *StringMap {
 	p := make(StringMap)
 
@@ -59,7 +134,7 @@ func (c *Config) StringMap(name string, usage string) *StringMap {
 type StringMap map[string]string
 
 func (sm *StringMap) Set(s string) error {
-	kvs := strings.Split(s, "=")
+	kvs := strings.SplitN(s, "=", 2)
 	if len(kvs) != 2 {
 		return fmt.Errorf("invalid key=value pair: %s", s)
 	}
@@ -76,3 +151,65 @@ func (sm *StringMap) String() (ret string) {
 
 	return ret
 }
+
+func (c *Config) StringSlice(name string, usage string) *StringSlice {
+	p := make(StringSlice, 0)
+
+	c.Var(&p, name, usage)
+
+	return (&p)
+}
+
+type StringSlice []string
+
+func (ss *StringSlice) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*ss = append(*ss, v)
+		}
+	}
+
+	return nil
+}
+
+func (ss *StringSlice) String() string {
+	return strings.Join(*ss, ",")
+}
+
+func (c *Config) KeyValueSlice(name string, usage string) *KeyValueSlice {
+	p := make(KeyValueSlice, 0)
+
+	c.Var(&p, name, usage)
+
+	return (&p)
+}
+
+// KeyValue is a key=value pair of a KeyValueSlice.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// KeyValueSlice is a repeatable flag of key=value pairs which, unlike a
+// StringMap, keeps every pair of a repeated key, in the order given.
+type KeyValueSlice []KeyValue
+
+func (kvs *KeyValueSlice) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("invalid key=value pair: %s", s)
+	}
+
+	*kvs = append(*kvs, KeyValue{Key: kv[0], Value: kv[1]})
+
+	return nil
+}
+
+func (kvs *KeyValueSlice) String() string {
+	pairs := make([]string, len(*kvs))
+	for i, kv := range *kvs {
+		pairs[i] = fmt.Sprintf("%s=%s", kv.Key, kv.Value)
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,178 @@
+// Package ecrfake is a local fake of the AWS ECR image scan findings API, so
+// that scan attestations can be exercised without AWS.
+package ecrfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	targetPrefix = "AmazonEC2ContainerRegistry_V20150921."
+
+	defaultMaxResults = 100
+)
+
+// Scan is the scan of an image, with findings in the (basic or enhanced) form
+// of the ECR API.
+type Scan struct {
+	// Status defaults to COMPLETE.
+	Status      string `json:"status,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	CompletedAt                  time.Time `json:"completedAt,omitempty"`
+	VulnerabilitySourceUpdatedAt time.Time `json:"vulnerabilitySourceUpdatedAt,omitempty"`
+
+	Findings         []json.RawMessage `json:"findings,omitempty"`
+	EnhancedFindings []json.RawMessage `json:"enhancedFindings,omitempty"`
+}
+
+// Server serves the DescribeImageScanFindings action of the ECR API for the
+// scans that have been set.
+type Server struct {
+	mu    sync.Mutex
+	scans map[string]Scan
+}
+
+var _ (http.Handler) = (*Server)(nil)
+
+func New() *Server {
+	return &Server{scans: make(map[string]Scan)}
+}
+
+// SetScan sets the scan of the image of the digest in the repository (by its
+// name within the registry, e.g. "team/app").
+func (s *Server) SetScan(repository, digest string, scan Scan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scans[repository+"@"+digest] = scan
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "UnsupportedOperation", r.Method)
+		return
+	}
+
+	if action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix); action != "DescribeImageScanFindings" {
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", action)
+		return
+	}
+
+	var in struct {
+		RepositoryName string `json:"repositoryName"`
+		ImageID        struct {
+			ImageDigest string `json:"imageDigest"`
+		} `json:"imageId"`
+		NextToken  string `json:"nextToken"`
+		MaxResults int    `json:"maxResults"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidParameterException", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	scan, ok := s.scans[in.RepositoryName+"@"+in.ImageID.ImageDigest]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ScanNotFoundException", fmt.Sprintf(
+			"Image scan does not exist for the image with '{imageDigest:%s}' in the repository with name '%s'",
+			in.ImageID.ImageDigest, in.RepositoryName,
+		))
+
+		return
+	}
+
+	status := scan.Status
+	if status == "" {
+		status = "COMPLETE"
+	}
+
+	out := map[string]interface{}{
+		"repositoryName":  in.RepositoryName,
+		"imageId":         in.ImageID,
+		"imageScanStatus": map[string]string{"status": status, "description": scan.Description},
+	}
+
+	if status == "COMPLETE" || status == "ACTIVE" {
+		// Findings are paged across both kinds, as a single offset.
+		offset, _ := strconv.Atoi(in.NextToken)
+
+		max := in.MaxResults
+		if max <= 0 {
+			max = defaultMaxResults
+		}
+
+		all := append(append([]json.RawMessage{}, scan.Findings...), scan.EnhancedFindings...)
+
+		end := offset + max
+		if end >= len(all) {
+			end = len(all)
+		} else {
+			out["nextToken"] = strconv.Itoa(end)
+		}
+
+		findings := map[string]interface{}{
+			"findingSeverityCounts": severityCounts(all),
+		}
+
+		if !scan.CompletedAt.IsZero() {
+			findings["imageScanCompletedAt"] = epochSeconds(scan.CompletedAt)
+		}
+
+		if !scan.VulnerabilitySourceUpdatedAt.IsZero() {
+			findings["vulnerabilitySourceUpdatedAt"] = epochSeconds(scan.VulnerabilitySourceUpdatedAt)
+		}
+
+		for i := offset; i < end; i++ {
+			key := "findings"
+			if i >= len(scan.Findings) {
+				key = "enhancedFindings"
+			}
+
+			page, _ := findings[key].([]json.RawMessage)
+			findings[key] = append(page, all[i])
+		}
+
+		out["imageScanFindings"] = findings
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(out)
+}
+
+// severityCounts counts the findings by their severity.
+func severityCounts(findings []json.RawMessage) map[string]int64 {
+	counts := make(map[string]int64)
+
+	for _, f := range findings {
+		var finding struct {
+			Severity string `json:"severity"`
+		}
+
+		if err := json.Unmarshal(f, &finding); err == nil && finding.Severity != "" {
+			counts[finding.Severity]++
+		}
+	}
+
+	return counts
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
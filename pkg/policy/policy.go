@@ -0,0 +1,221 @@
+// Package policy evaluates promotion policies against the images (and other
+// artifacts) being promoted.
+//
+// A policy is a list of rules, each of which denies a promotion when its
+// JMESPath (https://jmespath.org) expression evaluates truthy against any
+// Input of the promotion. Note that negation binds more tightly than
+// sub-expressions in JMESPath, so "!(annotations.team)" rather than
+// "!annotations.team".
+//
+// Every promotion is evaluated as the Input of what it promotes, be it an
+// image, other artifact or index. An index is evaluated as each of the images
+// (and artifacts) within it, and any nested indexes, as well, so rules about
+// image contents should be qualified by kind. For example:
+//
+//	{
+//	  "rules": [
+//	    {"name": "team", "deny": "!(annotations.team)", "message": "a team annotation is required"},
+//	    {"name": "root", "deny": "kind == 'image' && contains(['', 'root', '0'], config.config.User || '')", "message": "images must not run as root"},
+//	    {"name": "size", "deny": "size > `1073741824`", "message": "promotions must be under 1GiB"},
+//	    {"name": "latest", "deny": "tag == 'latest'", "message": "images must not be promoted as latest"}
+//	  ]
+//	}
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var (
+	ErrInvalidPolicy = errors.New("invalid policy")
+	ErrDenied        = errors.New("denied by policy")
+)
+
+// Policy is a list of rules that deny promotions.
+type Policy struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Rule denies promotions of images whose input the Deny expression evaluates
+// truthy (i.e. not false, null or empty) against.
+type Rule struct {
+	Name    string `json:"name"`
+	Deny    string `json:"deny"`
+	Message string `json:"message,omitempty"`
+
+	deny *jmespath.JMESPath
+}
+
+// Parse parses and compiles a JSON policy.
+func Parse(b []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPolicy, err)
+	}
+
+	names := make(map[string]bool, len(p.Rules))
+
+	for i, r := range p.Rules {
+		if r == nil || r.Name == "" {
+			return nil, fmt.Errorf("%w: rule %d has no name", ErrInvalidPolicy, i)
+		}
+
+		if names[r.Name] {
+			return nil, fmt.Errorf("%w: duplicate rule %q", ErrInvalidPolicy, r.Name)
+		}
+
+		names[r.Name] = true
+
+		var err error
+		if r.deny, err = jmespath.Compile(r.Deny); err != nil {
+			return nil, fmt.Errorf("%w: rule %q: %s", ErrInvalidPolicy, r.Name, err)
+		}
+	}
+
+	return &p, nil
+}
+
+// Kinds of Input.
+const (
+	KindImage    = "image"
+	KindArtifact = "artifact"
+	KindIndex    = "index"
+)
+
+// RuleNothingToEvaluate is the rule of the violation of an index that has no
+// images or artifacts to evaluate, which is denied rather than let through.
+const RuleNothingToEvaluate = "nothing-to-evaluate"
+
+// Input is what rules are evaluated against: an image, other artifact or index
+// and the request to promote it.
+type Input struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Tag of the destination, if promoted by tag.
+	Tag         string            `json:"tag"`
+	Annotations map[string]string `json:"annotations"`
+
+	// Kind is that of the manifest: KindImage, KindArtifact or KindIndex.
+	Kind      string          `json:"kind"`
+	Digest    string          `json:"digest"`
+	MediaType string          `json:"mediaType"`
+	Platform  *v1.Platform    `json:"platform,omitempty"`
+	Manifest  json.RawMessage `json:"manifest"`
+	// Config of images (i.e. not other artifacts) and its labels.
+	Config *v1.ConfigFile    `json:"config,omitempty"`
+	Labels map[string]string `json:"labels"`
+	Layers []v1.Descriptor   `json:"layers"`
+	// Size is that of the config and (compressed) layers, or for an index,
+	// the total of its images and artifacts.
+	Size int64 `json:"size"`
+}
+
+// Violation is a rule that denied the promotion of an image.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message,omitempty"`
+	// Digest is that of the offending image, or of its offending layer.
+	Digest   string `json:"digest"`
+	Platform string `json:"platform,omitempty"`
+	// Details are what the rule evaluated to, if more than true (e.g. the
+	// offending layers).
+	Details interface{} `json:"details,omitempty"`
+}
+
+// DeniedError is the error of a promotion denied by policy, with the
+// violations that denied it.
+type DeniedError struct {
+	Violations []Violation
+}
+
+func (e *DeniedError) Error() string {
+	rules := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		rules[i] = v.Rule
+		if v.Message != "" {
+			rules[i] += " (" + v.Message + ")"
+		}
+	}
+
+	return fmt.Sprintf("%s: %s", ErrDenied, strings.Join(rules, ", "))
+}
+
+func (e *DeniedError) Unwrap() error {
+	return ErrDenied
+}
+
+// Evaluate returns the violations of the rules by the input.
+func (p *Policy) Evaluate(in *Input) ([]Violation, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// JMESPath expressions are evaluated against the JSON of the input, so
+	// that its field names are as documented.
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+
+	var violations []Violation
+
+	for _, r := range p.Rules {
+		result, err := r.deny.Search(data)
+		if err != nil {
+			return nil, fmt.Errorf("evaluating rule %q: %w", r.Name, err)
+		}
+
+		if !truthy(result) {
+			continue
+		}
+
+		v := Violation{Rule: r.Name, Message: r.Message, Digest: in.Digest}
+
+		if in.Platform != nil {
+			v.Platform = platformString(in.Platform)
+		}
+
+		if result != true {
+			v.Details = result
+		}
+
+		violations = append(violations, v)
+	}
+
+	return violations, nil
+}
+
+func platformString(p *v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+
+	return s
+}
+
+// truthy is JMESPath's notion of truth.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// imageConfigMediaTypes are the config media types of container images. Any
+// other manifest (e.g. a Helm chart, WASM module or Flux artifact) is an OCI
+// artifact that merely reuses the image manifest format, if that.
+var imageConfigMediaTypes = map[types.MediaType]bool{
+	types.DockerConfigJSON: true,
+	types.OCIConfigJSON:    true,
+}
+
+// artifactManifest is the part of an image or artifact manifest that refers to
+// blobs.
+type artifactManifest struct {
+	Config *v1.Descriptor  `json:"config,omitempty"`
+	Layers []v1.Descriptor `json:"layers,omitempty"`
+	Blobs  []v1.Descriptor `json:"blobs,omitempty"`
+}
+
+// isImage reports whether the non-index manifest is that of a container image.
+func isImage(mediaType types.MediaType, manifest []byte) (bool, error) {
+	if !mediaType.IsImage() {
+		return false, nil
+	}
+
+	var m artifactManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return false, fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	return m.Config != nil && imageConfigMediaTypes[m.Config.MediaType], nil
+}
+
+// writeArtifact copies the OCI artifact at src to the destination as is,
+// other than merging the annotations into those of its manifest. Nothing about
+// an artifact's config or blobs can be assumed, so none of the image mutations
+// apply.
+func (s *service) writeArtifact(
+	ctx context.Context,
+	srcRef name.Reference,
+	srcDesc *remote.Descriptor,
+	dstRef name.Reference,
+	annotations map[string]string,
+) error {
+	var m artifactManifest
+	if err := json.Unmarshal(srcDesc.Manifest, &m); err != nil {
+		return fmt.Errorf("parsing artifact manifest: %w", err)
+	}
+
+	blobs := append(m.Layers, m.Blobs...)
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+
+	for _, desc := range blobs {
+		if !desc.MediaType.IsDistributable() {
+			continue
+		}
+
+		// Remote layers are mounted across repositories where possible.
+		l, err := remote.Layer(srcRef.Context().Digest(desc.Digest.String()), s.backend.RemoteOpts(ctx)...)
+		if err != nil {
+			return fmt.Errorf("fetching blob %q: %w", desc.Digest, err)
+		}
+
+		if err := remote.WriteLayer(dstRef.Context(), l, s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("writing blob %q: %w", desc.Digest, err)
+		}
+	}
+
+	manifest, err := annotateManifest(srcDesc.Manifest, annotations)
+	if err != nil {
+		return err
+	}
+
+	if err := remote.Put(
+		dstRef, &rawManifest{manifest, srcDesc.MediaType}, s.backend.RemoteOpts(ctx)...,
+	); err != nil {
+		return fmt.Errorf("writing destination artifact %q: %w", dstRef.Name(), err)
+	}
+
+	return nil
+}
+
+// annotateManifest merges the annotations into those of the serialised
+// manifest, leaving every other field (including any the Go container registry
+// libraries do not know of) untouched.
+func annotateManifest(manifest []byte, annotations map[string]string) ([]byte, error) {
+	if len(annotations) == 0 {
+		return manifest, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	merged := make(map[string]string, len(annotations))
+	if raw, ok := fields["annotations"]; ok {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return nil, fmt.Errorf("parsing manifest annotations: %w", err)
+		}
+	}
+
+	for k, v := range annotations {
+		merged[k] = v
+	}
+
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["annotations"] = b
+
+	return json.Marshal(fields)
+}
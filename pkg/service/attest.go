@@ -0,0 +1,229 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/in-toto/in-toto-golang/in_toto"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/cosign/pkg/oci/static"
+	"github.com/sigstore/cosign/pkg/oci/walk"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/dsse"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	cosremote "github.com/sigstore/cosign/pkg/cosign/remote"
+	ocimutate "github.com/sigstore/cosign/pkg/oci/mutate"
+	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
+	costypes "github.com/sigstore/cosign/pkg/types"
+	sigopts "github.com/sigstore/sigstore/pkg/signature/options"
+)
+
+// AttestationArtifactType is the artifact type of cosign attestations stored
+// as OCI 1.1 referrers.
+const AttestationArtifactType = costypes.DssePayloadType
+
+var (
+	ErrInvalidAttestation         = errors.New("invalid attestation")
+	ErrAttestationSubjectNotFound = errors.New("attestation subject not found")
+)
+
+// attestation is a predicate to attest alongside a signature.
+type attestation struct {
+	// subject is the digest of the image (or index) attested about, if not
+	// the signed one.
+	subject       v1.Hash
+	predicateType string
+	predicate     json.RawMessage
+}
+
+func (a attestation) validate() error {
+	if a.predicateType == "" {
+		return fmt.Errorf("%w: missing predicate type", ErrInvalidAttestation)
+	}
+
+	if !json.Valid(a.predicate) {
+		return fmt.Errorf("%w: %q predicate is not JSON", ErrInvalidAttestation, a.predicateType)
+	}
+
+	return nil
+}
+
+// attestationSuffix returns the attestation tag suffix that goes with the
+// signature tag suffix, e.g. ".1.2.3.att" for ".1.2.3.sig".
+func attestationSuffix(sigSuffix string) string {
+	return strings.TrimSuffix(sigSuffix, ociremote.SignatureTagSuffix) + ociremote.AttestationTagSuffix
+}
+
+// Attest signs an in-toto statement of the predicate about the image (or
+// index) at dst as a DSSE envelope and attaches it as a cosign attestation.
+// Attestations are stored alongside signatures, as per the options.
+func (s *service) Attest(
+	ctx context.Context, dst, predicateType string, predicate interface{}, opts ...SignOption,
+) error {
+	o := makeSignOpts(opts...)
+
+	dstRef, err := parseOCIReference(dst)
+	if err != nil {
+		return fmt.Errorf("parsing destination reference %q: %w", dst, err)
+	}
+
+	sigRepo, err := o.signatureRepository(dstRef.Context())
+	if err != nil {
+		return err
+	}
+
+	sigSuffix, err := o.signatureSuffix(dstRef, sigRepo)
+	if err != nil {
+		return err
+	}
+
+	k, err := s.routedSignerVerifier(ctx, dstRef, o)
+	if err != nil {
+		return err
+	}
+
+	se, err := ociremote.SignedEntity(dstRef, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
+	if err != nil {
+		return fmt.Errorf("discovering signed entity: %w", err)
+	}
+
+	return s.attest(ctx, k, dstRef.Context(), se, sigRepo, sigSuffix, o.referrers, predicateType, predicate)
+}
+
+// attest attaches a signed attestation of the predicate to the signed entity
+// of the repository.
+func (s *service) attest(
+	ctx context.Context,
+	k signature.SignerVerifier,
+	repo name.Repository,
+	se oci.SignedEntity,
+	sigRepo name.Repository,
+	sigSuffix string,
+	referrers bool,
+	predicateType string,
+	predicate interface{},
+) error {
+	subject, err := signedEntityDescriptor(se)
+	if err != nil {
+		return err
+	}
+
+	statement, err := json.Marshal(&in_toto.Statement{
+		StatementHeader: in_toto.StatementHeader{
+			Type:          in_toto.StatementInTotoV01,
+			PredicateType: predicateType,
+			Subject: []in_toto.Subject{{
+				Name:   repo.Name(),
+				Digest: in_toto.DigestSet{subject.Digest.Algorithm: subject.Digest.Hex},
+			}},
+		},
+		Predicate: predicate,
+	})
+	if err != nil {
+		return err
+	}
+
+	envelope, err := dsse.WrapSigner(k, in_toto.PayloadType).SignMessage(
+		bytes.NewReader(statement), sigopts.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("signing %q attestation: %w", predicateType, err)
+	}
+
+	att, err := static.NewAttestation(envelope, static.WithLayerMediaType(costypes.DssePayloadType))
+	if err != nil {
+		return err
+	}
+
+	if referrers {
+		if err := s.writeArtifactReferrer(ctx, sigRepo, subject, AttestationArtifactType, att); err != nil {
+			return fmt.Errorf("writing %q attestation: %w", predicateType, err)
+		}
+
+		return nil
+	}
+
+	newSE, err := ocimutate.AttachAttestationToEntity(
+		se, att, ocimutate.WithDupeDetector(cosremote.NewDupeDetector(k)),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := ociremote.WriteAttestations(
+		sigRepo, newSE, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...,
+	); err != nil {
+		return fmt.Errorf("writing %q attestation: %w", predicateType, err)
+	}
+
+	return nil
+}
+
+// attestEntities attaches the attestations of the options to the signed
+// entities (i.e. the index and its images, or the image) they are about.
+func (s *service) attestEntities(
+	ctx context.Context,
+	k signature.SignerVerifier,
+	dstRef name.Reference,
+	se oci.SignedEntity,
+	sigRepo name.Repository,
+	sigSuffix string,
+	o *signOpts,
+) error {
+	if len(o.attestations) == 0 {
+		return nil
+	}
+
+	signed, err := signedEntityDescriptor(se)
+	if err != nil {
+		return err
+	}
+
+	attested := make([]bool, len(o.attestations))
+
+	if err := walk.SignedEntity(ctx, se, func(ctx context.Context, se oci.SignedEntity) error {
+		desc, err := signedEntityDescriptor(se)
+		if err != nil {
+			return err
+		}
+
+		for i, a := range o.attestations {
+			subject := a.subject
+			if subject == (v1.Hash{}) {
+				subject = signed.Digest
+			}
+
+			if subject != desc.Digest {
+				continue
+			}
+
+			if err := s.attest(
+				ctx, k, dstRef.Context(), se, sigRepo, sigSuffix, o.referrers, a.predicateType, a.predicate,
+			); err != nil {
+				return err
+			}
+
+			attested[i] = true
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("writing attestations: %w", err)
+	}
+
+	for i, a := range o.attestations {
+		if !attested[i] {
+			return fmt.Errorf(
+				"%w: %q attestation of %q in %q", ErrAttestationSubjectNotFound, a.predicateType, a.subject, dstRef,
+			)
+		}
+	}
+
+	return nil
+}
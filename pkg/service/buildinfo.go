@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	errNotGoBinary = errors.New("not a Go binary")
+
+	goBuildInfoMagic = []byte("\xff Go buildinf:")
+)
+
+const (
+	goBuildInfoHeaderSize = 32
+
+	// goBuildInfoInline is set in the build info flags of Go 1.18+ binaries,
+	// whose version and module information follows the header inline.
+	goBuildInfoInline = 0x2
+	// goBuildInfoBigEndian is set in the build info flags of big endian
+	// binaries of older Go versions.
+	goBuildInfoBigEndian = 0x1
+)
+
+// goBinaryPackages returns the Go toolchain and modules a Go ELF binary was
+// built with, as recorded in its .go.buildinfo section.
+func goBinaryPackages(r io.ReaderAt) ([]sbomPackage, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, errNotGoBinary
+	}
+
+	sec := f.Section(".go.buildinfo")
+	if sec == nil {
+		return nil, errNotGoBinary
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < goBuildInfoHeaderSize || !bytes.HasPrefix(data, goBuildInfoMagic) {
+		return nil, errNotGoBinary
+	}
+
+	ptrSize, flags := int(data[14]), data[15]
+
+	var goVersion, modInfo string
+	{
+		switch {
+		case flags&goBuildInfoInline != 0:
+			rest := data[goBuildInfoHeaderSize:]
+			goVersion, rest = goVarintString(rest)
+			modInfo, _ = goVarintString(rest)
+		case ptrSize == 4 || ptrSize == 8:
+			var order binary.ByteOrder = binary.LittleEndian
+			if flags&goBuildInfoBigEndian != 0 {
+				order = binary.BigEndian
+			}
+
+			goVersion = goPointerString(f, order, ptrSize, goReadPtr(order, ptrSize, data[16:]))
+			modInfo = goPointerString(f, order, ptrSize, goReadPtr(order, ptrSize, data[16+ptrSize:]))
+		default:
+			return nil, errNotGoBinary
+		}
+	}
+
+	if goVersion == "" {
+		return nil, errNotGoBinary
+	}
+
+	pkgs := []sbomPackage{{Type: "golang", Name: "stdlib", Version: goVersion}}
+
+	// The module information is wrapped in 16 byte sentinels.
+	if len(modInfo) >= 33 && modInfo[len(modInfo)-17] == '\n' {
+		modInfo = modInfo[16 : len(modInfo)-16]
+	}
+
+	for _, line := range strings.Split(modInfo, "\n") {
+		fields := strings.Split(line, "\t")
+
+		switch {
+		case len(fields) < 3:
+			continue
+		case fields[0] == "mod" || fields[0] == "dep":
+			version := fields[2]
+			if version == "(devel)" {
+				version = ""
+			}
+
+			pkgs = append(pkgs, sbomPackage{Type: "golang", Name: fields[1], Version: version})
+		case fields[0] == "=>" && len(pkgs) > 1:
+			// Replacements apply to the module listed before them.
+			pkgs[len(pkgs)-1].Name, pkgs[len(pkgs)-1].Version = fields[1], fields[2]
+		}
+	}
+
+	return pkgs, nil
+}
+
+func goVarintString(b []byte) (string, []byte) {
+	n, w := binary.Uvarint(b)
+	if w <= 0 || n > uint64(len(b)-w) {
+		return "", nil
+	}
+
+	return string(b[w : w+int(n)]), b[w+int(n):]
+}
+
+func goReadPtr(order binary.ByteOrder, ptrSize int, b []byte) uint64 {
+	if ptrSize == 4 {
+		return uint64(order.Uint32(b))
+	}
+
+	return order.Uint64(b)
+}
+
+// goPointerString reads the Go string whose header is at the virtual address
+// within the binary.
+func goPointerString(f *elf.File, order binary.ByteOrder, ptrSize int, addr uint64) string {
+	hdr := goReadAt(f, addr, uint64(2*ptrSize))
+	if hdr == nil {
+		return ""
+	}
+
+	b := goReadAt(f, goReadPtr(order, ptrSize, hdr), goReadPtr(order, ptrSize, hdr[ptrSize:]))
+
+	return string(b)
+}
+
+func goReadAt(f *elf.File, addr, size uint64) []byte {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || size > p.Filesz || addr < p.Vaddr || addr+size > p.Vaddr+p.Filesz {
+			continue
+		}
+
+		b := make([]byte, size)
+		if _, err := p.ReadAt(b, int64(addr-p.Vaddr)); err != nil {
+			return nil
+		}
+
+		return b
+	}
+
+	return nil
+}
@@ -0,0 +1,563 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxCatalogFileSize bounds the files read into memory to be catalogued
+	// (e.g. rpm databases and Go binaries).
+	maxCatalogFileSize = 256 << 20
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+var errCatalogFileTooLarge = errors.New("file too large to catalogue")
+
+// sbomPackage is a package found within an image.
+type sbomPackage struct {
+	// Type is the package URL type of the package, e.g. "deb" or "npm".
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+	License string
+	// Epoch is that of rpm packages, which is not part of their version.
+	Epoch string
+}
+
+// purl returns the package URL of the package within an image of the given OS
+// release (its /etc/os-release fields).
+func (p sbomPackage) purl(release map[string]string) string {
+	namespace, name := "", p.Name
+	qualifiers := url.Values{}
+
+	switch p.Type {
+	case "deb", "rpm", "apk":
+		namespace = release["ID"]
+		if namespace == "" && p.Type == "apk" {
+			namespace = "alpine"
+		}
+
+		if p.Arch != "" {
+			qualifiers.Set("arch", p.Arch)
+		}
+
+		if p.Epoch != "" {
+			qualifiers.Set("epoch", p.Epoch)
+		}
+
+		if release["ID"] != "" && release["VERSION_ID"] != "" {
+			qualifiers.Set("distro", release["ID"]+"-"+release["VERSION_ID"])
+		}
+	case "golang", "npm":
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+	case "pypi":
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	}
+
+	var b strings.Builder
+
+	b.WriteString("pkg:" + p.Type + "/")
+
+	if namespace != "" {
+		for _, segment := range strings.Split(namespace, "/") {
+			b.WriteString(purlEscape(segment) + "/")
+		}
+	}
+
+	b.WriteString(purlEscape(name))
+
+	if p.Version != "" {
+		b.WriteString("@" + purlEscape(p.Version))
+	}
+
+	if len(qualifiers) > 0 {
+		// Encoding sorts the qualifiers by key, as package URLs require.
+		b.WriteString("?" + strings.ReplaceAll(qualifiers.Encode(), "+", "%20"))
+	}
+
+	return b.String()
+}
+
+func purlEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// layerContents is what was catalogued from a single layer.
+type layerContents struct {
+	// files are the catalogued files by path.
+	files map[string]catalogedFile
+	// whiteouts are the paths the layer deletes from those beneath it, and
+	// opaque the directories it empties.
+	whiteouts []string
+	opaque    []string
+	// findings are those of the layer's inspection, if inspected.
+	findings []InspectionFinding
+}
+
+// catalogedFile is what was catalogued from a single file.
+type catalogedFile struct {
+	packages []sbomPackage
+	// release is set for os-release files.
+	release map[string]string
+}
+
+// catalogLayer catalogues the packages of an (optionally compressed) layer
+// tarball. Files that cannot be parsed are skipped; they are inventory rather
+// than anything the image depends on being well formed. The exception is rpm
+// databases, whose packages would otherwise go missing unnoticed.
+//
+// Layers are untrusted input parsed in the background of their copy, so
+// should a cataloger panic on one, it fails the layer rather than the process.
+func catalogLayer(rc io.ReadCloser, c LayerCompression, o layerScanOpts) (_ *layerContents, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cataloguing layer: panic: %v", r)
+		}
+	}()
+
+	urc, err := decompress(rc, c)
+	if err != nil {
+		return nil, err
+	}
+	defer urc.Close()
+
+	contents := &layerContents{files: make(map[string]catalogedFile)}
+
+	tr := tar.NewReader(urc)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return contents, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading layer: %w", err)
+		}
+
+		p := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(p)
+
+		switch {
+		case base == whiteoutOpaque:
+			contents.opaque = append(contents.opaque, dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			contents.whiteouts = append(contents.whiteouts, dir+strings.TrimPrefix(base, whiteoutPrefix))
+			continue
+		}
+
+		if o.inspect {
+			contents.findings = append(contents.findings, inspectHeader(p, hdr)...)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// Secrets are scanned for as the file is catalogued, from the same
+		// read of it.
+		var (
+			r       io.Reader = tr
+			secrets *secretScanner
+		)
+
+		if o.inspect && hdr.Size <= maxSecretScanFileSize {
+			secrets = newSecretScanner()
+			r = io.TeeReader(tr, secrets)
+		}
+
+		if cataloger := catalogerFor(p, hdr); o.packages && cataloger != nil {
+			f, err := cataloger(r)
+			if err == nil {
+				contents.files[p] = f
+			} else if errors.Is(err, errInvalidRpmdb) {
+				// Without its rpm database, an image's SBOM would silently
+				// lack all of its OS packages.
+				return nil, fmt.Errorf("cataloguing %q: %w", p, err)
+			}
+		}
+
+		if secrets != nil {
+			if _, err := io.Copy(secrets, tr); err != nil {
+				return nil, fmt.Errorf("reading layer: %w", err)
+			}
+
+			contents.findings = append(contents.findings, secrets.findings(p)...)
+		}
+	}
+}
+
+// layerScanOpts are what layers are scanned for.
+type layerScanOpts struct {
+	// packages catalogues the packages of the layer.
+	packages bool
+	// inspect inspects the layer for forbidden content.
+	inspect bool
+}
+
+type cataloger func(r io.Reader) (catalogedFile, error)
+
+// rpmdbPaths are those of rpm databases: Berkeley DB, NDB and SQLite, which
+// newer releases keep under /usr/lib/sysimage.
+var rpmdbPaths = map[string]bool{
+	"var/lib/rpm/Packages":              true,
+	"var/lib/rpm/Packages.db":           true,
+	"var/lib/rpm/rpmdb.sqlite":          true,
+	"usr/lib/sysimage/rpm/Packages":     true,
+	"usr/lib/sysimage/rpm/Packages.db":  true,
+	"usr/lib/sysimage/rpm/rpmdb.sqlite": true,
+}
+
+// catalogerFor returns the cataloger of the file at the path, if any.
+func catalogerFor(p string, hdr *tar.Header) cataloger {
+	dir, base := path.Split(p)
+
+	switch {
+	case p == "etc/os-release" || p == "usr/lib/os-release":
+		return catalogOSRelease
+	case p == "var/lib/dpkg/status":
+		return catalogDpkg
+	case dir == "var/lib/dpkg/status.d/" && !strings.Contains(base, "."):
+		// Distroless images have a status file per package.
+		return catalogDpkg
+	case p == "lib/apk/db/installed":
+		return catalogApk
+	case rpmdbPaths[p]:
+		return catalogRpmdb
+	case base == "package-lock.json" && !strings.Contains(p, "node_modules/"):
+		return catalogPackageLock
+	case base == "requirements.txt":
+		return catalogRequirements
+	case hdr.FileInfo().Mode()&0111 != 0 && hdr.Size <= maxCatalogFileSize:
+		return catalogGoBinary
+	}
+
+	return nil
+}
+
+// mergeLayerContents returns the packages of the filesystem the layers make up
+// when applied in order, along with its OS release.
+func mergeLayerContents(layers []*layerContents) ([]sbomPackage, map[string]string) {
+	files := make(map[string]catalogedFile)
+
+	for _, l := range layers {
+		for p := range files {
+			for _, wh := range l.whiteouts {
+				if p == wh || strings.HasPrefix(p, wh+"/") {
+					delete(files, p)
+				}
+			}
+
+			for _, dir := range l.opaque {
+				if strings.HasPrefix(p, dir) {
+					delete(files, p)
+				}
+			}
+		}
+
+		for p, f := range l.files {
+			files[p] = f
+		}
+	}
+
+	release := files["usr/lib/os-release"].release
+	if f, ok := files["etc/os-release"]; ok {
+		release = f.release
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	var pkgs []sbomPackage
+
+	seen := make(map[sbomPackage]bool)
+
+	for _, p := range paths {
+		for _, pkg := range files[p].packages {
+			if !seen[pkg] {
+				seen[pkg] = true
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+
+	sortPackages(pkgs)
+
+	return pkgs, release
+}
+
+func catalogOSRelease(r io.Reader) (catalogedFile, error) {
+	release := make(map[string]string)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "#") {
+			continue
+		}
+
+		release[kv[0]] = strings.Trim(kv[1], `"'`)
+	}
+
+	return catalogedFile{release: release}, s.Err()
+}
+
+// controlStanzas reads the blank line separated stanzas of "Key: value"
+// fields that make up Debian control files and the like.
+func controlStanzas(r io.Reader) ([]map[string]string, error) {
+	var (
+		stanzas []map[string]string
+		stanza  map[string]string
+	)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+
+	for s.Scan() {
+		line := s.Text()
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			stanza = nil
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			// Continuation lines are of no interest.
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		if stanza == nil {
+			stanza = make(map[string]string)
+			stanzas = append(stanzas, stanza)
+		}
+
+		stanza[kv[0]] = strings.TrimSpace(kv[1])
+	}
+
+	return stanzas, s.Err()
+}
+
+func catalogDpkg(r io.Reader) (catalogedFile, error) {
+	stanzas, err := controlStanzas(r)
+	if err != nil {
+		return catalogedFile{}, err
+	}
+
+	var f catalogedFile
+
+	for _, st := range stanzas {
+		// Packages that have been removed, but not purged, are listed too.
+		if status, ok := st["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+
+		if st["Package"] == "" {
+			continue
+		}
+
+		f.packages = append(f.packages, sbomPackage{
+			Type:    "deb",
+			Name:    st["Package"],
+			Version: st["Version"],
+			Arch:    st["Architecture"],
+		})
+	}
+
+	return f, nil
+}
+
+func catalogApk(r io.Reader) (catalogedFile, error) {
+	stanzas, err := controlStanzas(r)
+	if err != nil {
+		return catalogedFile{}, err
+	}
+
+	var f catalogedFile
+
+	for _, st := range stanzas {
+		if st["P"] == "" {
+			continue
+		}
+
+		f.packages = append(f.packages, sbomPackage{
+			Type:    "apk",
+			Name:    st["P"],
+			Version: st["V"],
+			Arch:    st["A"],
+			License: st["L"],
+		})
+	}
+
+	return f, nil
+}
+
+func catalogRpmdb(r io.Reader) (catalogedFile, error) {
+	b, err := readCatalogFile(r, maxCatalogFileSize)
+	if errors.Is(err, errCatalogFileTooLarge) {
+		return catalogedFile{}, fmt.Errorf("%w: %s", errInvalidRpmdb, err)
+	}
+
+	if err != nil {
+		return catalogedFile{}, err
+	}
+
+	pkgs, err := rpmdbPackages(b)
+
+	return catalogedFile{packages: pkgs}, err
+}
+
+// npmLockDependency is a dependency of a lockfileVersion 1 package-lock.json.
+type npmLockDependency struct {
+	Version      string                       `json:"version"`
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+func catalogPackageLock(r io.Reader) (catalogedFile, error) {
+	var lock struct {
+		Packages map[string]struct {
+			Version string          `json:"version"`
+			License json.RawMessage `json:"license"`
+			Link    bool            `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]npmLockDependency `json:"dependencies"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&lock); err != nil {
+		return catalogedFile{}, err
+	}
+
+	var f catalogedFile
+
+	// Lockfile versions 2 and 3 list every package by its install path.
+	if len(lock.Packages) > 0 {
+		for p, pkg := range lock.Packages {
+			i := strings.LastIndex(p, "node_modules/")
+			if i < 0 || pkg.Link {
+				continue
+			}
+
+			var license string
+			json.Unmarshal(pkg.License, &license)
+
+			f.packages = append(f.packages, sbomPackage{
+				Type:    "npm",
+				Name:    p[i+len("node_modules/"):],
+				Version: pkg.Version,
+				License: license,
+			})
+		}
+
+		return f, nil
+	}
+
+	var walk func(deps map[string]npmLockDependency)
+
+	walk = func(deps map[string]npmLockDependency) {
+		for name, dep := range deps {
+			f.packages = append(f.packages, sbomPackage{Type: "npm", Name: name, Version: dep.Version})
+			walk(dep.Dependencies)
+		}
+	}
+
+	walk(lock.Dependencies)
+
+	return f, nil
+}
+
+// catalogRequirements catalogues the pinned (name==version) requirements of a
+// pip requirements file. Anything else does not say what was installed.
+func catalogRequirements(r io.Reader) (catalogedFile, error) {
+	var f catalogedFile
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		// Environment markers.
+		line = strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		nv := strings.SplitN(line, "==", 2)
+		if len(nv) != 2 {
+			continue
+		}
+
+		name := strings.TrimSpace(nv[0])
+		if i := strings.Index(name, "["); i >= 0 {
+			name = name[:i]
+		}
+
+		// Per-requirement options (e.g. hashes) follow the version.
+		version := strings.TrimSpace(strings.TrimPrefix(nv[1], "="))
+		if i := strings.IndexAny(version, " \t,\\"); i >= 0 {
+			version = version[:i]
+		}
+
+		f.packages = append(f.packages, sbomPackage{Type: "pypi", Name: name, Version: version})
+	}
+
+	return f, s.Err()
+}
+
+func catalogGoBinary(r io.Reader) (catalogedFile, error) {
+	br := bufio.NewReader(r)
+
+	if magic, err := br.Peek(4); err != nil || !bytes.Equal(magic, []byte("\x7fELF")) {
+		return catalogedFile{}, errNotGoBinary
+	}
+
+	b, err := readCatalogFile(br, maxCatalogFileSize)
+	if err != nil {
+		return catalogedFile{}, err
+	}
+
+	pkgs, err := goBinaryPackages(bytes.NewReader(b))
+
+	return catalogedFile{packages: pkgs}, err
+}
+
+// readCatalogFile reads a file to be catalogued into memory, up to max bytes
+// of it.
+func readCatalogFile(r io.Reader, max int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("%w: over %d bytes", errCatalogFileTooLarge, max)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// testLayerFile is a file of a test layer, by its path within the layer.
+type testLayerFile struct {
+	path    string
+	content []byte
+}
+
+// testLayer returns a (gzip compressed, should c be) layer tarball of the
+// files.
+func testLayer(t *testing.T, c LayerCompression, files ...testLayerFile) io.ReadCloser {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	w := io.Writer(&b)
+
+	var zw *gzip.Writer
+	if c == CompressionGzip {
+		zw = gzip.NewWriter(&b)
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     f.path,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(f.content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ioutil.NopCloser(&b)
+}
+
+func TestCatalogLayer(t *testing.T) {
+	pkgs, headers := testRpmPackages(2)
+
+	base, err := catalogLayer(testLayer(t, CompressionGzip,
+		testLayerFile{"etc/os-release", []byte("ID=\"rhel\"\nVERSION_ID='9.2'\n# ID=other\n")},
+		testLayerFile{"var/lib/dpkg/status", []byte(
+			"Package: bash\nStatus: install ok installed\nVersion: 5.1-2\nArchitecture: amd64\n" +
+				"Description: GNU Bourne Again SHell\n bash is an sh-compatible shell\n\n" +
+				"Package: vim\nStatus: deinstall ok config-files\nVersion: 2:8.2\n",
+		)},
+		testLayerFile{"lib/apk/db/installed", []byte("P:musl\nV:1.2.2-r3\nA:x86_64\nL:MIT\n")},
+		testLayerFile{"usr/lib/sysimage/rpm/Packages.db", testNDB(headers)},
+		testLayerFile{"app/node_modules/.package-lock.json", []byte("not even JSON")},
+		testLayerFile{"app/package-lock.json", []byte(`{"lockfileVersion":2,"packages":{` +
+			`"":{"version":"1.0.0"},` +
+			`"node_modules/left-pad":{"version":"1.3.0","license":"WTFPL"},` +
+			`"node_modules/lib":{"link":true}}}`,
+		)},
+		testLayerFile{"app/package-lock.json.bak", []byte("{")},
+		testLayerFile{"app/requirements.txt", []byte("flask==2.0.1\n")},
+		testLayerFile{"srv/requirements.txt", []byte(
+			"# pinned\nrequests[socks]==2.26.0 --hash=sha256:abc ; python_version>'3'\n-r other.txt\nsix>=1\n",
+		)},
+	), CompressionGzip, layerScanOpts{packages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The top layer deletes a file, and empties a directory, of the base.
+	top, err := catalogLayer(testLayer(t, CompressionNone,
+		testLayerFile{"app/.wh.requirements.txt", nil},
+		testLayerFile{"lib/apk/db/.wh..wh..opq", nil},
+	), CompressionNone, layerScanOpts{packages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, release := mergeLayerContents([]*layerContents{base, top})
+
+	want := []sbomPackage{
+		{Type: "deb", Name: "bash", Version: "5.1-2", Arch: "amd64"},
+		{Type: "npm", Name: "left-pad", Version: "1.3.0", License: "WTFPL"},
+		{Type: "pypi", Name: "requests", Version: "2.26.0"},
+	}
+	want = append(want, pkgs...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got packages %+v, want %+v", got, want)
+	}
+
+	if want := map[string]string{"ID": "rhel", "VERSION_ID": "9.2"}; !reflect.DeepEqual(release, want) {
+		t.Errorf("got release %v, want %v", release, want)
+	}
+
+	// Without the top layer, the deleted files' packages are there.
+	if got, _ := mergeLayerContents([]*layerContents{base}); len(got) != len(want)+2 {
+		t.Errorf("got %d packages of the base layer, want %d", len(got), len(want)+2)
+	}
+}
+
+func TestCatalogLayerInvalid(t *testing.T) {
+	sqlite := testSQLite(t)
+
+	for name, tc := range map[string]struct {
+		layer io.ReadCloser
+		err   error
+	}{
+		"truncated rpm database": {
+			layer: testLayer(t, CompressionNone, testLayerFile{"var/lib/rpm/rpmdb.sqlite", sqlite[:len(sqlite)/4]}),
+			err:   errInvalidRpmdb,
+		},
+		"unrecognised rpm database": {
+			layer: testLayer(t, CompressionNone, testLayerFile{"var/lib/rpm/Packages", []byte("nonsense")}),
+			err:   errInvalidRpmdb,
+		},
+	} {
+		if _, err := catalogLayer(tc.layer, CompressionNone, layerScanOpts{packages: true}); !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", name, err, tc.err)
+		}
+	}
+
+	// Unless packages are catalogued, rpm databases are not read.
+	if _, err := catalogLayer(testLayer(t, CompressionNone,
+		testLayerFile{"var/lib/rpm/Packages", []byte("nonsense")},
+	), CompressionNone, layerScanOpts{}); err != nil {
+		t.Errorf("uncatalogued: %s", err)
+	}
+
+	b, err := ioutil.ReadAll(testLayer(t, CompressionNone,
+		testLayerFile{"etc/os-release", bytes.Repeat([]byte("ID=rhel\n"), 128)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated within the file.
+	truncated := ioutil.NopCloser(bytes.NewReader(b[:1000]))
+	if _, err := catalogLayer(truncated, CompressionNone, layerScanOpts{packages: true}); err == nil {
+		t.Error("truncated layer catalogued")
+	}
+
+	uncompressed := ioutil.NopCloser(bytes.NewReader(b))
+	if _, err := catalogLayer(uncompressed, CompressionGzip, layerScanOpts{packages: true}); err == nil {
+		t.Error("uncompressed layer catalogued as gzip")
+	}
+}
+
+// panickingReader panics when read, as a cataloger might on a hostile layer.
+type panickingReader struct{}
+
+func (panickingReader) Read([]byte) (int, error) { panic("hostile layer") }
+
+func TestCatalogLayerPanic(t *testing.T) {
+	_, err := catalogLayer(ioutil.NopCloser(panickingReader{}), CompressionNone, layerScanOpts{packages: true})
+	if err == nil {
+		t.Error("panic not recovered as an error")
+	}
+}
+
+func TestReadCatalogFile(t *testing.T) {
+	b, err := readCatalogFile(bytes.NewReader([]byte("small")), 5)
+	if err != nil || string(b) != "small" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	// Larger files are not read beyond the limit.
+	r := &countingReader{}
+	if _, err := readCatalogFile(r, 1<<20); !errors.Is(err, errCatalogFileTooLarge) {
+		t.Errorf("error %v, want %v", err, errCatalogFileTooLarge)
+	}
+
+	if r.n > 1<<20+512 {
+		t.Errorf("read %d bytes, over the limit of %d", r.n, 1<<20)
+	}
+}
+
+// countingReader is an endless reader of zeros that counts what is read.
+type countingReader struct {
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	r.n += len(p)
+
+	return len(p), nil
+}
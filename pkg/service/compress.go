@@ -0,0 +1,294 @@
+package service
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LayerCompression selects the compression layers are recompressed to during
+// Copy.
+type LayerCompression string
+
+const (
+	// CompressionNone leaves layers as they are.
+	CompressionNone LayerCompression = ""
+	// CompressionGzip recompresses layers with gzip for older runtimes.
+	CompressionGzip LayerCompression = "gzip"
+	// CompressionZstd recompresses layers with zstd for faster pulls on
+	// runtimes that support it (e.g. containerd 1.5+).
+	CompressionZstd LayerCompression = "zstd"
+)
+
+// OCIZstdLayer is the OCI media type of a zstd compressed layer, which has no
+// Docker equivalent.
+const OCIZstdLayer types.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+var (
+	ErrInvalidLayerCompression      = errors.New("invalid layer compression")
+	ErrIncompatibleLayerCompression = errors.New("incompatible layer compression")
+
+	// layerCompressions maps the layer media types that can be recompressed
+	// to their current compression.
+	layerCompressions = map[types.MediaType]LayerCompression{
+		types.DockerLayer:             CompressionGzip,
+		types.DockerUncompressedLayer: CompressionNone,
+		types.OCILayer:                CompressionGzip,
+		types.OCIUncompressedLayer:    CompressionNone,
+		OCIZstdLayer:                  CompressionZstd,
+	}
+)
+
+func (c LayerCompression) validate() error {
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidLayerCompression, c)
+}
+
+// mediaType returns the layer media type for the compression within an image
+// of the given manifest media type.
+func (c LayerCompression) mediaType(manifestMediaType types.MediaType) (types.MediaType, error) {
+	docker := manifestMediaType == types.DockerManifestSchema2
+
+	switch {
+	case c == CompressionGzip && docker:
+		return types.DockerLayer, nil
+	case c == CompressionGzip:
+		return types.OCILayer, nil
+	case c == CompressionZstd && docker:
+		return "", fmt.Errorf(
+			"%w: zstd layers require OCI media types (convert them first)",
+			ErrIncompatibleLayerCompression,
+		)
+	case c == CompressionZstd:
+		return OCIZstdLayer, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrInvalidLayerCompression, c)
+}
+
+// recompressImage rewrites img with its layers recompressed as they stream
+// through. Layers already using the requested compression, or of media types
+// that aren't regular filesystem layers (e.g. foreign layers), are left as-is.
+func recompressImage(img v1.Image, c LayerCompression) (v1.Image, error) {
+	if c == CompressionNone {
+		return img, nil
+	}
+
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	var changed bool
+
+	for i, l := range layers {
+		from, ok := layerCompressions[m.Layers[i].MediaType]
+		if !ok || from == c {
+			continue
+		}
+
+		to, err := c.mediaType(mt)
+		if err != nil {
+			return nil, err
+		}
+
+		layers[i] = &recompressedLayer{
+			base:      l,
+			from:      from,
+			to:        c,
+			mediaType: to,
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return img, nil
+	}
+
+	return &rewrittenImage{
+		base:            img,
+		mediaType:       mt,
+		configMediaType: m.Config.MediaType,
+		layers:          layers,
+	}, nil
+}
+
+// recompressedLayer is a v1.Layer that decompresses its base layer and
+// recompresses it on the fly whenever its compressed contents are read. In
+// the spirit of the Go container registry stream package, the digest and size
+// are not known until the layer has been fully read once (i.e. written to the
+// destination) and stream.ErrNotComputed is returned until then. The diff ID
+// is unaffected by compression and is that of the base layer.
+type recompressedLayer struct {
+	base      v1.Layer
+	from, to  LayerCompression
+	mediaType types.MediaType
+
+	mu       sync.Mutex
+	computed bool
+	digest   v1.Hash
+	size     int64
+}
+
+var _ v1.Layer = (*recompressedLayer)(nil)
+
+func (l *recompressedLayer) MediaType() (types.MediaType, error) { return l.mediaType, nil }
+
+func (l *recompressedLayer) DiffID() (v1.Hash, error) { return l.base.DiffID() }
+
+func (l *recompressedLayer) Digest() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return v1.Hash{}, stream.ErrNotComputed
+	}
+
+	return l.digest, nil
+}
+
+func (l *recompressedLayer) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return 0, stream.ErrNotComputed
+	}
+
+	return l.size, nil
+}
+
+func (l *recompressedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.base.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(rc, l.from)
+}
+
+func (l *recompressedLayer) Compressed() (io.ReadCloser, error) {
+	urc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer urc.Close()
+
+		h := sha256.New()
+		cw := &countingWriter{w: io.MultiWriter(pw, h)}
+
+		err := compress(cw, urc, l.to)
+		if err == nil {
+			l.mu.Lock()
+			l.digest = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+			l.size = cw.n
+			l.computed = true
+			l.mu.Unlock()
+		}
+
+		// Readers only see EOF once the digest and size have been recorded.
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+func decompress(rc io.ReadCloser, c LayerCompression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompressing gzip layer: %w", err)
+		}
+
+		return &readCloser{Reader: zr, close: rc.Close}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompressing zstd layer: %w", err)
+		}
+
+		return &readCloser{Reader: zr, close: func() error {
+			zr.Close()
+			return rc.Close()
+		}}, nil
+	}
+
+	return rc, nil
+}
+
+func compress(w io.Writer, r io.Reader, c LayerCompression) (err error) {
+	var zw io.WriteCloser
+	{
+		switch c {
+		case CompressionGzip:
+			zw = gzip.NewWriter(w)
+		case CompressionZstd:
+			// A single encoder goroutine keeps the output (and therefore
+			// the digest) deterministic should the layer be re-read on a
+			// retried upload.
+			if zw, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %q", ErrInvalidLayerCompression, c)
+		}
+	}
+
+	if _, err = io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+
+	return zw.Close()
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error { return rc.close() }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+
+	return n, err
+}
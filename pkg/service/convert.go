@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// MediaTypeConversion selects the media type flavour an image is rewritten to
+// during Copy.
+type MediaTypeConversion string
+
+const (
+	// ConvertNone leaves media types untouched.
+	ConvertNone MediaTypeConversion = ""
+	// ConvertToOCI rewrites Docker v2 schema 2 media types to OCI.
+	ConvertToOCI MediaTypeConversion = "oci"
+	// ConvertToDocker rewrites OCI media types to Docker v2 schema 2 for
+	// legacy consumers.
+	ConvertToDocker MediaTypeConversion = "docker"
+)
+
+var (
+	ErrInvalidMediaTypeConversion = errors.New("invalid media type conversion")
+	ErrUnconvertibleMediaType     = errors.New("unconvertible media type")
+
+	dockerToOCIMediaTypes = map[types.MediaType]types.MediaType{
+		types.DockerManifestSchema2:   types.OCIManifestSchema1,
+		types.DockerManifestList:      types.OCIImageIndex,
+		types.DockerConfigJSON:        types.OCIConfigJSON,
+		types.DockerLayer:             types.OCILayer,
+		types.DockerUncompressedLayer: types.OCIUncompressedLayer,
+		types.DockerForeignLayer:      types.OCIRestrictedLayer,
+	}
+	ociToDockerMediaTypes = invertMediaTypes(dockerToOCIMediaTypes)
+
+	// ociOnlyMediaTypes have no Docker equivalent.
+	ociOnlyMediaTypes = map[types.MediaType]bool{
+		types.OCIUncompressedRestrictedLayer: true,
+		OCIZstdLayer:                         true,
+	}
+)
+
+func invertMediaTypes(m map[types.MediaType]types.MediaType) map[types.MediaType]types.MediaType {
+	inverted := make(map[types.MediaType]types.MediaType, len(m))
+	for k, v := range m {
+		inverted[v] = k
+	}
+
+	return inverted
+}
+
+func (c MediaTypeConversion) validate() error {
+	switch c {
+	case ConvertNone, ConvertToOCI, ConvertToDocker:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidMediaTypeConversion, c)
+}
+
+// mediaType returns the converted equivalent of mt. Media types that are
+// already of the target flavour are returned as-is, whereas those with no
+// equivalent in the target flavour are an error.
+func (c MediaTypeConversion) mediaType(mt types.MediaType) (types.MediaType, error) {
+	var from, to map[types.MediaType]types.MediaType
+	{
+		switch c {
+		case ConvertToOCI:
+			from, to = dockerToOCIMediaTypes, ociToDockerMediaTypes
+		case ConvertToDocker:
+			from, to = ociToDockerMediaTypes, dockerToOCIMediaTypes
+		default:
+			return mt, nil
+		}
+	}
+
+	if converted, ok := from[mt]; ok {
+		return converted, nil
+	}
+
+	if _, ok := to[mt]; ok {
+		return mt, nil
+	}
+
+	if c == ConvertToOCI && ociOnlyMediaTypes[mt] {
+		return mt, nil
+	}
+
+	return "", fmt.Errorf("%w: %q has no %s equivalent", ErrUnconvertibleMediaType, mt, c)
+}
+
+// convertImage rewrites img with its manifest, config and layer media types
+// converted. Layer content and the config file are carried over untouched so
+// that the diff IDs and history remain correct.
+func convertImage(img v1.Image, c MediaTypeConversion) (v1.Image, error) {
+	if c == ConvertNone {
+		return img, nil
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	manifestMediaType, err := c.mediaType(mt)
+	if err != nil {
+		return nil, err
+	}
+
+	configMediaType, err := c.mediaType(m.Config.MediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := manifestMediaType != mt || configMediaType != m.Config.MediaType
+
+	layerMediaTypes := make([]types.MediaType, len(m.Layers))
+	for i, desc := range m.Layers {
+		if layerMediaTypes[i], err = c.mediaType(desc.MediaType); err != nil {
+			return nil, err
+		}
+
+		changed = changed || layerMediaTypes[i] != desc.MediaType
+	}
+
+	if !changed {
+		return img, nil
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	for i, l := range layers {
+		layers[i] = withLayerMediaType(l, layerMediaTypes[i])
+	}
+
+	return &rewrittenImage{
+		base:            img,
+		mediaType:       manifestMediaType,
+		configMediaType: configMediaType,
+		layers:          layers,
+	}, nil
+}
@@ -0,0 +1,464 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+
+	ocicryptconfig "github.com/containers/ocicrypt/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// encryptedSuffix is appended to the media type of a layer encrypted as per the
+// ocicrypt spec (e.g. application/vnd.oci.image.layer.v1.tar+gzip+encrypted).
+const encryptedSuffix = "+encrypted"
+
+var (
+	ErrInvalidLayerEncryption      = errors.New("invalid layer encryption")
+	ErrIncompatibleLayerEncryption = errors.New("incompatible layer encryption")
+)
+
+// layerEncryption holds the ocicrypt configuration of a Copy, built from the
+// given keys on validation.
+type layerEncryption struct {
+	recipients  [][]byte
+	privateKeys [][]byte
+
+	// Indexes of the layers to encrypt, negative indexes counting back from
+	// the top layer. All layers are encrypted when empty.
+	layers []int
+
+	encrypt *ocicryptconfig.EncryptConfig
+	decrypt *ocicryptconfig.DecryptConfig
+}
+
+// validateLayerEncryption checks the keys given for layer encryption and
+// decryption, and that encryption is not combined with options it cannot work
+// alongside.
+func (o *copyOpts) validateLayerEncryption() error {
+	var err error
+
+	if o.encryption.privateKeys != nil {
+		if o.encryption.decrypt, err = newDecryptConfig(o.encryption.privateKeys); err != nil {
+			return err
+		}
+	}
+
+	if o.encryption.recipients == nil {
+		return nil
+	}
+
+	if o.compression != CompressionNone {
+		// The ocicrypt layer block cipher needs the digest of the plain layer
+		// up front, which streamed layers do not have.
+		return fmt.Errorf(
+			"%w: layers cannot be encrypted whilst being recompressed (do so in a separate promotion)",
+			ErrIncompatibleLayerEncryption,
+		)
+	}
+
+	if o.estargz {
+		// As neither do those converted to eStargz.
+		return fmt.Errorf(
+			"%w: layers cannot be encrypted whilst being converted to eStargz (do so in a separate promotion)",
+			ErrIncompatibleLayerEncryption,
+		)
+	}
+
+	o.encryption.encrypt, err = newEncryptConfig(o.encryption.recipients)
+
+	return err
+}
+
+func newEncryptConfig(recipients [][]byte) (*ocicryptconfig.EncryptConfig, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%w: no recipient public keys", ErrInvalidLayerEncryption)
+	}
+
+	for i, r := range recipients {
+		if !utils.IsPublicKey(r) {
+			return nil, fmt.Errorf("%w: recipient %d is not a JWE public key", ErrInvalidLayerEncryption, i)
+		}
+	}
+
+	cc, err := ocicryptconfig.EncryptWithJwe(recipients)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLayerEncryption, err)
+	}
+
+	return cc.EncryptConfig, nil
+}
+
+func newDecryptConfig(privateKeys [][]byte) (*ocicryptconfig.DecryptConfig, error) {
+	if len(privateKeys) == 0 {
+		return nil, fmt.Errorf("%w: no private keys", ErrInvalidLayerEncryption)
+	}
+
+	passwords := make([][]byte, len(privateKeys))
+
+	for i, k := range privateKeys {
+		if ok, err := utils.IsPrivateKey(k, nil); !ok {
+			return nil, fmt.Errorf("%w: key %d is not an unencrypted private key: %v", ErrInvalidLayerEncryption, i, err)
+		}
+
+		passwords[i] = []byte{}
+	}
+
+	cc, err := ocicryptconfig.DecryptWithPrivKeys(privateKeys, passwords)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLayerEncryption, err)
+	}
+
+	return cc.DecryptConfig, nil
+}
+
+// selected reports whether the layer at index i of n should be encrypted.
+func (le *layerEncryption) selected(i, n int) bool {
+	if len(le.layers) == 0 {
+		return true
+	}
+
+	for _, l := range le.layers {
+		if l == i || l < 0 && n+l == i {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ociDescriptor(desc v1.Descriptor) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:   string(desc.MediaType),
+		Digest:      digest.Digest(desc.Digest.String()),
+		Size:        desc.Size,
+		Annotations: desc.Annotations,
+	}
+}
+
+// decryptImage rewrites img with its encrypted layers decrypted. Decryption
+// happens before any other mutation so that they act on the plain layers.
+func decryptImage(img v1.Image, dc *ocicryptconfig.DecryptConfig) (v1.Image, error) {
+	if dc == nil {
+		return img, nil
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	var changed bool
+
+	for i, l := range layers {
+		desc := m.Layers[i]
+		if !strings.HasSuffix(string(desc.MediaType), encryptedSuffix) {
+			continue
+		}
+
+		// Unwrapping the layer key up front both checks that a private key
+		// was given for the layer and yields the plain layer digest.
+		h, err := plainLayerDigest(dc, desc)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping layer %q key: %w", desc.Digest, err)
+		}
+
+		layers[i] = &decryptedLayer{
+			base:   l,
+			desc:   desc,
+			dc:     dc,
+			digest: h,
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return img, nil
+	}
+
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	return &rewrittenImage{
+		base:            img,
+		mediaType:       mt,
+		configMediaType: m.Config.MediaType,
+		layers:          layers,
+	}, nil
+}
+
+// plainLayerDigest returns the digest of the plain layer that is recorded
+// alongside the symmetric key wrapped in the encrypted layer's annotations.
+//
+// NOTE: ocicrypt's DecryptLayer unwraps the same but loses the digest on the
+// way out, so the key wrappers are used directly.
+func plainLayerDigest(dc *ocicryptconfig.DecryptConfig, desc v1.Descriptor) (v1.Hash, error) {
+	// Surface ocicrypt's own error should none of the private keys fit.
+	if _, _, err := ocicrypt.DecryptLayer(dc, nil, ociDescriptor(desc), true); err != nil {
+		return v1.Hash{}, err
+	}
+
+	for scheme, wrapped := range ocicrypt.GetWrappedKeysMap(ociDescriptor(desc)) {
+		for _, b64 := range strings.Split(wrapped, ",") {
+			b, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return v1.Hash{}, err
+			}
+
+			optsData, err := ocicrypt.GetKeyWrapper(scheme).UnwrapKey(dc, b)
+			if err != nil {
+				continue
+			}
+
+			var opts blockcipher.PrivateLayerBlockCipherOptions
+			if err := json.Unmarshal(optsData, &opts); err != nil {
+				return v1.Hash{}, err
+			}
+
+			return v1.NewHash(opts.Digest.String())
+		}
+	}
+
+	return v1.Hash{}, errors.New("no private key could unwrap the layer key")
+}
+
+// encryptImage rewrites img with its selected layers encrypted. Encryption
+// happens after any other mutation. Already encrypted layers, or those of
+// media types that aren't regular filesystem layers, are left as-is.
+func encryptImage(img v1.Image, le *layerEncryption) (v1.Image, error) {
+	if le.encrypt == nil {
+		return img, nil
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	var changed bool
+
+	for i, l := range layers {
+		desc := m.Layers[i]
+		if _, ok := layerCompressions[desc.MediaType]; !ok || !le.selected(i, len(layers)) {
+			continue
+		}
+
+		layers[i] = &encryptedLayer{
+			base:      l,
+			desc:      desc,
+			ec:        le.encrypt,
+			mediaType: desc.MediaType + encryptedSuffix,
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return img, nil
+	}
+
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	return &rewrittenImage{
+		base:            img,
+		mediaType:       mt,
+		configMediaType: m.Config.MediaType,
+		layers:          layers,
+	}, nil
+}
+
+// encryptedLayer is a v1.Layer that is encrypted on the fly whenever its
+// compressed contents are read. Each read uses a new symmetric key, so, as with
+// recompressed layers, the digest, size and (key wrapping) annotations are not
+// known until the layer has been fully read once. The diff ID is that of the
+// plain layer, as per the ocicrypt spec.
+type encryptedLayer struct {
+	base      v1.Layer
+	desc      v1.Descriptor
+	ec        *ocicryptconfig.EncryptConfig
+	mediaType types.MediaType
+
+	mu          sync.Mutex
+	computed    bool
+	digest      v1.Hash
+	size        int64
+	annotations map[string]string
+}
+
+var _ v1.Layer = (*encryptedLayer)(nil)
+
+func (l *encryptedLayer) MediaType() (types.MediaType, error) { return l.mediaType, nil }
+
+func (l *encryptedLayer) DiffID() (v1.Hash, error) { return l.base.DiffID() }
+
+func (l *encryptedLayer) Uncompressed() (io.ReadCloser, error) { return l.base.Uncompressed() }
+
+func (l *encryptedLayer) Digest() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return v1.Hash{}, stream.ErrNotComputed
+	}
+
+	return l.digest, nil
+}
+
+func (l *encryptedLayer) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return 0, stream.ErrNotComputed
+	}
+
+	return l.size, nil
+}
+
+func (l *encryptedLayer) Annotations(base map[string]string) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return nil, stream.ErrNotComputed
+	}
+
+	annotations := make(map[string]string, len(base)+len(l.annotations))
+	for k, v := range base {
+		annotations[k] = v
+	}
+
+	for k, v := range l.annotations {
+		annotations[k] = v
+	}
+
+	return annotations, nil
+}
+
+func (l *encryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.base.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	r, finalize, err := ocicrypt.EncryptLayer(l.ec, rc, ociDescriptor(l.desc))
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("encrypting layer: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer rc.Close()
+
+		h := sha256.New()
+		cw := &countingWriter{w: io.MultiWriter(pw, h)}
+
+		_, err := io.Copy(cw, r)
+		if err == nil {
+			var annotations map[string]string
+			if annotations, err = finalize(); err == nil {
+				l.mu.Lock()
+				l.digest = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+				l.size = cw.n
+				l.annotations = annotations
+				l.computed = true
+				l.mu.Unlock()
+			}
+		}
+
+		// Readers only see EOF once the digest, size and annotations have
+		// been recorded.
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// decryptedLayer is a v1.Layer that is decrypted on the fly whenever its
+// compressed contents are read. The ocicrypt block cipher preserves the length
+// of the layer and records the digest of the plain layer, so unlike encryption
+// nothing needs to be streamed before the digest and size are known.
+type decryptedLayer struct {
+	base   v1.Layer
+	desc   v1.Descriptor
+	dc     *ocicryptconfig.DecryptConfig
+	digest v1.Hash
+}
+
+var _ v1.Layer = (*decryptedLayer)(nil)
+
+func (l *decryptedLayer) MediaType() (types.MediaType, error) {
+	return types.MediaType(strings.TrimSuffix(string(l.desc.MediaType), encryptedSuffix)), nil
+}
+
+func (l *decryptedLayer) Digest() (v1.Hash, error) { return l.digest, nil }
+
+func (l *decryptedLayer) DiffID() (v1.Hash, error) { return l.base.DiffID() }
+
+func (l *decryptedLayer) Size() (int64, error) { return l.desc.Size, nil }
+
+func (l *decryptedLayer) Annotations(base map[string]string) (map[string]string, error) {
+	return ocicrypt.FilterOutAnnotations(base), nil
+}
+
+func (l *decryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.base.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	r, _, err := ocicrypt.DecryptLayer(l.dc, rc, ociDescriptor(l.desc), false)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("decrypting layer: %w", err)
+	}
+
+	return &readCloser{Reader: r, close: rc.Close}, nil
+}
+
+func (l *decryptedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err := l.MediaType()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return decompress(rc, layerCompressions[mt])
+}
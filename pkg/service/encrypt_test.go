@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateLayerEncryption(t *testing.T) {
+	recipients := [][]byte{[]byte("not a key")}
+
+	for _, tc := range []struct {
+		name string
+		opts []CopyOption
+		err  error
+	}{
+		{
+			name: "recompressed",
+			opts: []CopyOption{WithLayerEncryption(recipients, nil), WithLayerCompression(CompressionZstd)},
+			err:  ErrIncompatibleLayerEncryption,
+		},
+		{
+			name: "converted to eStargz",
+			opts: []CopyOption{WithLayerEncryption(recipients, nil), WithEstargz(nil)},
+			err:  ErrIncompatibleLayerEncryption,
+		},
+		{
+			name: "invalid recipient",
+			opts: []CopyOption{WithLayerEncryption(recipients, nil)},
+			err:  ErrInvalidLayerEncryption,
+		},
+		{
+			name: "decrypted",
+			opts: []CopyOption{WithLayerDecryption(recipients)},
+			err:  ErrInvalidLayerEncryption,
+		},
+		{
+			name: "converted to eStargz unencrypted",
+			opts: []CopyOption{WithEstargz(nil)},
+		},
+	} {
+		if err := makeCopyOpts(tc.opts...).validateLayerEncryption(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
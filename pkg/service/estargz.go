@@ -0,0 +1,297 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var ErrIncompatibleEstargz = errors.New("incompatible eStargz conversion")
+
+// validateEstargz checks that eStargz conversion is not combined with options
+// it cannot work alongside.
+func (o *copyOpts) validateEstargz() error {
+	if !o.estargz {
+		return nil
+	}
+
+	if o.compression == CompressionZstd {
+		return fmt.Errorf("%w: eStargz layers are gzip compressed", ErrIncompatibleEstargz)
+	}
+
+	if o.soci {
+		return fmt.Errorf("%w: SOCI indexes and eStargz are alternative lazy pulling formats", ErrIncompatibleEstargz)
+	}
+
+	return nil
+}
+
+// estargzImage rewrites img with its layers converted to eStargz, making them
+// lazily pullable by the stargz snapshotter. Layers that are already eStargz,
+// or of media types that aren't regular filesystem layers, are left as-is.
+//
+// Conversion reorders (and adds to) the entries of each layer, so the diff IDs
+// of the config file change too.
+func estargzImage(img v1.Image, prioritizedFiles []string) (v1.Image, error) {
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	var changed bool
+
+	// Layers are converted one at a time, however many are written at once.
+	converting := make(chan struct{}, 1)
+
+	for i, l := range layers {
+		from, ok := layerCompressions[m.Layers[i].MediaType]
+		if !ok {
+			continue
+		}
+
+		if _, ok := m.Layers[i].Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+			continue
+		}
+
+		to, err := CompressionGzip.mediaType(mt)
+		if err != nil {
+			return nil, err
+		}
+
+		layers[i] = &estargzLayer{
+			base:             l,
+			from:             from,
+			mediaType:        to,
+			prioritizedFiles: prioritizedFiles,
+			converting:       converting,
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return img, nil
+	}
+
+	return &rewrittenImage{
+		base:            img,
+		mediaType:       mt,
+		configMediaType: m.Config.MediaType,
+		layers:          layers,
+		rewriteDiffIDs:  true,
+	}, nil
+}
+
+// estargzLayer is a v1.Layer converted to eStargz.
+//
+// Unlike recompression, conversion cannot stream its input: the eStargz builder
+// needs random access to the whole tar. The tar is therefore spilled to a
+// temporary file, which is removed as soon as the converted blob has been
+// streamed to the writer. As with recompressed layers, the digest, diff ID
+// (and so the config file) and table of contents digest are only known once
+// the layer has been written.
+type estargzLayer struct {
+	base             v1.Layer
+	from             LayerCompression
+	mediaType        types.MediaType
+	prioritizedFiles []string
+	converting       chan struct{}
+
+	mu        sync.Mutex
+	computed  bool
+	digest    v1.Hash
+	diffID    v1.Hash
+	size      int64
+	tocDigest string
+}
+
+var _ v1.Layer = (*estargzLayer)(nil)
+
+func (l *estargzLayer) MediaType() (types.MediaType, error) { return l.mediaType, nil }
+
+func (l *estargzLayer) Digest() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return v1.Hash{}, stream.ErrNotComputed
+	}
+
+	return l.digest, nil
+}
+
+func (l *estargzLayer) DiffID() (v1.Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return v1.Hash{}, stream.ErrNotComputed
+	}
+
+	return l.diffID, nil
+}
+
+func (l *estargzLayer) Size() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return 0, stream.ErrNotComputed
+	}
+
+	return l.size, nil
+}
+
+func (l *estargzLayer) Compressed() (io.ReadCloser, error) {
+	// The base layer is only fetched once it is this layer's turn, so that
+	// layers waiting to be converted hold no connections open.
+	l.converting <- struct{}{}
+
+	rc, err := l.base.Compressed()
+	if err != nil {
+		<-l.converting
+		return nil, err
+	}
+
+	urc, err := decompress(rc, l.from)
+	if err != nil {
+		<-l.converting
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer func() { <-l.converting }()
+
+		// Readers only see EOF once the digests and size have been recorded.
+		pw.CloseWithError(l.convert(urc, pw))
+	}()
+
+	return pr, nil
+}
+
+// convert writes the uncompressed base layer, converted, recording the
+// digests and size of the blob.
+func (l *estargzLayer) convert(urc io.ReadCloser, w io.Writer) error {
+	tarball, size, err := spill(urc)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		tarball.Close()
+		os.Remove(tarball.Name())
+	}()
+
+	// Prioritised files are given for the image as a whole, so most will not
+	// be found in any one layer.
+	var missing []string
+
+	blob, err := estargz.Build(
+		io.NewSectionReader(tarball, 0, size),
+		estargz.WithPrioritizedFiles(l.prioritizedFiles),
+		estargz.WithAllowPrioritizeNotFound(&missing),
+	)
+	if err != nil {
+		return fmt.Errorf("building eStargz layer: %w", err)
+	}
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(w, h)}
+
+	if _, err := io.Copy(cw, blob); err != nil {
+		blob.Close()
+		return fmt.Errorf("building eStargz layer: %w", err)
+	}
+
+	// The diff ID is only known once the blob has been read and closed.
+	if err := blob.Close(); err != nil {
+		return fmt.Errorf("building eStargz layer: %w", err)
+	}
+
+	diffID, err := v1.NewHash(blob.DiffID().String())
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.digest = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+	l.diffID = diffID
+	l.size = cw.n
+	l.tocDigest = blob.TOCDigest().String()
+	l.computed = true
+	l.mu.Unlock()
+
+	return nil
+}
+
+// spill writes the uncompressed layer to a temporary file.
+func spill(urc io.ReadCloser) (*os.File, int64, error) {
+	defer urc.Close()
+
+	f, err := ioutil.TempFile("", "ocistow-estargz-*.tar")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(f, urc)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return nil, 0, fmt.Errorf("reading layer: %w", err)
+	}
+
+	return f, size, nil
+}
+
+func (l *estargzLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(rc, CompressionGzip)
+}
+
+// Annotations adds the layer descriptor annotation that the stargz snapshotter
+// uses to verify the layer's table of contents.
+func (l *estargzLayer) Annotations(base map[string]string) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.computed {
+		return nil, stream.ErrNotComputed
+	}
+
+	annotations := make(map[string]string, len(base)+1)
+	for k, v := range base {
+		annotations[k] = v
+	}
+
+	annotations[estargz.TOCJSONDigestAnnotation] = l.tocDigest
+
+	return annotations, nil
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+)
+
+const (
+	// NotBeforeClaim and NotAfterClaim are the optional signature payload
+	// claims of the window (as RFC 3339 timestamps) that the signature is
+	// valid in.
+	NotBeforeClaim = "notBefore"
+	NotAfterClaim  = "notAfter"
+)
+
+var (
+	ErrSignatureNotYetValid = errors.New("signature not yet valid")
+	ErrSignatureExpired     = errors.New("signature expired")
+	ErrSignatureUnbounded   = errors.New("signature claims no expiry")
+	ErrInvalidValidity      = errors.New("invalid signature validity")
+)
+
+// ValidateSignatureAnnotations rejects annotations that would be taken for the
+// validity claims of signatures, which only signing itself may make, lest a
+// request claim a window of its choosing.
+func ValidateSignatureAnnotations(annotations map[string]string) error {
+	for _, claim := range []string{NotBeforeClaim, NotAfterClaim} {
+		if _, ok := annotations[claim]; ok {
+			return fmt.Errorf("%w: the %q annotation is reserved", ErrInvalidValidity, claim)
+		}
+	}
+
+	return nil
+}
+
+// validity is the window that a signature is valid in.
+type validity struct {
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// newValidity returns the window of the given length from now.
+func newValidity(now time.Time, length time.Duration) validity {
+	now = now.UTC().Truncate(time.Second)
+	return validity{notBefore: now, notAfter: now.Add(length)}
+}
+
+// claim adds the window's claims to the optional section of a payload.
+func (v validity) claim(optional map[string]interface{}) {
+	optional[NotBeforeClaim] = v.notBefore.Format(time.RFC3339)
+	optional[NotAfterClaim] = v.notAfter.Format(time.RFC3339)
+}
+
+// payloadValidity returns the window claimed by the signature payload, if any.
+func payloadValidity(p []byte) (*validity, error) {
+	var cp payload.Cosign
+	if err := json.Unmarshal(p, &cp); err != nil {
+		return nil, err
+	}
+
+	var (
+		v     validity
+		found bool
+	)
+
+	for claim, t := range map[string]*time.Time{NotBeforeClaim: &v.notBefore, NotAfterClaim: &v.notAfter} {
+		s, ok := cp.Annotations[claim]
+		if !ok {
+			continue
+		}
+
+		ts, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s claim %v is not a timestamp", ErrInvalidValidity, claim, s)
+		}
+
+		var err error
+		if *t, err = time.Parse(time.RFC3339, ts); err != nil {
+			return nil, fmt.Errorf("%w: %s claim: %s", ErrInvalidValidity, claim, err)
+		}
+
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return &v, nil
+}
+
+// verifyValidity checks that the signature is valid now, as per the window
+// claimed by its payload, which must have an end if bounded.
+func verifyValidity(sig oci.Signature, now time.Time, bounded bool) error {
+	p, err := sig.Payload()
+	if err != nil {
+		return err
+	}
+
+	v, err := payloadValidity(p)
+	if err != nil {
+		return err
+	}
+
+	if v == nil || v.notAfter.IsZero() {
+		if bounded {
+			return ErrSignatureUnbounded
+		}
+
+		return nil
+	}
+
+	if !v.notBefore.IsZero() && now.Before(v.notBefore) {
+		return fmt.Errorf("%w until %s", ErrSignatureNotYetValid, v.notBefore.Format(time.RFC3339))
+	}
+
+	if !v.notAfter.IsZero() && !now.Before(v.notAfter) {
+		return fmt.Errorf("%w on %s", ErrSignatureExpired, v.notAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// expiring returns whether a signature's claimed window ends within the given
+// duration of now, or, if expired, has already ended.
+func expiring(now time.Time, within time.Duration, expired bool) func(oci.Signature) bool {
+	return func(sig oci.Signature) bool {
+		p, err := sig.Payload()
+		if err != nil {
+			return false
+		}
+
+		v, err := payloadValidity(p)
+		if err != nil || v == nil || v.notAfter.IsZero() {
+			return false
+		}
+
+		if !now.Before(v.notAfter) {
+			return expired
+		}
+
+		return v.notAfter.Before(now.Add(within))
+	}
+}
+
+// refreshValidity returns the payload with a window from now of the given
+// length, or else of the length of the window it claims.
+func refreshValidity(now time.Time, length time.Duration) func([]byte) ([]byte, error) {
+	return func(p []byte) ([]byte, error) {
+		var cp payload.Cosign
+		if err := json.Unmarshal(p, &cp); err != nil {
+			return nil, err
+		}
+
+		l := length
+		if l <= 0 {
+			v, err := payloadValidity(p)
+			if err != nil {
+				return nil, err
+			} else if v == nil || v.notBefore.IsZero() || v.notAfter.IsZero() {
+				return nil, fmt.Errorf("%w: payload has no window to refresh", ErrInvalidValidity)
+			}
+
+			l = v.notAfter.Sub(v.notBefore)
+		}
+
+		if cp.Annotations == nil {
+			cp.Annotations = make(map[string]interface{})
+		}
+
+		newValidity(now, l).claim(cp.Annotations)
+
+		return cp.MarshalJSON()
+	}
+}
+
+// Refresh re-signs the tagged images (and indexes) of the repositories whose
+// signatures by the key, or if none by the backend's key or that routed to by
+// each image's annotations, and by any co-signing keys, expire within the
+// given duration, with a window from now, replacing them. Being tagged is
+// taken to mean being in use, so that trust in images that are no longer
+// promoted lapses. So too does trust in those whose signatures have already
+// expired, unless WithExpiredSignatureRefresh.
+//
+// The window is that of WithSignatureValidity, or else the length of the
+// window of the signature refreshed. Refresh otherwise takes the same options
+// as Resign, though the expiring signatures are always removed.
+func (s *service) Refresh(
+	ctx context.Context, repos []string, keyRef string, within time.Duration, signOpts []SignOption, opts ...ResignOption,
+) error {
+	o, ro := makeSignOpts(signOpts...), makeResignOpts(opts...)
+
+	if within <= 0 {
+		return fmt.Errorf("%w: refresh within %s", ErrInvalidValidity, within)
+	}
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return err
+	}
+
+	coKs, err := s.coSignerVerifiers(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range repos {
+		repo, err := name.NewRepository(r)
+		if err != nil {
+			return fmt.Errorf("parsing repository %q: %w", r, err)
+		}
+
+		rs := func(ctx context.Context, ref name.Digest) ([]resigning, error) {
+			var (
+				k   signature.SignerVerifier
+				err error
+			)
+
+			if keyRef == "" {
+				k, err = s.routedSignerVerifier(ctx, ref, o)
+			} else {
+				k, err = s.signerVerifier(ctx, keyRef)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			now := time.Now()
+			rs := make([]resigning, 0, len(coKs)+1)
+
+			for _, k := range append([]signature.SignerVerifier{k}, coKs...) {
+				rs = append(rs, resigning{
+					oldK:    k,
+					newK:    k,
+					old:     expiring(now, within, ro.refreshExpired),
+					payload: refreshValidity(now, o.validity),
+					remove:  true,
+				})
+			}
+
+			return rs, nil
+		}
+
+		if err := s.resignRepository(ctx, repo, rs, o, ro); err != nil {
+			return fmt.Errorf("refreshing %q: %w", repo.Name(), err)
+		}
+	}
+
+	return nil
+}
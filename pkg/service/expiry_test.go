@@ -0,0 +1,36 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiring(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name     string
+		optional string
+		want     bool
+		expired  bool
+	}{
+		{"expiring", `{"notBefore":"2022-08-01T12:00:00Z","notAfter":"2022-09-02T00:00:00Z"}`, true, true},
+		{"not yet expiring", `{"notBefore":"2022-08-01T12:00:00Z","notAfter":"2022-09-03T00:00:00Z"}`, false, false},
+		{"expired", `{"notBefore":"2022-08-01T12:00:00Z","notAfter":"2022-08-31T00:00:00Z"}`, false, true},
+		{"expiring now", `{"notAfter":"2022-09-01T12:00:00Z"}`, false, true},
+		{"unbounded", `{"notBefore":"2022-08-01T12:00:00Z"}`, false, false},
+		{"unclaimed", `null`, false, false},
+		{"invalid", `{"notAfter":"tomorrow"}`, false, false},
+	} {
+		sig := testSignature(t, tc.optional)
+
+		if got := expiring(now, 24*time.Hour, false)(sig); got != tc.want {
+			t.Errorf("%s: expiring %t, want %t", tc.name, got, tc.want)
+		}
+
+		// Already expired signatures are only refreshed when asked to be.
+		if got := expiring(now, 24*time.Hour, true)(sig); got != tc.expired {
+			t.Errorf("%s: expiring (or expired) %t, want %t", tc.name, got, tc.expired)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// rewrittenImage is a v1.Image that swaps out the manifest and config media
+// types, and the layers, of a base image whilst keeping its config file (and
+// therefore diff IDs and history) intact.
+//
+// Unlike the Go container registry mutate package, the manifest is computed
+// lazily on every call so that streaming layers, whose digests are only known
+// once they have been written, can be used without buffering them anywhere.
+//
+// Should the uncompressed contents of any layers differ from those of the base
+// image (e.g. after eStargz conversion), rewriteDiffIDs recomputes the config
+// file's diff IDs from the layers.
+type rewrittenImage struct {
+	base            v1.Image
+	mediaType       types.MediaType
+	configMediaType types.MediaType
+	layers          []v1.Layer
+	rewriteDiffIDs  bool
+}
+
+// annotatedLayer is implemented by layers that rewrite the annotations of their
+// descriptor in the manifest, given those of the base descriptor.
+type annotatedLayer interface {
+	Annotations(base map[string]string) (map[string]string, error)
+}
+
+var _ v1.Image = (*rewrittenImage)(nil)
+
+func (i *rewrittenImage) MediaType() (types.MediaType, error) { return i.mediaType, nil }
+
+func (i *rewrittenImage) Layers() ([]v1.Layer, error) { return i.layers, nil }
+
+func (i *rewrittenImage) ConfigName() (v1.Hash, error) {
+	if !i.rewriteDiffIDs {
+		return i.base.ConfigName()
+	}
+
+	return partial.ConfigName(i)
+}
+
+func (i *rewrittenImage) ConfigFile() (*v1.ConfigFile, error) {
+	cfg, err := i.base.ConfigFile()
+	if err != nil || !i.rewriteDiffIDs {
+		return cfg, err
+	}
+
+	cfg = cfg.DeepCopy()
+
+	cfg.RootFS.DiffIDs = make([]v1.Hash, len(i.layers))
+	for idx, l := range i.layers {
+		if cfg.RootFS.DiffIDs[idx], err = l.DiffID(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func (i *rewrittenImage) RawConfigFile() ([]byte, error) {
+	if !i.rewriteDiffIDs {
+		return i.base.RawConfigFile()
+	}
+
+	cfg, err := i.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(cfg)
+}
+
+func (i *rewrittenImage) Digest() (v1.Hash, error) { return partial.Digest(i) }
+
+func (i *rewrittenImage) Size() (int64, error) { return partial.Size(i) }
+
+func (i *rewrittenImage) Manifest() (*v1.Manifest, error) {
+	m, err := i.base.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	m = m.DeepCopy()
+
+	// With OCI media types, this should not be set, see discussion:
+	// https://github.com/opencontainers/image-spec/pull/795
+	m.MediaType = ""
+	if strings.Contains(string(i.mediaType), types.DockerVendorPrefix) {
+		m.MediaType = i.mediaType
+	}
+
+	m.Config.MediaType = i.configMediaType
+
+	if i.rewriteDiffIDs {
+		if m.Config.Digest, err = i.ConfigName(); err != nil {
+			return nil, err
+		}
+
+		b, err := i.RawConfigFile()
+		if err != nil {
+			return nil, err
+		}
+
+		m.Config.Size = int64(len(b))
+	}
+
+	for idx, l := range i.layers {
+		// NOTE: Errors are deliberately unwrapped so that callers can
+		// detect stream.ErrNotComputed.
+		if m.Layers[idx].Digest, err = l.Digest(); err != nil {
+			return nil, err
+		}
+
+		if m.Layers[idx].Size, err = l.Size(); err != nil {
+			return nil, err
+		}
+
+		if m.Layers[idx].MediaType, err = l.MediaType(); err != nil {
+			return nil, err
+		}
+
+		if al, ok := l.(annotatedLayer); ok {
+			if m.Layers[idx].Annotations, err = al.Annotations(m.Layers[idx].Annotations); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func (i *rewrittenImage) RawManifest() ([]byte, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(m)
+}
+
+func (i *rewrittenImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	if cfgName, err := i.ConfigName(); err == nil && cfgName == h {
+		return partial.ConfigLayer(i)
+	}
+
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+
+	return nil, fmt.Errorf("layer with digest %q not found", h)
+}
+
+func (i *rewrittenImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.DiffID(); err == nil && d == h {
+			return l, nil
+		}
+	}
+
+	return nil, fmt.Errorf("layer with diff ID %q not found", h)
+}
+
+// mediaTypeLayer overrides the media type reported by a layer.
+type mediaTypeLayer struct {
+	v1.Layer
+	mediaType types.MediaType
+}
+
+func (l *mediaTypeLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+func withLayerMediaType(l v1.Layer, mt types.MediaType) v1.Layer {
+	if current, err := l.MediaType(); err == nil && current == mt {
+		return l
+	}
+
+	// Retain the ability to cross-repository mount blobs on write.
+	if ml, ok := l.(*remote.MountableLayer); ok {
+		return &remote.MountableLayer{
+			Layer:     &mediaTypeLayer{ml.Layer, mt},
+			Reference: ml.Reference,
+		}
+	}
+
+	return &mediaTypeLayer{l, mt}
+}
@@ -0,0 +1,530 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/martinbaillie/ocistow/pkg/policy"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// InspectionMode selects what is done with forbidden content (e.g. secrets and
+// setuid binaries) found in image layers as they stream through Copy.
+type InspectionMode string
+
+const (
+	// InspectNone inspects nothing.
+	InspectNone InspectionMode = ""
+	// InspectBlock fails the copy, with a policy.DeniedError of the findings,
+	// before anything of the image is written. Each layer is therefore read
+	// twice: once to inspect it, and again to write it.
+	InspectBlock InspectionMode = "block"
+	// InspectAnnotate annotates images with a summary of their findings.
+	InspectAnnotate InspectionMode = "annotate"
+	// InspectAttest records the findings of images in the promotion record
+	// (see WithPromotionRecord) for attesting.
+	InspectAttest InspectionMode = "attest"
+)
+
+const (
+	// InspectionPredicateType is the in-toto predicate type of layer
+	// inspection attestations.
+	InspectionPredicateType = "https://github.com/martinbaillie/ocistow/inspection@v1"
+
+	// AnnotationInspectionFindings is the annotation of the number of
+	// inspection findings of an image, and AnnotationInspectionRules that of
+	// the rules they broke (comma separated).
+	AnnotationInspectionFindings = "io.github.martinbaillie.ocistow.inspection.findings"
+	AnnotationInspectionRules    = "io.github.martinbaillie.ocistow.inspection.rules"
+
+	// maxSecretScanFileSize bounds the files whose contents are scanned for
+	// secrets, and maxSecretScanLine the lines within them (longer lines are
+	// scanned in overlapping chunks).
+	maxSecretScanFileSize = 32 << 20
+	maxSecretScanLine     = 4 << 10
+	secretScanLineOverlap = 256
+)
+
+// Inspection rules.
+const (
+	ruleSSHDirectory   = "ssh-directory"
+	ruleAWSCredentials = "aws-credentials"
+	rulePrivateKey     = "private-key"
+	ruleSetuid         = "setuid"
+	ruleSetgid         = "setgid"
+	ruleWorldWritable  = "world-writable"
+	ruleSecretPrefix   = "secret/"
+)
+
+var ErrInvalidInspectionMode = errors.New("invalid inspection mode")
+
+func (m InspectionMode) validate() error {
+	switch m {
+	case InspectNone, InspectBlock, InspectAnnotate, InspectAttest:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidInspectionMode, m)
+}
+
+// layerInspection is the configuration of layer inspection.
+type layerInspection struct {
+	mode InspectionMode
+	// allow are path globs of findings to ignore, optionally qualified by
+	// rule (e.g. "setuid:usr/bin/*").
+	allow []string
+}
+
+func (i *layerInspection) allowed(f InspectionFinding) bool {
+	for _, a := range i.allow {
+		rule, glob := "", a
+		if j := strings.Index(a, ":"); j > 0 {
+			rule, glob = a[:j], a[j+1:]
+		}
+
+		if rule != "" && rule != f.Rule {
+			continue
+		}
+
+		if ok, _ := path.Match("/"+strings.TrimPrefix(glob, "/"), f.Path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InspectionFinding is forbidden content found in an image layer. Secrets
+// themselves are never recorded.
+type InspectionFinding struct {
+	Rule string `json:"rule"`
+	// Layer is the digest of the (source) layer the finding is in. Note that
+	// content deleted by a later layer is still found, as it remains within
+	// the image.
+	Layer v1.Hash `json:"layer"`
+	Path  string  `json:"path"`
+	Line  int     `json:"line,omitempty"`
+}
+
+// Inspection is the layer inspection of a promoted image.
+type Inspection struct {
+	// Digest is that of the promoted image. For indexes, there is an
+	// inspection of each of the images within.
+	Digest   v1.Hash
+	Findings []InspectionFinding
+}
+
+// Predicate returns the inspection as an attestation predicate.
+func (i *Inspection) Predicate() interface{} {
+	findings := i.Findings
+	if findings == nil {
+		findings = []InspectionFinding{}
+	}
+
+	return map[string]interface{}{"findings": findings}
+}
+
+// inspectHeader returns the findings of a layer tarball entry by its header.
+func inspectHeader(p string, hdr *tar.Header) []InspectionFinding {
+	var findings []InspectionFinding
+
+	add := func(rule string) {
+		findings = append(findings, InspectionFinding{Rule: rule, Path: "/" + p})
+	}
+
+	dir, base := path.Split(p)
+	regular := hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+
+	switch {
+	case strings.HasPrefix(p, "root/.ssh/") && hdr.Typeflag != tar.TypeDir:
+		add(ruleSSHDirectory)
+	case base == "credentials" && (dir == ".aws/" || strings.HasSuffix(dir, "/.aws/")):
+		add(ruleAWSCredentials)
+	}
+
+	if regular && hdr.Mode&04000 != 0 {
+		add(ruleSetuid)
+	}
+
+	if regular && hdr.Mode&02000 != 0 {
+		add(ruleSetgid)
+	}
+
+	// Sticky directories (e.g. /tmp) are world-writable by design.
+	if hdr.Mode&0002 != 0 && (regular || (hdr.Typeflag == tar.TypeDir && hdr.Mode&01000 == 0)) {
+		add(ruleWorldWritable)
+	}
+
+	return findings
+}
+
+// secretPattern is a pattern of secrets within a line of text. Keywords
+// (lower case) prefilter the lines worth matching, and the minimum entropy
+// applies to the secret submatch, if any, to rule out placeholders.
+type secretPattern struct {
+	rule       string
+	keywords   []string
+	re         *regexp.Regexp
+	minEntropy float64
+}
+
+var secretPatterns = []secretPattern{
+	{
+		rule:     rulePrivateKey,
+		keywords: []string{"private key"},
+		re:       regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`),
+	},
+	{
+		rule:     ruleSecretPrefix + "aws-access-key-id",
+		keywords: []string{"akia", "asia"},
+		re:       regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		rule:       ruleSecretPrefix + "aws-secret-access-key",
+		keywords:   []string{"aws"},
+		re:         regexp.MustCompile(`(?i)aws.{0,20}(?:secret|private).{0,20}[=:]\s*["']?([A-Za-z0-9/+]{40})(?:[^A-Za-z0-9/+]|$)`),
+		minEntropy: 4,
+	},
+	{
+		rule:     ruleSecretPrefix + "github-token",
+		keywords: []string{"ghp_", "gho_", "ghu_", "ghs_", "ghr_", "github_pat_"},
+		re:       regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{82})\b`),
+	},
+	{
+		rule:     ruleSecretPrefix + "gitlab-token",
+		keywords: []string{"glpat-"},
+		re:       regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`),
+	},
+	{
+		rule:     ruleSecretPrefix + "slack-token",
+		keywords: []string{"xox"},
+		re:       regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`),
+	},
+	{
+		rule:     ruleSecretPrefix + "stripe-key",
+		keywords: []string{"_live_"},
+		re:       regexp.MustCompile(`\b[sr]k_live_[A-Za-z0-9]{24,}\b`),
+	},
+	{
+		rule:     ruleSecretPrefix + "google-api-key",
+		keywords: []string{"aiza"},
+		re:       regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`),
+	},
+	{
+		rule:     ruleSecretPrefix + "generic",
+		keywords: []string{"key", "secret", "token", "passw"},
+		re: regexp.MustCompile(
+			`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d)[A-Za-z_-]*["']?\s*[:=]\s*["']?([A-Za-z0-9/+_.=-]{20,})`,
+		),
+		minEntropy: 4,
+	},
+}
+
+// secretScanner is an io.Writer of a file's contents that scans them for
+// secrets line by line, without holding more than a line in memory. Binary
+// files are skipped.
+type secretScanner struct {
+	buf    []byte
+	line   int
+	binary bool
+	start  bool
+
+	// found is the first line of each rule found, by rule.
+	found map[string]int
+}
+
+func newSecretScanner() *secretScanner {
+	return &secretScanner{line: 1, start: true, found: make(map[string]int)}
+}
+
+func (s *secretScanner) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if s.start {
+		s.start = false
+
+		head := p
+		if len(head) > 512 {
+			head = head[:512]
+		}
+
+		s.binary = bytes.IndexByte(head, 0) >= 0
+	}
+
+	if s.binary {
+		return n, nil
+	}
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.buf = append(s.buf, p...)
+
+			if len(s.buf) > maxSecretScanLine {
+				s.scan(s.buf)
+				s.buf = append(s.buf[:0], s.buf[len(s.buf)-secretScanLineOverlap:]...)
+			}
+
+			break
+		}
+
+		s.buf = append(s.buf, p[:i]...)
+		s.scan(s.buf)
+		s.buf = s.buf[:0]
+		s.line++
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// findings returns the findings of the file at the path, once written in full.
+func (s *secretScanner) findings(p string) []InspectionFinding {
+	if len(s.buf) > 0 {
+		s.scan(s.buf)
+		s.buf = nil
+	}
+
+	findings := make([]InspectionFinding, 0, len(s.found))
+	for rule, line := range s.found {
+		findings = append(findings, InspectionFinding{Rule: rule, Path: "/" + p, Line: line})
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Rule < findings[j].Rule })
+
+	return findings
+}
+
+func (s *secretScanner) scan(line []byte) {
+	lower := bytes.ToLower(line)
+
+	for _, sp := range secretPatterns {
+		if _, ok := s.found[sp.rule]; ok || !containsAny(lower, sp.keywords) {
+			continue
+		}
+
+		for _, m := range sp.re.FindAllSubmatch(line, -1) {
+			if sp.minEntropy > 0 && (len(m) < 2 || shannonEntropy(m[1]) < sp.minEntropy) {
+				continue
+			}
+
+			s.found[sp.rule] = s.line
+
+			break
+		}
+	}
+}
+
+func containsAny(b []byte, keywords []string) bool {
+	for _, k := range keywords {
+		if bytes.Contains(b, []byte(k)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shannonEntropy returns the entropy of b in bits per byte.
+func shannonEntropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var e float64
+
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+
+		p := float64(n) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// findings returns the allowed inspection findings of the image, reading any
+// layers that were not streamed through in full.
+func (s *imageScan) findings() ([]InspectionFinding, error) {
+	var findings []InspectionFinding
+
+	for _, l := range s.layers {
+		contents, err := l.scanned()
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, l.findings(contents)...)
+	}
+
+	return findings, nil
+}
+
+// findings returns the allowed inspection findings of the layer's contents.
+func (l *scannedLayer) findings(contents *layerContents) []InspectionFinding {
+	if contents == nil || len(contents.findings) == 0 {
+		return nil
+	}
+
+	digest, _ := l.Layer.Digest()
+
+	var findings []InspectionFinding
+
+	for _, f := range contents.findings {
+		f.Layer = digest
+		if !l.inspection.allowed(f) {
+			findings = append(findings, f)
+		}
+	}
+
+	return findings
+}
+
+// inspectionDenial returns the policy denial of the inspection findings.
+func inspectionDenial(findings []InspectionFinding) error {
+	violations := make([]policy.Violation, len(findings))
+
+	for i, f := range findings {
+		details := map[string]interface{}{"path": f.Path}
+		if f.Line > 0 {
+			details["line"] = f.Line
+		}
+
+		violations[i] = policy.Violation{
+			Rule:    f.Rule,
+			Message: "forbidden layer content",
+			Digest:  f.Layer.String(),
+			Details: details,
+		}
+	}
+
+	return &policy.DeniedError{Violations: violations}
+}
+
+// inspectionAnnotations returns the annotations summarising the findings.
+func inspectionAnnotations(findings []InspectionFinding) map[string]string {
+	seen := make(map[string]bool)
+
+	var rules []string
+
+	for _, f := range findings {
+		if !seen[f.Rule] {
+			seen[f.Rule] = true
+			rules = append(rules, f.Rule)
+		}
+	}
+
+	sort.Strings(rules)
+
+	return map[string]string{
+		AnnotationInspectionFindings: strconv.Itoa(len(findings)),
+		AnnotationInspectionRules:    strings.Join(rules, ","),
+	}
+}
+
+// recordInspections records the inspections of the images scanned during the
+// copy in the promotion record, if there is one.
+func (o *copyOpts) recordInspections() error {
+	if o.promotion == nil || o.inspection.mode != InspectAttest {
+		return nil
+	}
+
+	for _, scan := range o.scans {
+		d, err := scan.image.Digest()
+		if err != nil {
+			return fmt.Errorf("getting digest: %w", err)
+		}
+
+		findings, err := scan.findings()
+		if err != nil {
+			return fmt.Errorf("inspecting layers: %w", err)
+		}
+
+		o.promotion.Inspections = append(o.promotion.Inspections, Inspection{Digest: d, Findings: findings})
+	}
+
+	return nil
+}
+
+// scanOf returns the scan of the (mutated) image, if it was scanned.
+func (o *copyOpts) scanOf(img v1.Image) *imageScan {
+	for _, scan := range o.scans {
+		if scan.image == img {
+			return scan
+		}
+	}
+
+	return nil
+}
+
+// writeInspected inspects the layers of the mutated image before its manifest
+// is written, to block or annotate it as per the options. When annotating, its
+// layers are written ahead of it so that, where they stream, they are only read
+// once. When blocking, nothing is written until they are found to be clean.
+func (s *service) writeInspected(ctx context.Context, dst name.Repository, img v1.Image, o *copyOpts) (v1.Image, error) {
+	if o.inspection.mode != InspectBlock && o.inspection.mode != InspectAnnotate {
+		return img, nil
+	}
+
+	scan := o.scanOf(img)
+	if scan == nil {
+		return img, nil
+	}
+
+	if o.inspection.mode == InspectAnnotate {
+		if err := s.writeLayers(ctx, dst, img); err != nil {
+			return nil, err
+		}
+	}
+
+	findings, err := scan.findings()
+	if err != nil {
+		return nil, fmt.Errorf("inspecting layers: %w", err)
+	}
+
+	if o.inspection.mode == InspectBlock {
+		if len(findings) > 0 {
+			return nil, inspectionDenial(findings)
+		}
+
+		return img, nil
+	}
+
+	img = mutate.Annotations(img, inspectionAnnotations(findings)).(v1.Image)
+	scan.image = img
+
+	return img, nil
+}
+
+// writeLayers writes all of the layers of the image to the destination.
+func (s *service) writeLayers(ctx context.Context, dst name.Repository, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("getting layers: %w", err)
+	}
+
+	for _, l := range layers {
+		if err := remote.WriteLayer(dst, l, s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("writing layer: %w", err)
+		}
+	}
+
+	return nil
+}
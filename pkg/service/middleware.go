@@ -19,7 +19,7 @@ func NewContextLoggerMiddleware() ServiceMiddleware {
 type contextLoggerMiddleware struct{ next Service }
 
 func (clsm *contextLoggerMiddleware) Copy(
-	ctx context.Context, src, dst string, annotations map[string]string,
+	ctx context.Context, src, dst string, annotations map[string]string, opts ...CopyOption,
 ) (err error) {
 	then := time.Now()
 
@@ -44,11 +44,11 @@ func (clsm *contextLoggerMiddleware) Copy(
 			}).Msg("")
 	}()
 
-	return clsm.next.Copy(ctx, src, dst, annotations)
+	return clsm.next.Copy(ctx, src, dst, annotations, opts...)
 }
 
 func (clsm *contextLoggerMiddleware) Sign(
-	ctx context.Context, dst string, annotations map[string]string,
+	ctx context.Context, dst string, annotations map[string]string, opts ...SignOption,
 ) (err error) {
 	then := time.Now()
 
@@ -73,8 +73,176 @@ func (clsm *contextLoggerMiddleware) Sign(
 			Msg("")
 	}()
 
-	return clsm.next.Sign(ctx, dst, annotations)
+	return clsm.next.Sign(ctx, dst, annotations, opts...)
 }
+
+func (clsm *contextLoggerMiddleware) Verify(ctx context.Context, dst string, opts ...SignOption) (err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "Verify").
+			Fields(map[string]interface{}{
+				"took": fmt.Sprint(time.Since(then)),
+				"dst":  dst,
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.Verify(ctx, dst, opts...)
+}
+
+func (clsm *contextLoggerMiddleware) Attest(
+	ctx context.Context, dst, predicateType string, predicate interface{}, opts ...SignOption,
+) (err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "Attest").
+			Fields(map[string]interface{}{
+				"took":          fmt.Sprint(time.Since(then)),
+				"dst":           dst,
+				"predicateType": predicateType,
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.Attest(ctx, dst, predicateType, predicate, opts...)
+}
+
+func (clsm *contextLoggerMiddleware) AttestScan(ctx context.Context, dst string, opts ...SignOption) (err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "AttestScan").
+			Fields(map[string]interface{}{
+				"took": fmt.Sprint(time.Since(then)),
+				"dst":  dst,
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.AttestScan(ctx, dst, opts...)
+}
+
+func (clsm *contextLoggerMiddleware) Resign(
+	ctx context.Context, repos []string, oldKeyRef, newKeyRef string, signOpts []SignOption, opts ...ResignOption,
+) (err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "Resign").
+			Fields(map[string]interface{}{
+				"took":  fmt.Sprint(time.Since(then)),
+				"repos": repos,
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.Resign(ctx, repos, oldKeyRef, newKeyRef, signOpts, opts...)
+}
+
+func (clsm *contextLoggerMiddleware) Unsign(
+	ctx context.Context, dst, keyRef string, signOpts []SignOption, opts ...UnsignOption,
+) (removed []RemovedSignature, err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "Unsign").
+			Fields(map[string]interface{}{
+				"took":    fmt.Sprint(time.Since(then)),
+				"dst":     dst,
+				"removed": len(removed),
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.Unsign(ctx, dst, keyRef, signOpts, opts...)
+}
+
+func (clsm *contextLoggerMiddleware) Refresh(
+	ctx context.Context, repos []string, keyRef string, within time.Duration, signOpts []SignOption, opts ...ResignOption,
+) (err error) {
+	then := time.Now()
+
+	defer func() {
+		var e *log.Event
+		{
+			if err != nil {
+				e = log.Ctx(ctx).Error()
+				e.Fields(map[string]interface{}{"err": err})
+			} else {
+				e = log.Ctx(ctx).Info()
+			}
+		}
+
+		e.Str("component", "service").
+			Str("method", "Refresh").
+			Fields(map[string]interface{}{
+				"took":   fmt.Sprint(time.Since(then)),
+				"repos":  repos,
+				"within": fmt.Sprint(within),
+			}).
+			Msg("")
+	}()
+
+	return clsm.next.Refresh(ctx, repos, keyRef, within, signOpts, opts...)
+}
+
 func NewAWSXrayMiddleware() ServiceMiddleware {
 	return func(s Service) Service { return &awsXrayMiddleware{s} }
 }
@@ -82,10 +250,10 @@ func NewAWSXrayMiddleware() ServiceMiddleware {
 type awsXrayMiddleware struct{ next Service }
 
 func (clsm *awsXrayMiddleware) Copy(
-	ctx context.Context, src, dst string, annotations map[string]string,
+	ctx context.Context, src, dst string, annotations map[string]string, opts ...CopyOption,
 ) (err error) {
 	return xray.Capture(ctx, "Copy", func(ctxCopy context.Context) error {
-		err := clsm.next.Copy(ctxCopy, src, dst, annotations)
+		err := clsm.next.Copy(ctxCopy, src, dst, annotations, opts...)
 
 		xray.AddMetadata(ctxCopy, "src", src)
 		xray.AddMetadata(ctxCopy, "dst", dst)
@@ -100,10 +268,10 @@ func (clsm *awsXrayMiddleware) Copy(
 }
 
 func (clsm *awsXrayMiddleware) Sign(
-	ctx context.Context, dst string, annotations map[string]string,
+	ctx context.Context, dst string, annotations map[string]string, opts ...SignOption,
 ) (err error) {
 	return xray.Capture(ctx, "Sign", func(ctxSign context.Context) error {
-		err := clsm.next.Sign(ctxSign, dst, annotations)
+		err := clsm.next.Sign(ctxSign, dst, annotations, opts...)
 
 		xray.AddMetadata(ctxSign, "dst", dst)
 		xray.AddMetadata(ctxSign, "annotations", annotations)
@@ -115,3 +283,100 @@ func (clsm *awsXrayMiddleware) Sign(
 		return err
 	})
 }
+
+func (clsm *awsXrayMiddleware) Verify(ctx context.Context, dst string, opts ...SignOption) (err error) {
+	return xray.Capture(ctx, "Verify", func(ctxVerify context.Context) error {
+		err := clsm.next.Verify(ctxVerify, dst, opts...)
+
+		xray.AddMetadata(ctxVerify, "dst", dst)
+
+		if err != nil {
+			xray.AddMetadata(ctxVerify, "err", err)
+		}
+
+		return err
+	})
+}
+
+func (clsm *awsXrayMiddleware) Attest(
+	ctx context.Context, dst, predicateType string, predicate interface{}, opts ...SignOption,
+) (err error) {
+	return xray.Capture(ctx, "Attest", func(ctxAttest context.Context) error {
+		err := clsm.next.Attest(ctxAttest, dst, predicateType, predicate, opts...)
+
+		xray.AddMetadata(ctxAttest, "dst", dst)
+		xray.AddMetadata(ctxAttest, "predicateType", predicateType)
+
+		if err != nil {
+			xray.AddMetadata(ctxAttest, "err", err)
+		}
+
+		return err
+	})
+}
+
+func (clsm *awsXrayMiddleware) AttestScan(ctx context.Context, dst string, opts ...SignOption) (err error) {
+	return xray.Capture(ctx, "AttestScan", func(ctxAttestScan context.Context) error {
+		err := clsm.next.AttestScan(ctxAttestScan, dst, opts...)
+
+		xray.AddMetadata(ctxAttestScan, "dst", dst)
+
+		if err != nil {
+			xray.AddMetadata(ctxAttestScan, "err", err)
+		}
+
+		return err
+	})
+}
+
+func (clsm *awsXrayMiddleware) Resign(
+	ctx context.Context, repos []string, oldKeyRef, newKeyRef string, signOpts []SignOption, opts ...ResignOption,
+) (err error) {
+	return xray.Capture(ctx, "Resign", func(ctxResign context.Context) error {
+		err := clsm.next.Resign(ctxResign, repos, oldKeyRef, newKeyRef, signOpts, opts...)
+
+		xray.AddMetadata(ctxResign, "repos", repos)
+
+		if err != nil {
+			xray.AddMetadata(ctxResign, "err", err)
+		}
+
+		return err
+	})
+}
+
+func (clsm *awsXrayMiddleware) Unsign(
+	ctx context.Context, dst, keyRef string, signOpts []SignOption, opts ...UnsignOption,
+) (removed []RemovedSignature, err error) {
+	err = xray.Capture(ctx, "Unsign", func(ctxUnsign context.Context) error {
+		removed, err = clsm.next.Unsign(ctxUnsign, dst, keyRef, signOpts, opts...)
+
+		xray.AddMetadata(ctxUnsign, "dst", dst)
+		xray.AddMetadata(ctxUnsign, "removed", len(removed))
+
+		if err != nil {
+			xray.AddMetadata(ctxUnsign, "err", err)
+		}
+
+		return err
+	})
+
+	return removed, err
+}
+
+func (clsm *awsXrayMiddleware) Refresh(
+	ctx context.Context, repos []string, keyRef string, within time.Duration, signOpts []SignOption, opts ...ResignOption,
+) (err error) {
+	return xray.Capture(ctx, "Refresh", func(ctxRefresh context.Context) error {
+		err := clsm.next.Refresh(ctxRefresh, repos, keyRef, within, signOpts, opts...)
+
+		xray.AddMetadata(ctxRefresh, "repos", repos)
+		xray.AddMetadata(ctxRefresh, "within", within.String())
+
+		if err != nil {
+			xray.AddMetadata(ctxRefresh, "err", err)
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,371 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/martinbaillie/ocistow/pkg/policy"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// CopyOption configures optional behaviour of Service.Copy.
+type CopyOption func(*copyOpts)
+
+type copyOpts struct {
+	conversion  MediaTypeConversion
+	compression LayerCompression
+
+	soci             bool
+	sociMinLayerSize int64
+
+	estargz                 bool
+	estargzPrioritizedFiles []string
+
+	encryption layerEncryption
+
+	promotion *Promotion
+
+	sbom       SBOMFormat
+	inspection layerInspection
+	// scans are those of the images written, for their SBOMs and inspections.
+	scans []*imageScan
+
+	policy *policy.Policy
+}
+
+// SignOption configures optional behaviour of Service.Sign.
+type SignOption func(*signOpts)
+
+type signOpts struct {
+	referrers  bool
+	repository string
+	suffix     string
+	replace    bool
+	validity   time.Duration
+
+	unboundedSignatures bool
+
+	keyRoutes     KeyRoutes
+	coSigningKeys []string
+
+	attestations []attestation
+
+	scanTimeout time.Duration
+}
+
+func makeCopyOpts(opts ...CopyOption) *copyOpts {
+	o := &copyOpts{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithMediaTypeConversion rewrites the manifest, config and layer media types
+// of the copied image (or index) to the given flavour before it is written.
+func WithMediaTypeConversion(c MediaTypeConversion) CopyOption {
+	return func(o *copyOpts) {
+		o.conversion = c
+	}
+}
+
+// WithLayerCompression recompresses the layers of the copied image (or index)
+// as they stream through.
+func WithLayerCompression(c LayerCompression) CopyOption {
+	return func(o *copyOpts) {
+		o.compression = c
+	}
+}
+
+// WithSOCIIndex generates a Seekable OCI (SOCI) index of the gzip compressed
+// layers of at least minLayerSize in the copied image (or each image of the
+// copied index), allowing runtimes to lazily pull them. The index is written
+// as a referrer of the image.
+func WithSOCIIndex(minLayerSize int64) CopyOption {
+	return func(o *copyOpts) {
+		o.soci = true
+		o.sociMinLayerSize = minLayerSize
+	}
+}
+
+// WithEstargz converts the layers of the copied image (or index) to eStargz
+// for clusters running the stargz snapshotter. The prioritised files (absolute
+// paths within the image) are placed first in their layers so that they can be
+// prefetched.
+func WithEstargz(prioritizedFiles []string) CopyOption {
+	return func(o *copyOpts) {
+		o.estargz = true
+		o.estargzPrioritizedFiles = prioritizedFiles
+	}
+}
+
+// WithLayerEncryption encrypts the layers of the copied image (or each image of
+// the copied index) with ocicrypt for the given JWE recipients (PEM encoded
+// public keys). Only the layers at the given indexes are encrypted, negative
+// indexes counting back from the top layer, or all layers when none are given.
+func WithLayerEncryption(recipients [][]byte, layers []int) CopyOption {
+	return func(o *copyOpts) {
+		o.encryption.recipients = recipients
+		o.encryption.layers = layers
+	}
+}
+
+// WithLayerDecryption decrypts the ocicrypt encrypted layers of the copied
+// image (or each image of the copied index) with the given PEM encoded private
+// keys.
+func WithLayerDecryption(privateKeys [][]byte) CopyOption {
+	return func(o *copyOpts) {
+		o.encryption.privateKeys = privateKeys
+	}
+}
+
+// WithPromotionRecord records what the copy did in p, e.g. so that provenance
+// can be attested for it.
+func WithPromotionRecord(p *Promotion) CopyOption {
+	return func(o *copyOpts) {
+		o.promotion = p
+	}
+}
+
+// WithSBOM generates a software bill of materials of the copied image (or each
+// image of the copied index) in the given format, cataloguing OS and language
+// packages from its layers as they stream through. The SBOMs are recorded in
+// the promotion record (see WithPromotionRecord) for attesting.
+func WithSBOM(f SBOMFormat) CopyOption {
+	return func(o *copyOpts) {
+		o.sbom = f
+	}
+}
+
+// WithLayerInspection inspects the layers of the copied image (or each image
+// of the copied index) as they stream through for forbidden content: SSH and
+// AWS credentials, private keys, setuid/setgid binaries, world-writable files
+// and known secret tokens. Findings at paths matching any of the allowed globs
+// (optionally qualified by rule, e.g. "setuid:usr/bin/*") are ignored, and the
+// rest dealt with as per the mode.
+func WithLayerInspection(mode InspectionMode, allow []string) CopyOption {
+	return func(o *copyOpts) {
+		o.inspection.mode = mode
+		o.inspection.allow = allow
+	}
+}
+
+// WithPolicy evaluates the policy against the source image (or each image of
+// the index, or other artifact) and the request before copying, failing with a
+// policy.DeniedError of the violations of its rules, if any.
+func WithPolicy(p *policy.Policy) CopyOption {
+	return func(o *copyOpts) {
+		o.policy = p
+	}
+}
+
+func makeSignOpts(opts ...SignOption) *signOpts {
+	o := &signOpts{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithSignatureReferrers stores signatures as OCI 1.1 referrers of the signed
+// image (or index) rather than under cosign's signature tag, falling back to
+// the referrers tag schema on registries without the referrers API.
+func WithSignatureReferrers() SignOption {
+	return func(o *signOpts) {
+		o.referrers = true
+	}
+}
+
+// WithSignatureRepository stores signatures in the given repository rather
+// than alongside the signed image (or index), as with cosign's
+// COSIGN_REPOSITORY.
+func WithSignatureRepository(repo string) SignOption {
+	return func(o *signOpts) {
+		o.repository = repo
+	}
+}
+
+// WithSignatureSuffix stores signatures under cosign signature tags with the
+// given suffix rather than ".sig". Any SignatureSuffixTagPlaceholder in the
+// suffix is replaced by the tag being signed (e.g. ".{tag}.sig"), so that
+// several tags of the same digest can be signed in repositories with immutable
+// tags.
+func WithSignatureSuffix(suffix string) SignOption {
+	return func(o *signOpts) {
+		o.suffix = suffix
+	}
+}
+
+// WithSignatureReplacement has signing replace the earlier signatures of the
+// image (or index) by the same key, e.g. those with stale annotations, rather
+// than add to them, so that each key has a single current claim set.
+func WithSignatureReplacement() SignOption {
+	return func(o *signOpts) {
+		o.replace = true
+	}
+}
+
+// WithSignatureValidity has signatures claim (in their payloads) to be valid
+// for the given duration from when they are signed, which verification
+// enforces, rejecting signatures that claim no expiry. Refresh re-signs them
+// before they expire.
+func WithSignatureValidity(validity time.Duration) SignOption {
+	return func(o *signOpts) {
+		o.validity = validity
+	}
+}
+
+// WithUnboundedSignatures has verification accept signatures that claim no
+// expiry despite WithSignatureValidity, e.g. those made before it.
+func WithUnboundedSignatures() SignOption {
+	return func(o *signOpts) {
+		o.unboundedSignatures = true
+	}
+}
+
+// WithKeyRoutes signs with the key of the first route that matches the
+// destination (and its annotations) rather than the backend's key, rejecting
+// destinations that none match. Verification accepts a signature by the key of
+// any route of the destination's repository whose annotations its payload
+// matches.
+func WithKeyRoutes(routes KeyRoutes) SignOption {
+	return func(o *signOpts) {
+		o.keyRoutes = routes
+	}
+}
+
+// WithCoSigningKeys also signs with the keys of the key refs
+// ([<signer>:]<key>, e.g. vault:security), as well as the backend's key, and
+// verifies that each of them did so. Attestations are only signed by the
+// backend's (or routed) key.
+func WithCoSigningKeys(keyRefs ...string) SignOption {
+	return func(o *signOpts) {
+		o.coSigningKeys = append(o.coSigningKeys, keyRefs...)
+	}
+}
+
+// WithAttestation attaches a signed in-toto attestation of the JSON predicate
+// of the given type (e.g. a scan result or test report) about the signed image
+// (or index), alongside its signature. It can be given more than once.
+func WithAttestation(predicateType string, predicate json.RawMessage) SignOption {
+	return func(o *signOpts) {
+		o.attestations = append(o.attestations, attestation{
+			predicateType: predicateType,
+			predicate:     predicate,
+		})
+	}
+}
+
+// WithImageAttestation is WithAttestation about the image (or index) of the
+// given digest, which is either the signed one or one within it (e.g. the image
+// of a single platform of a signed index).
+func WithImageAttestation(digest v1.Hash, predicateType string, predicate json.RawMessage) SignOption {
+	return func(o *signOpts) {
+		o.attestations = append(o.attestations, attestation{
+			subject:       digest,
+			predicateType: predicateType,
+			predicate:     predicate,
+		})
+	}
+}
+
+// WithScanTimeout waits up to the timeout for the registry to finish scanning
+// images before attesting their scan findings, rather than failing straight
+// away.
+func WithScanTimeout(timeout time.Duration) SignOption {
+	return func(o *signOpts) {
+		o.scanTimeout = timeout
+	}
+}
+
+// ResignOption configures optional behaviour of Service.Resign (and
+// Service.Refresh) beyond the SignOptions it also takes.
+type ResignOption func(*resignOpts)
+
+type resignOpts struct {
+	removeOldSignatures bool
+	progress            func(ResignProgress)
+	skip                func(ref string) bool
+	refreshExpired      bool
+}
+
+func makeResignOpts(opts ...ResignOption) *resignOpts {
+	o := &resignOpts{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithOldSignatureRemoval has Resign remove the old key's signatures of the
+// images (and indexes) that it re-signs.
+func WithOldSignatureRemoval() ResignOption {
+	return func(o *resignOpts) {
+		o.removeOldSignatures = true
+	}
+}
+
+// WithResignProgress has Resign report its progress through each repository.
+func WithResignProgress(progress func(ResignProgress)) ResignOption {
+	return func(o *resignOpts) {
+		o.progress = progress
+	}
+}
+
+// WithResignSkip has Resign skip the references (of ResignProgress) that skip
+// reports, e.g. those already re-signed before it was interrupted.
+func WithResignSkip(skip func(ref string) bool) ResignOption {
+	return func(o *resignOpts) {
+		o.skip = skip
+	}
+}
+
+// WithExpiredSignatureRefresh has Refresh also refresh signatures that have
+// already expired, rather than only those yet to.
+func WithExpiredSignatureRefresh() ResignOption {
+	return func(o *resignOpts) {
+		o.refreshExpired = true
+	}
+}
+
+// UnsignOption configures optional behaviour of Service.Unsign beyond the
+// SignOptions it also takes.
+type UnsignOption func(*unsignOpts)
+
+type unsignOpts struct {
+	allSignatures bool
+	revocation    *Revocation
+}
+
+func makeUnsignOpts(opts ...UnsignOption) *unsignOpts {
+	o := &unsignOpts{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithAllSignatures has Unsign remove every signature of the image (or index),
+// whatever its key.
+func WithAllSignatures() UnsignOption {
+	return func(o *unsignOpts) {
+		o.allSignatures = true
+	}
+}
+
+// WithRevocation has Unsign attest to the signatures it removes, and why, in a
+// signed revocation record.
+func WithRevocation(reason, revoker string) UnsignOption {
+	return func(o *unsignOpts) {
+		o.revocation = &Revocation{Reason: reason, Revoker: revoker}
+	}
+}
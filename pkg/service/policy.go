@@ -0,0 +1,271 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/martinbaillie/ocistow/pkg/policy"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// enforcePolicy evaluates the policy against the source image, other artifact
+// or index, and each of the images and artifacts of the index (and any nested
+// indexes), before anything is written, returning a policy.DeniedError of any
+// violations. An index with no images or artifacts to evaluate is denied.
+func enforcePolicy(
+	p *policy.Policy,
+	srcRef name.Reference,
+	srcDesc *remote.Descriptor,
+	dstRef name.Reference,
+	annotations map[string]string,
+) error {
+	if p == nil {
+		return nil
+	}
+
+	request := policy.Input{
+		Source:      srcRef.Name(),
+		Destination: dstRef.Name(),
+		Annotations: annotations,
+	}
+
+	if tag, ok := dstRef.(name.Tag); ok {
+		request.Tag = tag.TagStr()
+	}
+
+	var (
+		inputs     []*policy.Input
+		violations []policy.Violation
+	)
+
+	if srcDesc.MediaType.IsIndex() {
+		idx, err := srcDesc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("pulling index: %w", err)
+		}
+
+		var n int
+		if inputs, n, err = indexPolicyInputs(request, idx); err != nil {
+			return err
+		}
+
+		// Rules have nothing to evaluate, so can't have been satisfied.
+		if n == 0 {
+			violations = append(violations, policy.Violation{
+				Rule:    policy.RuleNothingToEvaluate,
+				Message: "the index has no images or artifacts to evaluate",
+				Digest:  inputs[0].Digest,
+			})
+		}
+	} else {
+		image, err := isImage(srcDesc.MediaType, srcDesc.Manifest)
+		if err != nil {
+			return fmt.Errorf("inspecting %q: %w", srcRef, err)
+		}
+
+		var in *policy.Input
+		{
+			if image {
+				img, err := srcDesc.Image()
+				if err != nil {
+					return fmt.Errorf("pulling image: %w", err)
+				}
+
+				in, err = imagePolicyInput(request, img)
+			} else {
+				in, err = artifactPolicyInput(request, srcDesc.Digest, srcDesc.MediaType, srcDesc.Manifest)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		inputs = append(inputs, in)
+	}
+
+	for _, in := range inputs {
+		v, err := p.Evaluate(in)
+		if err != nil {
+			return err
+		}
+
+		violations = append(violations, v...)
+	}
+
+	if len(violations) > 0 {
+		return &policy.DeniedError{Violations: violations}
+	}
+
+	return nil
+}
+
+// indexPolicyInputs returns the policy inputs of the index of the request, the
+// index's own first, followed by those of each of its images and artifacts and
+// of its nested indexes, and how many images and artifacts there are in all.
+func indexPolicyInputs(request policy.Input, idx v1.ImageIndex) ([]*policy.Input, int, error) {
+	digest, err := idx.Digest()
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting index digest: %w", err)
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting index media type: %w", err)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting index manifest: %w", err)
+	}
+
+	in := request
+	in.Kind = policy.KindIndex
+	in.Digest = digest.String()
+	in.MediaType = string(mt)
+
+	if in.Manifest, err = idx.RawManifest(); err != nil {
+		return nil, 0, fmt.Errorf("getting index manifest: %w", err)
+	}
+
+	inputs := []*policy.Input{&in}
+
+	var n int
+
+	for _, desc := range im.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, 0, fmt.Errorf("pulling index %q: %w", desc.Digest, err)
+			}
+
+			childInputs, childN, err := indexPolicyInputs(request, child)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			// The nested index's own input totals its images and artifacts.
+			in.Size += childInputs[0].Size
+			inputs = append(inputs, childInputs...)
+			n += childN
+
+			continue
+		}
+
+		// The child is fetched as an image whatever its media type, which
+		// merely makes its raw manifest available.
+		child, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, 0, fmt.Errorf("pulling manifest %q: %w", desc.Digest, err)
+		}
+
+		manifest, err := child.RawManifest()
+		if err != nil {
+			return nil, 0, fmt.Errorf("getting manifest %q: %w", desc.Digest, err)
+		}
+
+		image, err := isImage(desc.MediaType, manifest)
+		if err != nil {
+			return nil, 0, fmt.Errorf("inspecting %q: %w", desc.Digest, err)
+		}
+
+		// BuildKit attestation manifests are image manifests in form only.
+		if desc.Annotations[dockerReferenceTypeAnnotation] == dockerAttestationManifest {
+			image = false
+		}
+
+		var childIn *policy.Input
+		{
+			if image {
+				childIn, err = imagePolicyInput(request, child)
+			} else {
+				childIn, err = artifactPolicyInput(request, desc.Digest, desc.MediaType, manifest)
+			}
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		childIn.Platform = desc.Platform
+		in.Size += childIn.Size
+		inputs = append(inputs, childIn)
+		n++
+	}
+
+	return inputs, n, nil
+}
+
+// imagePolicyInput returns the policy input of the image of the request.
+func imagePolicyInput(request policy.Input, img v1.Image) (*policy.Input, error) {
+	in := request
+	in.Kind = policy.KindImage
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("getting digest: %w", err)
+	}
+
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting media type: %w", err)
+	}
+
+	if in.Manifest, err = img.RawManifest(); err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	if in.Config, err = img.ConfigFile(); err != nil {
+		return nil, fmt.Errorf("getting config: %w", err)
+	}
+
+	in.Digest = digest.String()
+	in.MediaType = string(mt)
+	in.Labels = in.Config.Config.Labels
+	in.Layers = m.Layers
+	in.Size = manifestSize(m)
+
+	return &in, nil
+}
+
+// artifactPolicyInput returns the policy input of the (non-image) artifact of
+// the request.
+func artifactPolicyInput(
+	request policy.Input, digest v1.Hash, mediaType types.MediaType, manifest []byte,
+) (*policy.Input, error) {
+	in := request
+	in.Kind = policy.KindArtifact
+
+	m, err := v1.ParseManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest %q: %w", digest, err)
+	}
+
+	in.Digest = digest.String()
+	in.MediaType = string(mediaType)
+	in.Manifest = manifest
+	in.Layers = m.Layers
+	in.Size = manifestSize(m)
+
+	return &in, nil
+}
+
+// manifestSize is the size of the config and layers of the manifest.
+func manifestSize(m *v1.Manifest) int64 {
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+
+	return size
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/in-toto/in-toto-golang/in_toto"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// ProvenanceBuilderID identifies ocistow as the builder of promoted images
+	// in their provenance.
+	ProvenanceBuilderID = "https://github.com/martinbaillie/ocistow"
+	// ProvenanceRecipeType is the type of the recipe of a promotion.
+	ProvenanceRecipeType = "https://github.com/martinbaillie/ocistow/promotion@v1"
+)
+
+// Promotion is a record of what a copy did.
+type Promotion struct {
+	Source            string
+	SourceDigest      v1.Hash
+	Destination       string
+	DestinationDigest v1.Hash
+	Annotations       map[string]string
+	// Mutations are the options that changed the copied image (or index)
+	// beyond its annotations.
+	Mutations  map[string]interface{}
+	StartedOn  time.Time
+	FinishedOn time.Time
+
+	SBOMs       []SBOM
+	Inspections []Inspection
+}
+
+// mutations describes the options that change the copied image (or index).
+func (o *copyOpts) mutations() map[string]interface{} {
+	m := make(map[string]interface{})
+
+	if o.conversion != ConvertNone {
+		m["convertMediaTypes"] = o.conversion
+	}
+
+	if o.compression != CompressionNone {
+		m["layerCompression"] = o.compression
+	}
+
+	if o.estargz {
+		m["estargz"] = map[string]interface{}{"prioritizedFiles": o.estargzPrioritizedFiles}
+	}
+
+	if o.encryption.recipients != nil {
+		m["encrypt"] = map[string]interface{}{
+			"recipients": len(o.encryption.recipients),
+			"layers":     o.encryption.layers,
+		}
+	}
+
+	if o.encryption.privateKeys != nil {
+		m["decrypt"] = true
+	}
+
+	if o.soci {
+		m["sociIndex"] = map[string]interface{}{"minLayerSize": o.sociMinLayerSize}
+	}
+
+	return m
+}
+
+// recordPromotion records the copy in p, if it is to be recorded.
+func (s *service) recordPromotion(
+	ctx context.Context,
+	p *Promotion,
+	srcRef name.Reference,
+	srcDesc *remote.Descriptor,
+	dstRef name.Reference,
+	annotations map[string]string,
+	mutations map[string]interface{},
+	started time.Time,
+) error {
+	if p == nil {
+		return nil
+	}
+
+	dstDesc, err := remote.Head(dstRef, s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		return fmt.Errorf("fetching %q: %w", dstRef.Name(), err)
+	}
+
+	*p = Promotion{
+		Source:            srcRef.Name(),
+		SourceDigest:      srcDesc.Digest,
+		Destination:       dstRef.Name(),
+		DestinationDigest: dstDesc.Digest,
+		Annotations:       annotations,
+		Mutations:         mutations,
+		StartedOn:         started,
+		FinishedOn:        time.Now(),
+	}
+
+	return nil
+}
+
+// Provenance returns the SLSA provenance predicate of the promotion, which was
+// invoked by the given identity (e.g. a Lambda request ID or CLI user).
+func (p *Promotion) Provenance(invoker string) *in_toto.ProvenancePredicate {
+	started, finished := p.StartedOn.UTC(), p.FinishedOn.UTC()
+
+	return &in_toto.ProvenancePredicate{
+		Builder: in_toto.ProvenanceBuilder{ID: ProvenanceBuilderID},
+		Recipe: in_toto.ProvenanceRecipe{
+			Type:       ProvenanceRecipeType,
+			EntryPoint: "copy",
+			Arguments: map[string]interface{}{
+				"source":      p.Source,
+				"destination": p.Destination,
+				"annotations": p.Annotations,
+				"mutations":   p.Mutations,
+			},
+			Environment: map[string]interface{}{
+				"invoker": invoker,
+			},
+		},
+		Metadata: &in_toto.ProvenanceMetadata{
+			BuildStartedOn:  &started,
+			BuildFinishedOn: &finished,
+			Completeness: in_toto.ProvenanceComplete{
+				Arguments:   true,
+				Environment: true,
+				Materials:   true,
+			},
+		},
+		Materials: []in_toto.ProvenanceMaterial{{
+			URI:    p.Source,
+			Digest: in_toto.DigestSet{p.SourceDigest.Algorithm: p.SourceDigest.Hex},
+		}},
+	}
+}
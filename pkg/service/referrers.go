@@ -0,0 +1,347 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// NOTE: The Go container registry libraries predate OCI 1.1, so referrers (i.e.
+// manifests with a subject) are written here by hand. Registries that support
+// the referrers API acknowledge the subject of a pushed manifest with the
+// OCI-Subject header. Those that don't are given a referrers tag schema index
+// instead, as per the OCI distribution spec's fallback.
+//
+// That fallback is a read-modify-write of a tag, so concurrent writers of
+// referrers to the same subject race, the last write dropping the others'
+// descriptors. Each update is therefore read back and retried until it sticks
+// (or a limit is reached), which narrows but cannot close that window; only
+// the referrers API can. The fallback is never used where the registry
+// supports the referrers API, and fails clearly where the tag is immutable.
+
+const (
+	ociSubjectHeader = "OCI-Subject"
+
+	// referrersTagAttempts is the number of times an update of a referrers
+	// tag schema index is written before giving up on it sticking.
+	referrersTagAttempts = 3
+)
+
+var (
+	ErrReferrersTagConflict  = errors.New("concurrently updated referrers tag")
+	ErrImmutableReferrersTag = errors.New("immutable referrers tag")
+)
+
+// referrerDescriptor is a descriptor that, unlike those of the Go container
+// registry libraries, can carry an artifact type.
+type referrerDescriptor struct {
+	v1.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type referrersIndex struct {
+	SchemaVersion int64                `json:"schemaVersion"`
+	MediaType     types.MediaType      `json:"mediaType"`
+	Manifests     []referrerDescriptor `json:"manifests"`
+}
+
+// rawManifest is a remote.Taggable of an already serialised manifest.
+type rawManifest struct {
+	manifest  []byte
+	mediaType types.MediaType
+}
+
+func (rm *rawManifest) RawManifest() ([]byte, error) { return rm.manifest, nil }
+
+func (rm *rawManifest) MediaType() (types.MediaType, error) { return rm.mediaType, nil }
+
+// referrersTag returns the referrers tag schema tag for the subject digest.
+func referrersTag(repo name.Repository, subject v1.Hash) name.Tag {
+	return repo.Tag(fmt.Sprintf("%s-%s", subject.Algorithm, subject.Hex))
+}
+
+// writeReferrer writes a manifest of the given media type and artifact type
+// that refers to the subject manifest in the repository.
+func (s *service) writeReferrer(
+	ctx context.Context,
+	repo name.Repository,
+	manifest []byte,
+	mediaType types.MediaType,
+	artifactType string,
+	subject v1.Hash,
+) error {
+	digest, size, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+
+	supported, err := s.putReferrer(ctx, repo, manifest, mediaType, digest)
+	if err != nil {
+		return fmt.Errorf("writing referrer %q: %w", digest, err)
+	}
+
+	if supported {
+		return nil
+	}
+
+	desc := referrerDescriptor{
+		Descriptor: v1.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest,
+			Size:      size,
+		},
+		ArtifactType: artifactType,
+	}
+
+	return s.updateReferrersTagIndex(ctx, referrersTag(repo, subject), func(idx *referrersIndex) bool {
+		for _, d := range idx.Manifests {
+			if d.Digest == digest {
+				return false
+			}
+		}
+
+		idx.Manifests = append(idx.Manifests, desc)
+
+		return true
+	})
+}
+
+// deleteReferrer deletes the referrer manifest of the subject, removing it
+// from the subject's referrers tag schema index should it be in one.
+func (s *service) deleteReferrer(ctx context.Context, repo name.Repository, subject, digest v1.Hash) error {
+	if err := remote.Delete(repo.Digest(digest.String()), s.backend.RemoteOpts(ctx)...); err != nil {
+		return fmt.Errorf("deleting referrer %q: %w", digest, err)
+	}
+
+	return s.updateReferrersTagIndex(ctx, referrersTag(repo, subject), func(idx *referrersIndex) bool {
+		manifests := make([]referrerDescriptor, 0, len(idx.Manifests))
+
+		for _, desc := range idx.Manifests {
+			if desc.Digest != digest {
+				manifests = append(manifests, desc)
+			}
+		}
+
+		if len(manifests) == len(idx.Manifests) {
+			return false
+		}
+
+		idx.Manifests = manifests
+
+		return true
+	})
+}
+
+// updateReferrersTagIndex applies the update, which reports whether it changed
+// the index and must be idempotent, to the referrers tag schema index, reading
+// the index back after each write to check that the update was not lost to a
+// concurrent writer.
+func (s *service) updateReferrersTagIndex(
+	ctx context.Context, tag name.Tag, update func(*referrersIndex) bool,
+) error {
+	for attempt := 0; ; attempt++ {
+		idx, err := s.referrersTagIndex(ctx, tag)
+		if err != nil {
+			return err
+		}
+
+		if !update(idx) {
+			return nil
+		}
+
+		if attempt == referrersTagAttempts {
+			return fmt.Errorf("%w %q: update lost %d times", ErrReferrersTagConflict, tag.Name(), attempt)
+		}
+
+		if err := s.putReferrersTagIndex(ctx, tag, idx); err != nil {
+			return err
+		}
+	}
+}
+
+// putReferrersTagIndex writes the referrers tag schema index.
+func (s *service) putReferrersTagIndex(ctx context.Context, tag name.Tag, idx *referrersIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	err = remote.Put(tag, &rawManifest{b, types.OCIImageIndex}, s.backend.RemoteOpts(ctx)...)
+	if isImmutableTagError(err) {
+		return fmt.Errorf(
+			"%w %q: the registry supports neither the referrers API nor overwriting the tag: %v",
+			ErrImmutableReferrersTag, tag.Name(), err,
+		)
+	} else if err != nil {
+		return fmt.Errorf("writing referrers tag %q: %w", tag.Name(), err)
+	}
+
+	return nil
+}
+
+// isImmutableTagError returns whether the error is that of overwriting an
+// immutable tag, which registries (e.g. ECR) report as an invalid tag.
+func isImmutableTagError(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	for _, d := range terr.Errors {
+		if d.Code == transport.TagInvalidErrorCode || strings.Contains(strings.ToLower(d.Message), "immutable") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// putReferrer pushes the manifest by digest, reporting whether the registry
+// processed its subject.
+func (s *service) putReferrer(
+	ctx context.Context,
+	repo name.Repository,
+	manifest []byte,
+	mediaType types.MediaType,
+	digest v1.Hash,
+) (bool, error) {
+	tr, err := s.backend.RegistryTransport(ctx, repo, repo.Scope(transport.PushScope))
+	if err != nil {
+		return false, err
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", repo.RepositoryStr(), digest),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(manifest))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", string(mediaType))
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted); err != nil {
+		return false, err
+	}
+
+	return resp.Header.Get(ociSubjectHeader) != "", nil
+}
+
+// referrersTagIndex returns the referrers tag schema index, which is empty
+// should the tag not yet exist.
+func (s *service) referrersTagIndex(ctx context.Context, tag name.Tag) (*referrersIndex, error) {
+	idx := &referrersIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+
+	desc, err := remote.Get(tag, s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return idx, nil
+		}
+
+		return nil, fmt.Errorf("fetching referrers tag %q: %w", tag.Name(), err)
+	}
+
+	if err := json.Unmarshal(desc.Manifest, idx); err != nil {
+		return nil, fmt.Errorf("parsing referrers tag %q: %w", tag.Name(), err)
+	}
+
+	return idx, nil
+}
+
+// referrers returns the descriptors of the manifests of the artifact type that
+// refer to the subject, through the referrers API where the registry supports
+// it, or the referrers tag schema otherwise.
+func (s *service) referrers(
+	ctx context.Context, repo name.Repository, subject v1.Hash, artifactType string,
+) ([]referrerDescriptor, error) {
+	idx, supported, err := s.getReferrers(ctx, repo, subject, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("fetching referrers of %q: %w", subject, err)
+	}
+
+	if !supported {
+		if idx, err = s.referrersTagIndex(ctx, referrersTag(repo, subject)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Registries need not apply the artifact type filter.
+	var descs []referrerDescriptor
+
+	for _, desc := range idx.Manifests {
+		if desc.ArtifactType == artifactType {
+			descs = append(descs, desc)
+		}
+	}
+
+	return descs, nil
+}
+
+// getReferrers queries the referrers API, reporting whether the registry
+// supports it.
+func (s *service) getReferrers(
+	ctx context.Context, repo name.Repository, subject v1.Hash, artifactType string,
+) (*referrersIndex, bool, error) {
+	tr, err := s.backend.RegistryTransport(ctx, repo, repo.Scope(transport.PullScope))
+	if err != nil {
+		return nil, false, err
+	}
+
+	u := url.URL{
+		Scheme:   repo.Registry.Scheme(),
+		Host:     repo.RegistryStr(),
+		Path:     fmt.Sprintf("/v2/%s/referrers/%s", repo.RepositoryStr(), subject),
+		RawQuery: url.Values{"artifactType": []string{artifactType}}.Encode(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	// Registries without the referrers API do not know of the endpoint.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, false, err
+	}
+
+	idx := &referrersIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(idx); err != nil {
+		return nil, false, fmt.Errorf("parsing referrers: %w", err)
+	}
+
+	return idx, true, nil
+}
@@ -0,0 +1,530 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/cosign/pkg/oci/empty"
+	"github.com/sigstore/cosign/pkg/oci/walk"
+	"github.com/sigstore/sigstore/pkg/signature"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocimutate "github.com/sigstore/cosign/pkg/oci/mutate"
+	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
+)
+
+// ResignOutcome is what Resign did with a signed reference.
+type ResignOutcome string
+
+const (
+	// ResignResigned is a reference whose old key signatures are (now) also
+	// signed by the new key.
+	ResignResigned ResignOutcome = "resigned"
+	// ResignUnsigned is a reference that the old key did not sign (or, when
+	// refreshing, whose signatures are not expiring).
+	ResignUnsigned ResignOutcome = "unsigned"
+	// ResignSkipped is a reference that was skipped, as per WithResignSkip.
+	ResignSkipped ResignOutcome = "skipped"
+)
+
+var (
+	ErrInvalidResign = errors.New("invalid re-sign")
+
+	// cosignTagRegex matches the tags of signatures, attestations and
+	// referrers, which are not themselves re-signed.
+	cosignTagRegex = regexp.MustCompile(`^sha256-[a-f0-9]{64}`)
+)
+
+// ResignProgress is the progress of Resign through a repository.
+type ResignProgress struct {
+	// Ref is the digest reference of the image (or index) re-signed, or its
+	// tag and digest when signatures are suffixed with their tag.
+	Ref     string
+	Outcome ResignOutcome
+	// Signed and Removed are the number of signatures made by the new key and
+	// removed of the old key, across the image (or index) and its manifests.
+	Signed  int
+	Removed int
+	// Done is the number of references of the repository done, of Total.
+	Done  int
+	Total int
+}
+
+// resignRef is a tagged image (or index) of a repository to re-sign.
+type resignRef struct {
+	ref       string
+	digest    name.Digest
+	sigSuffix string
+}
+
+// Resign signs the tagged images (and indexes) of the repositories that are
+// signed by the old key with the new key, e.g. when rotating keys, signing the
+// same payloads, so that their annotations still hold. Without a new key, the
+// backend's key signs, or that routed to by each image's annotations.
+//
+// Resign takes the same options as signing, so that signatures are looked for
+// (and written) wherever they were, and optionally removes the old key's
+// signatures once re-signed. Attestations are not re-signed.
+func (s *service) Resign(
+	ctx context.Context, repos []string, oldKeyRef, newKeyRef string, signOpts []SignOption, opts ...ResignOption,
+) error {
+	o, ro := makeSignOpts(signOpts...), makeResignOpts(opts...)
+
+	if oldKeyRef == "" {
+		return fmt.Errorf("%w: no old key", ErrInvalidResign)
+	}
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return err
+	}
+
+	oldK, err := s.signerVerifier(ctx, oldKeyRef)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range repos {
+		repo, err := name.NewRepository(r)
+		if err != nil {
+			return fmt.Errorf("parsing repository %q: %w", r, err)
+		}
+
+		rs := func(ctx context.Context, ref name.Digest) ([]resigning, error) {
+			var (
+				newK signature.SignerVerifier
+				err  error
+			)
+
+			if newKeyRef == "" {
+				newK, err = s.routedSignerVerifier(ctx, ref, o)
+			} else {
+				newK, err = s.signerVerifier(ctx, newKeyRef)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			if sameKey(oldK, newK) {
+				return nil, fmt.Errorf("%w: %q is signed by the old key", ErrInvalidResign, ref.Name())
+			}
+
+			return []resigning{{
+				oldK:   oldK,
+				newK:   newK,
+				remove: ro.removeOldSignatures,
+			}}, nil
+		}
+
+		if err := s.resignRepository(ctx, repo, rs, o, ro); err != nil {
+			return fmt.Errorf("re-signing %q: %w", repo.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// sameKey returns whether the keys have the same public key, so that
+// re-signing (and removing the old key's signatures) would be a loss.
+func sameKey(a, b signature.PublicKeyProvider) bool {
+	aPub, err := a.PublicKey()
+	if err != nil {
+		return false
+	}
+
+	bPub, err := b.PublicKey()
+	if err != nil {
+		return false
+	}
+
+	aDER, err := x509.MarshalPKIXPublicKey(aPub)
+	if err != nil {
+		return false
+	}
+
+	bDER, err := x509.MarshalPKIXPublicKey(bPub)
+
+	return err == nil && bytes.Equal(aDER, bDER)
+}
+
+// resigning is how signatures are re-signed.
+type resigning struct {
+	oldK, newK signature.SignerVerifier
+	// old selects which of the old key's signatures to re-sign, or all if nil.
+	old func(oci.Signature) bool
+	// payload returns the payload to re-sign an old payload as, or the same if
+	// nil.
+	payload func([]byte) ([]byte, error)
+	// remove removes the old signatures once re-signed.
+	remove bool
+}
+
+// resign signs the payloads of the old key's selected signatures for the
+// digest with the new key, unless it already has, returning the old signatures
+// and those of the new key.
+func (r *resigning) resign(
+	ctx context.Context, digest v1.Hash, sigs []oci.Signature,
+) (old, newSigs []oci.Signature, err error) {
+	for _, sig := range signaturesBy(r.oldK, digest, sigs) {
+		if r.old != nil && !r.old(sig) {
+			continue
+		}
+
+		old = append(old, sig)
+
+		p, err := sig.Payload()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if r.payload != nil {
+			if p, err = r.payload(p); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if signedBy(r.newK, p, sigs) || signedBy(r.newK, p, newSigs) {
+			continue
+		}
+
+		newSig, err := signPayload(ctx, r.newK, p)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newSigs = append(newSigs, newSig)
+	}
+
+	return old, newSigs, nil
+}
+
+// resignRepository re-signs the tagged images (and indexes) of the repository
+// as per the resignings of each, which are those of its key.
+func (s *service) resignRepository(
+	ctx context.Context,
+	repo name.Repository,
+	resignings func(context.Context, name.Digest) ([]resigning, error),
+	o *signOpts,
+	ro *resignOpts,
+) error {
+	sigRepo, err := o.signatureRepository(repo)
+	if err != nil {
+		return err
+	}
+
+	refs, err := s.resignRefs(ctx, repo, sigRepo, o)
+	if err != nil {
+		return err
+	}
+
+	for i, ref := range refs {
+		p := ResignProgress{Ref: ref.ref, Outcome: ResignSkipped, Done: i + 1, Total: len(refs)}
+
+		if ro.skip == nil || !ro.skip(ref.ref) {
+			rs, err := resignings(ctx, ref.digest)
+			if err != nil {
+				return fmt.Errorf("re-signing %q: %w", ref.ref, err)
+			}
+
+			if p.Outcome, p.Signed, p.Removed, err = s.resignRef(ctx, ref, sigRepo, rs, o); err != nil {
+				return fmt.Errorf("re-signing %q: %w", ref.ref, err)
+			}
+		}
+
+		if ro.progress != nil {
+			ro.progress(p)
+		}
+	}
+
+	return nil
+}
+
+// resignRefs returns the tagged images (and indexes) of the repository, once
+// per signature tag.
+func (s *service) resignRefs(
+	ctx context.Context, repo, sigRepo name.Repository, o *signOpts,
+) ([]resignRef, error) {
+	tags, err := remote.List(repo, s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("listing tags: %w", err)
+	}
+
+	sort.Strings(tags)
+
+	var (
+		refs []resignRef
+		seen = make(map[string]bool)
+	)
+
+	for _, t := range tags {
+		if cosignTagRegex.MatchString(t) {
+			continue
+		}
+
+		tag := repo.Tag(t)
+
+		desc, err := remote.Head(tag, s.backend.RemoteOpts(ctx)...)
+		if err != nil {
+			return nil, fmt.Errorf("fetching %q: %w", tag.Name(), err)
+		}
+
+		sigSuffix, err := o.signatureSuffix(tag, sigRepo)
+		if err != nil {
+			return nil, err
+		}
+
+		ref := resignRef{digest: repo.Digest(desc.Digest.String()), sigSuffix: sigSuffix}
+
+		ref.ref = ref.digest.Name()
+		if strings.Contains(o.suffix, SignatureSuffixTagPlaceholder) {
+			ref.ref = tag.Name() + "@" + desc.Digest.String()
+		}
+
+		if !seen[ref.ref] {
+			seen[ref.ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, nil
+}
+
+// resignRef re-signs the image (or index) and each of its manifests.
+func (s *service) resignRef(
+	ctx context.Context, ref resignRef, sigRepo name.Repository, rs []resigning, o *signOpts,
+) (outcome ResignOutcome, signed, removed int, err error) {
+	outcome = ResignUnsigned
+
+	se, err := ociremote.SignedEntity(ref.digest, s.signatureRemoteOpts(ctx, sigRepo, ref.sigSuffix)...)
+	if err != nil {
+		return outcome, 0, 0, fmt.Errorf("discovering signed entity: %w", err)
+	}
+
+	err = walk.SignedEntity(ctx, se, func(ctx context.Context, se oci.SignedEntity) error {
+		desc, err := signedEntityDescriptor(se)
+		if err != nil {
+			return err
+		}
+
+		var sigs []oci.Signature
+		if o.referrers {
+			sigs, err = s.referrerSignatures(ctx, sigRepo, desc.Digest)
+		} else {
+			sigs, err = tagSignatures(se)
+		}
+
+		if err != nil {
+			return fmt.Errorf("discovering signatures: %w", err)
+		}
+
+		var newSigs, oldSigs []oci.Signature
+
+		for i := range rs {
+			old, resigned, err := rs[i].resign(ctx, desc.Digest, sigs)
+			if err != nil {
+				return err
+			}
+
+			if len(old) == 0 {
+				continue
+			}
+
+			outcome = ResignResigned
+			newSigs = append(newSigs, resigned...)
+
+			if rs[i].remove {
+				oldSigs = append(oldSigs, old...)
+			}
+		}
+
+		signed += len(newSigs)
+
+		if o.referrers {
+			if len(newSigs) > 0 {
+				if err := s.writeArtifactReferrer(ctx, sigRepo, desc, SignatureArtifactType, newSigs...); err != nil {
+					return err
+				}
+			}
+
+			if len(oldSigs) == 0 {
+				return nil
+			}
+
+			removedSigs, err := s.removeReferrerSignatures(ctx, sigRepo, desc.Digest, signatureIn(oldSigs))
+			removed += len(removedSigs)
+
+			return err
+		}
+
+		kept, removedSigs := partitionSignatures(sigs, signatureIn(oldSigs))
+		removed += len(removedSigs)
+
+		if len(newSigs) == 0 && len(removedSigs) == 0 {
+			return nil
+		}
+
+		return s.replaceTagSignatures(ctx, se, sigRepo, ref.sigSuffix, append(kept, newSigs...))
+	})
+
+	return outcome, signed, removed, err
+}
+
+// signatureIn returns whether a signature is one of the signatures, as per
+// their base64 signatures.
+func signatureIn(sigs []oci.Signature) func(oci.Signature) bool {
+	b64sigs := make(map[string]bool, len(sigs))
+
+	for _, sig := range sigs {
+		if b64sig, err := sig.Base64Signature(); err == nil {
+			b64sigs[b64sig] = true
+		}
+	}
+
+	return func(sig oci.Signature) bool {
+		b64sig, err := sig.Base64Signature()
+		return err == nil && b64sigs[b64sig]
+	}
+}
+
+// partitionSignatures returns the signatures to keep, and those that remove
+// reports.
+func partitionSignatures(
+	sigs []oci.Signature, remove func(oci.Signature) bool,
+) (kept, removed []oci.Signature) {
+	kept = make([]oci.Signature, 0, len(sigs))
+
+	for _, sig := range sigs {
+		if remove(sig) {
+			removed = append(removed, sig)
+		} else {
+			kept = append(kept, sig)
+		}
+	}
+
+	return kept, removed
+}
+
+// replacedSignatures is a signed entity whose signatures are replaced.
+type replacedSignatures struct {
+	oci.SignedEntity
+	sigs oci.Signatures
+}
+
+func (rs *replacedSignatures) Signatures() (oci.Signatures, error) { return rs.sigs, nil }
+
+func (rs *replacedSignatures) Digest() (v1.Hash, error) {
+	return rs.SignedEntity.(interface{ Digest() (v1.Hash, error) }).Digest()
+}
+
+// replaceTagSignatures writes the signatures under the cosign signature tag of
+// the signed entity in place of those there, deleting the signature manifest
+// should there be none.
+func (s *service) replaceTagSignatures(
+	ctx context.Context, se oci.SignedEntity, sigRepo name.Repository, sigSuffix string, sigs []oci.Signature,
+) error {
+	if len(sigs) == 0 {
+		desc, err := signedEntityDescriptor(se)
+		if err != nil {
+			return err
+		}
+
+		tag, err := ociremote.SignatureTag(
+			sigRepo.Digest(desc.Digest.String()), s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...,
+		)
+		if err != nil {
+			return err
+		}
+
+		sigDesc, err := remote.Head(tag, s.backend.RemoteOpts(ctx)...)
+		if err != nil {
+			return fmt.Errorf("fetching signatures %q: %w", tag.Name(), err)
+		}
+
+		if err := remote.Delete(tag.Digest(sigDesc.Digest.String()), s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("deleting signatures %q: %w", tag.Name(), err)
+		}
+
+		return nil
+	}
+
+	replaced, err := ocimutate.AppendSignatures(empty.Signatures(), sigs...)
+	if err != nil {
+		return err
+	}
+
+	return ociremote.WriteSignatures(
+		sigRepo, &replacedSignatures{se, replaced}, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...,
+	)
+}
+
+// removeReferrerSignatures removes the signatures that remove reports from the
+// signature referrers of the subject, rewriting those that have others and
+// deleting those that are then empty. It returns the signatures removed.
+func (s *service) removeReferrerSignatures(
+	ctx context.Context, repo name.Repository, subject v1.Hash, remove func(oci.Signature) bool,
+) ([]oci.Signature, error) {
+	descs, err := s.referrers(ctx, repo, subject, SignatureArtifactType)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []oci.Signature
+
+	for _, desc := range descs {
+		m, sigs, err := s.referrerManifestSignatures(ctx, repo, desc.Digest)
+		if err != nil {
+			return removed, err
+		}
+
+		var (
+			layers      = make([]v1.Descriptor, 0, len(m.Layers))
+			removedSigs []oci.Signature
+		)
+
+		for i, layer := range m.Layers {
+			if sigs[i] != nil && remove(sigs[i]) {
+				removedSigs = append(removedSigs, sigs[i])
+				continue
+			}
+
+			layers = append(layers, layer)
+		}
+
+		if len(removedSigs) == 0 {
+			continue
+		}
+
+		// The kept signatures are written anew before the old manifest is
+		// deleted, so that none are lost should deletion fail.
+		if len(layers) > 0 {
+			m.Layers = layers
+
+			b, err := json.Marshal(m)
+			if err != nil {
+				return removed, err
+			}
+
+			if err := s.writeReferrer(ctx, repo, b, m.MediaType, m.ArtifactType, subject); err != nil {
+				return removed, err
+			}
+		}
+
+		if err := s.deleteReferrer(ctx, repo, subject, desc.Digest); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, removedSigs...)
+	}
+
+	return removed, nil
+}
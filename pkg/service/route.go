@@ -0,0 +1,185 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+)
+
+var (
+	ErrInvalidKeyRoute = errors.New("invalid signing key route")
+	ErrNoKeyRoute      = errors.New("no signing key route")
+)
+
+// KeyRoute routes the signing of destinations in matching repositories, and
+// optionally with matching annotations, to a key.
+type KeyRoute struct {
+	// Repository is a pattern (as per path.Match) of the destination's
+	// repository, including its registry, e.g.
+	// "*.dkr.ecr.*.amazonaws.com/team-a/*".
+	Repository string `json:"repository"`
+	// Annotations are patterns of the values of annotations that the
+	// destination must also have, if any.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Key is the key ref ([<signer>:]<key>) to sign with.
+	Key string `json:"key"`
+}
+
+func (r *KeyRoute) validate() error {
+	if r.Key == "" {
+		return fmt.Errorf("%w: %q has no key", ErrInvalidKeyRoute, r.Repository)
+	}
+
+	if _, err := path.Match(r.Repository, ""); err != nil {
+		return fmt.Errorf("%w: repository %q: %s", ErrInvalidKeyRoute, r.Repository, err)
+	}
+
+	for k, v := range r.Annotations {
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("%w: annotation %q of %q: %s", ErrInvalidKeyRoute, k, r.Repository, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *KeyRoute) matchesRepository(repo name.Repository) bool {
+	ok, _ := path.Match(r.Repository, repo.Name())
+	return ok
+}
+
+// matchesAnnotations returns whether the annotations (e.g. of a signature
+// payload, whose values need not be strings) match those of the route.
+func (r *KeyRoute) matchesAnnotations(annotations map[string]interface{}) bool {
+	for k, pattern := range r.Annotations {
+		v, ok := annotations[k]
+		if !ok {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern, fmt.Sprint(v)); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// KeyRoutes route the signing of destinations to the key of the first of them
+// that matches.
+type KeyRoutes []KeyRoute
+
+// ParseKeyRoutes parses and validates JSON key routes.
+func ParseKeyRoutes(b []byte) (KeyRoutes, error) {
+	var routes KeyRoutes
+	if err := json.Unmarshal(b, &routes); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKeyRoute, err)
+	}
+
+	return routes, routes.validate()
+}
+
+func (rs KeyRoutes) validate() error {
+	for i := range rs {
+		if err := rs[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Route returns the key ref of the first route that matches the destination
+// and its annotations.
+func (rs KeyRoutes) Route(dst string, annotations map[string]string) (string, error) {
+	dstRef, err := parseOCIReference(dst)
+	if err != nil {
+		return "", fmt.Errorf("parsing destination reference %q: %w", dst, err)
+	}
+
+	return rs.route(dstRef.Context(), annotations)
+}
+
+// route returns the key ref of the first route that matches the repository and
+// annotations.
+func (rs KeyRoutes) route(repo name.Repository, annotations map[string]string) (string, error) {
+	downscaled := make(map[string]interface{}, len(annotations))
+	for k, v := range annotations {
+		downscaled[k] = v
+	}
+
+	for _, r := range rs {
+		if r.matchesRepository(repo) && r.matchesAnnotations(downscaled) {
+			return r.Key, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrNoKeyRoute, repo.Name())
+}
+
+// of returns the routes of the destination repository, whatever its
+// annotations, or a route to the backend's key when there are none to route
+// by.
+func (rs KeyRoutes) of(repo name.Repository) (KeyRoutes, error) {
+	if len(rs) == 0 {
+		return KeyRoutes{{}}, nil
+	}
+
+	var routes KeyRoutes
+
+	for _, r := range rs {
+		if r.matchesRepository(repo) {
+			routes = append(routes, r)
+		}
+	}
+
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrNoKeyRoute, repo.Name())
+	}
+
+	return routes, nil
+}
+
+// signatures groups the signatures by the key of the first of the routes that
+// their payload annotations match, as signing would have routed them, keyed in
+// the order of the routes. Signatures that none match are left out.
+func (rs KeyRoutes) signatures(sigs []oci.Signature) ([]string, map[string][]oci.Signature) {
+	routed := make(map[string][]oci.Signature)
+
+	for _, sig := range sigs {
+		p, err := sig.Payload()
+		if err != nil {
+			continue
+		}
+
+		var cp payload.Cosign
+		if err := json.Unmarshal(p, &cp); err != nil {
+			continue
+		}
+
+		for _, r := range rs {
+			if r.matchesAnnotations(cp.Annotations) {
+				routed[r.Key] = append(routed[r.Key], sig)
+				break
+			}
+		}
+	}
+
+	var keys []string
+
+	seen := make(map[string]bool)
+
+	for _, r := range rs {
+		if _, ok := routed[r.Key]; ok && !seen[r.Key] {
+			seen[r.Key] = true
+			keys = append(keys, r.Key)
+		}
+	}
+
+	return keys, routed
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/cosign/pkg/oci/static"
+)
+
+// testSignature returns a signature whose payload has the optional section.
+func testSignature(t *testing.T, optional string) oci.Signature {
+	t.Helper()
+
+	sig, err := static.NewSignature([]byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"app"},`+
+		`"image":{"docker-manifest-digest":"sha256:%s"},"type":"cosign container image signature"},`+
+		`"optional":%s}`, strings.Repeat("a", 64), optional)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+func TestKeyRoutesSignatures(t *testing.T) {
+	var (
+		teamA    = testSignature(t, `{"team":"a"}`)
+		teamB    = testSignature(t, `{"team":"b"}`)
+		unrouted = testSignature(t, `null`)
+	)
+
+	sigs := []oci.Signature{teamA, teamB, unrouted}
+
+	for _, tc := range []struct {
+		name   string
+		routes KeyRoutes
+		keys   []string
+		routed map[string][]oci.Signature
+	}{
+		{
+			// Team A's signatures are only ever by its key, not the catch-all.
+			name: "overlapping",
+			routes: KeyRoutes{
+				{Repository: "*", Annotations: map[string]string{"team": "a"}, Key: "team-a"},
+				{Repository: "*", Key: "catch-all"},
+			},
+			keys:   []string{"team-a", "catch-all"},
+			routed: map[string][]oci.Signature{"team-a": {teamA}, "catch-all": {teamB, unrouted}},
+		},
+		{
+			name: "shadowed",
+			routes: KeyRoutes{
+				{Repository: "*", Key: "catch-all"},
+				{Repository: "*", Annotations: map[string]string{"team": "a"}, Key: "team-a"},
+			},
+			keys:   []string{"catch-all"},
+			routed: map[string][]oci.Signature{"catch-all": sigs},
+		},
+		{
+			name: "partial",
+			routes: KeyRoutes{
+				{Repository: "*", Annotations: map[string]string{"team": "[ab]"}, Key: "teams"},
+				{Repository: "*", Annotations: map[string]string{"team": "b"}, Key: "team-b"},
+			},
+			keys:   []string{"teams"},
+			routed: map[string][]oci.Signature{"teams": {teamA, teamB}},
+		},
+		{
+			name: "shared key",
+			routes: KeyRoutes{
+				{Repository: "*", Annotations: map[string]string{"team": "a"}, Key: "shared"},
+				{Repository: "*", Annotations: map[string]string{"team": "b"}, Key: "team-b"},
+				{Repository: "*", Key: "shared"},
+			},
+			keys:   []string{"shared", "team-b"},
+			routed: map[string][]oci.Signature{"shared": {teamA, unrouted}, "team-b": {teamB}},
+		},
+	} {
+		keys, routed := tc.routes.signatures(sigs)
+
+		if !reflect.DeepEqual(keys, tc.keys) {
+			t.Errorf("%s: keys %v, want %v", tc.name, keys, tc.keys)
+		}
+
+		if !reflect.DeepEqual(routed, tc.routed) {
+			t.Errorf("%s: routed %v, want %v", tc.name, routed, tc.routed)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Berkeley DB hash database layout, as used by the rpm Packages database of
+// RHEL 8, Amazon Linux 2 and older.
+const (
+	bdbHashMagic = 0x061561
+
+	bdbPageHeaderSize = 26
+
+	bdbPageHashUnsorted = 2
+	bdbPageOverflow     = 7
+	bdbPageHash         = 13
+
+	bdbItemOffPage = 3
+)
+
+// NDB layout, as used by the rpm Packages.db database of SUSE: a header and
+// slots of the packages' blobs, all little-endian.
+const (
+	ndbHeaderMagic = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic   = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic   = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+
+	ndbPageSize   = 4096
+	ndbHeaderSize = 32
+	ndbSlotSize   = 16
+	ndbBlockSize  = 16
+)
+
+// sqliteMagic starts the SQLite rpmdb.sqlite database of RHEL 9, Fedora 33,
+// Amazon Linux 2023 and later.
+const sqliteMagic = "SQLite format 3\x00"
+
+// rpm header tags and types.
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagLicense = 1014
+	rpmTagArch    = 1022
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeI18NString  = 9
+	rpmHeaderEntrySize = 16
+)
+
+var errInvalidRpmdb = errors.New("invalid rpm database")
+
+// rpmdbPackages returns the packages of an rpm database of any of the formats
+// rpm has used, as told by its magic.
+func rpmdbPackages(db []byte) ([]sbomPackage, error) {
+	var (
+		headers [][]byte
+		err     error
+	)
+
+	switch {
+	case bytes.HasPrefix(db, []byte(sqliteMagic)):
+		headers, err = sqliteRpmdbHeaders(db)
+	case len(db) >= ndbHeaderSize && binary.LittleEndian.Uint32(db) == ndbHeaderMagic:
+		headers, err = ndbHeaders(db)
+	case len(db) >= 16 && (binary.LittleEndian.Uint32(db[12:]) == bdbHashMagic ||
+		binary.BigEndian.Uint32(db[12:]) == bdbHashMagic):
+		headers, err = bdbHeaders(db)
+	default:
+		return nil, fmt.Errorf("%w: unrecognised format", errInvalidRpmdb)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := make([]sbomPackage, 0, len(headers))
+
+	for _, blob := range headers {
+		pkg, err := rpmHeaderPackage(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		// Imported GPG keys masquerade as packages.
+		if pkg.Name == "gpg-pubkey" {
+			continue
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
+
+// sqliteRpmdbHeaders returns the package headers of a SQLite rpm database, the
+// blobs of its Packages table.
+func sqliteRpmdbHeaders(db []byte) ([][]byte, error) {
+	rows, err := sqliteTableRows(db, "Packages")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidRpmdb, err)
+	}
+
+	headers := make([][]byte, 0, len(rows))
+
+	for _, row := range rows {
+		// The table is (hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB).
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%w: Packages row of %d columns", errInvalidRpmdb, len(row))
+		}
+
+		blob, ok := row[1].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("%w: Packages row without a blob", errInvalidRpmdb)
+		}
+
+		headers = append(headers, blob)
+	}
+
+	return headers, nil
+}
+
+// ndbHeaders returns the package headers of an NDB rpm database.
+func ndbHeaders(db []byte) ([][]byte, error) {
+	order := binary.LittleEndian
+
+	slotPages := int(order.Uint32(db[12:]))
+	if slotPages <= 0 || slotPages*ndbPageSize > len(db) {
+		return nil, fmt.Errorf("%w: truncated", errInvalidRpmdb)
+	}
+
+	var headers [][]byte
+
+	// The header takes the place of the first slots.
+	for off := ndbHeaderSize; off+ndbSlotSize <= slotPages*ndbPageSize; off += ndbSlotSize {
+		slot := db[off:]
+		if order.Uint32(slot) != ndbSlotMagic {
+			return nil, fmt.Errorf("%w: bad slot at %d", errInvalidRpmdb, off)
+		}
+
+		// Free slots have no package.
+		pkgIdx := order.Uint32(slot[4:])
+		if pkgIdx == 0 {
+			continue
+		}
+
+		blk := int(order.Uint32(slot[8:])) * ndbBlockSize
+		if blk+ndbBlockSize > len(db) {
+			return nil, fmt.Errorf("%w: package %d out of range", errInvalidRpmdb, pkgIdx)
+		}
+
+		blob := db[blk:]
+		if order.Uint32(blob) != ndbBlobMagic || order.Uint32(blob[4:]) != pkgIdx {
+			return nil, fmt.Errorf("%w: bad blob of package %d", errInvalidRpmdb, pkgIdx)
+		}
+
+		length := int(order.Uint32(blob[12:]))
+		if ndbBlockSize+length > len(blob) {
+			return nil, fmt.Errorf("%w: short package header", errInvalidRpmdb)
+		}
+
+		headers = append(headers, blob[ndbBlockSize:ndbBlockSize+length])
+	}
+
+	return headers, nil
+}
+
+// bdbHeaders returns the package headers of a Berkeley DB rpm database.
+//
+// Every package header is stored as an off-page item of a hash page, so rather
+// than follow the hash buckets, the pages are simply walked in order.
+func bdbHeaders(db []byte) ([][]byte, error) {
+	if len(db) < 512 {
+		return nil, errInvalidRpmdb
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(db[12:]) != bdbHashMagic {
+		if order = binary.BigEndian; order.Uint32(db[12:]) != bdbHashMagic {
+			return nil, fmt.Errorf("%w: not a Berkeley DB hash database", errInvalidRpmdb)
+		}
+	}
+
+	pageSize := int(order.Uint32(db[20:]))
+	lastPage := int(order.Uint32(db[32:]))
+
+	if pageSize < 512 || pageSize > len(db) || lastPage >= len(db)/pageSize {
+		return nil, fmt.Errorf("%w: truncated", errInvalidRpmdb)
+	}
+
+	page := func(n int) []byte { return db[n*pageSize : (n+1)*pageSize] }
+
+	var headers [][]byte
+
+	for n := 1; n <= lastPage; n++ {
+		p := page(n)
+		if p[25] != bdbPageHash && p[25] != bdbPageHashUnsorted {
+			continue
+		}
+
+		entries := int(order.Uint16(p[20:]))
+
+		// Entries alternate between keys and values; only values are of
+		// interest.
+		for i := 1; i < entries; i += 2 {
+			if bdbPageHeaderSize+2*i+2 > pageSize {
+				break
+			}
+
+			off := int(order.Uint16(p[bdbPageHeaderSize+2*i:]))
+			if off+12 > pageSize || p[off] != bdbItemOffPage {
+				continue
+			}
+
+			// The value is stored across a chain of overflow pages.
+			next, length := int(order.Uint32(p[off+4:])), int(order.Uint32(p[off+8:]))
+			if length > len(db) {
+				return nil, fmt.Errorf("%w: package header of %d bytes out of range", errInvalidRpmdb, length)
+			}
+
+			blob := make([]byte, 0, length)
+
+			for hops := 0; next != 0 && hops <= lastPage; hops++ {
+				if next > lastPage {
+					return nil, fmt.Errorf("%w: overflow page %d out of range", errInvalidRpmdb, next)
+				}
+
+				op := page(next)
+				if op[25] != bdbPageOverflow {
+					return nil, fmt.Errorf("%w: page %d is not an overflow page", errInvalidRpmdb, next)
+				}
+
+				used := int(order.Uint16(op[22:]))
+				if bdbPageHeaderSize+used > pageSize {
+					return nil, fmt.Errorf("%w: overflow page %d overruns", errInvalidRpmdb, next)
+				}
+
+				blob = append(blob, op[bdbPageHeaderSize:bdbPageHeaderSize+used]...)
+				next = int(order.Uint32(op[16:]))
+			}
+
+			if len(blob) != length {
+				return nil, fmt.Errorf("%w: short package header", errInvalidRpmdb)
+			}
+
+			headers = append(headers, blob)
+		}
+	}
+
+	return headers, nil
+}
+
+// rpmHeaderPackage returns the package of an rpm header blob, i.e. a header
+// as stored in rpm databases (without the leading magic of package files).
+func rpmHeaderPackage(blob []byte) (sbomPackage, error) {
+	if len(blob) < 8 {
+		return sbomPackage{}, fmt.Errorf("%w: short package header", errInvalidRpmdb)
+	}
+
+	entries := int(binary.BigEndian.Uint32(blob[0:]))
+	dataLen := int(binary.BigEndian.Uint32(blob[4:]))
+
+	index := blob[8:]
+	if entries*rpmHeaderEntrySize+dataLen > len(index) {
+		return sbomPackage{}, fmt.Errorf("%w: short package header", errInvalidRpmdb)
+	}
+
+	data := index[entries*rpmHeaderEntrySize : entries*rpmHeaderEntrySize+dataLen]
+
+	pkg := sbomPackage{Type: "rpm"}
+
+	var version, release string
+
+	for i := 0; i < entries; i++ {
+		e := index[i*rpmHeaderEntrySize:]
+
+		tag := int32(binary.BigEndian.Uint32(e[0:]))
+		typ := binary.BigEndian.Uint32(e[4:])
+		off := int(int32(binary.BigEndian.Uint32(e[8:])))
+
+		if off < 0 || off >= len(data) {
+			continue
+		}
+
+		var s string
+		{
+			switch typ {
+			case rpmTypeString, rpmTypeI18NString:
+				s = string(data[off:])
+				if end := bytes.IndexByte(data[off:], 0); end >= 0 {
+					s = string(data[off : off+end])
+				}
+			case rpmTypeInt32:
+				if off+4 <= len(data) {
+					s = strconv.Itoa(int(int32(binary.BigEndian.Uint32(data[off:]))))
+				}
+			default:
+				continue
+			}
+		}
+
+		switch tag {
+		case rpmTagName:
+			pkg.Name = s
+		case rpmTagVersion:
+			version = s
+		case rpmTagRelease:
+			release = s
+		case rpmTagEpoch:
+			pkg.Epoch = s
+		case rpmTagLicense:
+			pkg.License = s
+		case rpmTagArch:
+			pkg.Arch = s
+		}
+	}
+
+	if pkg.Name == "" {
+		return pkg, fmt.Errorf("%w: package header without a name", errInvalidRpmdb)
+	}
+
+	pkg.Version = version
+	if release != "" {
+		pkg.Version += "-" + release
+	}
+
+	return pkg, nil
+}
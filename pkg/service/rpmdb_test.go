@@ -0,0 +1,376 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRpmTag is a tag of an rpm header: a string, or an int32 given an int.
+type testRpmTag struct {
+	tag   int32
+	value interface{}
+}
+
+// testRpmHeader returns an rpm header blob of the tags, as rpm databases store
+// them.
+func testRpmHeader(tags ...testRpmTag) []byte {
+	var index, data bytes.Buffer
+
+	for _, t := range tags {
+		typ := uint32(rpmTypeString)
+
+		if v, ok := t.value.(int); ok {
+			typ = rpmTypeInt32
+			for data.Len()%4 != 0 {
+				data.WriteByte(0)
+			}
+
+			binary.Write(&index, binary.BigEndian, []uint32{uint32(t.tag), typ, uint32(data.Len()), 1})
+			binary.Write(&data, binary.BigEndian, int32(v))
+
+			continue
+		}
+
+		binary.Write(&index, binary.BigEndian, []uint32{uint32(t.tag), typ, uint32(data.Len()), 1})
+		data.WriteString(t.value.(string))
+		data.WriteByte(0)
+	}
+
+	var b bytes.Buffer
+
+	binary.Write(&b, binary.BigEndian, []uint32{uint32(len(tags)), uint32(data.Len())})
+	b.Write(index.Bytes())
+	b.Write(data.Bytes())
+
+	return b.Bytes()
+}
+
+// testRpmPackage returns the i'th package of the test databases, and its
+// header. Every tenth has an epoch, and the seventh a license long enough to
+// overflow the pages of the databases.
+func testRpmPackage(i int) (sbomPackage, []byte) {
+	pkg := sbomPackage{
+		Type:    "rpm",
+		Name:    fmt.Sprintf("pkg-%03d", i),
+		Version: fmt.Sprintf("1.%d-1.el9", i),
+		Arch:    "x86_64",
+		License: "MIT",
+	}
+
+	if i == 7 {
+		pkg.License = strings.Repeat("MIT ", 800)
+	}
+
+	tags := []testRpmTag{
+		{rpmTagName, pkg.Name},
+		{rpmTagVersion, fmt.Sprintf("1.%d", i)},
+		{rpmTagRelease, "1.el9"},
+		{rpmTagArch, pkg.Arch},
+		{rpmTagLicense, pkg.License},
+	}
+
+	if i%10 == 0 {
+		pkg.Epoch = "1"
+		tags = append(tags, testRpmTag{rpmTagEpoch, 1})
+	}
+
+	return pkg, testRpmHeader(tags...)
+}
+
+// testRpmPackages returns n packages and their headers, followed by the header
+// of an imported GPG key.
+func testRpmPackages(n int) ([]sbomPackage, [][]byte) {
+	var (
+		pkgs    []sbomPackage
+		headers [][]byte
+	)
+
+	for i := 0; i < n; i++ {
+		pkg, header := testRpmPackage(i)
+		pkgs = append(pkgs, pkg)
+		headers = append(headers, header)
+	}
+
+	headers = append(headers, testRpmHeader(
+		testRpmTag{rpmTagName, "gpg-pubkey"},
+		testRpmTag{rpmTagVersion, "fd431d51"},
+		testRpmTag{rpmTagRelease, "4ae0493b"},
+	))
+
+	return pkgs, headers
+}
+
+// testNDB returns an NDB rpm database of the headers.
+func testNDB(headers [][]byte) []byte {
+	order := binary.LittleEndian
+
+	db := make([]byte, ndbPageSize)
+	order.PutUint32(db, ndbHeaderMagic)
+	order.PutUint32(db[12:], 1)
+
+	// A free slot (as left by an erased package) precedes the packages'.
+	slot := func(i int) []byte { return db[ndbHeaderSize+i*ndbSlotSize:] }
+	for i := 0; ndbHeaderSize+(i+1)*ndbSlotSize <= ndbPageSize; i++ {
+		order.PutUint32(slot(i), ndbSlotMagic)
+	}
+
+	for i, header := range headers {
+		blob := make([]byte, ndbBlockSize+len(header))
+		order.PutUint32(blob, ndbBlobMagic)
+		order.PutUint32(blob[4:], uint32(i+1))
+		order.PutUint32(blob[12:], uint32(len(header)))
+		copy(blob[ndbBlockSize:], header)
+
+		for len(blob)%ndbBlockSize != 0 {
+			blob = append(blob, 0)
+		}
+
+		s := slot(i + 1)
+		order.PutUint32(s[4:], uint32(i+1))
+		order.PutUint32(s[8:], uint32(len(db)/ndbBlockSize))
+		order.PutUint32(s[12:], uint32(len(blob)/ndbBlockSize))
+
+		db = append(db, blob...)
+	}
+
+	return db
+}
+
+// testBDB returns a Berkeley DB hash rpm database of the headers, each stored
+// (as rpm does) on a chain of overflow pages.
+func testBDB(order binary.ByteOrder, pageSize int, headers [][]byte) []byte {
+	var pages [][]byte
+
+	newPage := func(typ byte) []byte {
+		p := make([]byte, pageSize)
+		order.PutUint32(p[8:], uint32(len(pages)))
+		p[25] = typ
+		pages = append(pages, p)
+
+		return p
+	}
+
+	meta := newPage(8)
+	order.PutUint32(meta[12:], bdbHashMagic)
+	order.PutUint32(meta[20:], uint32(pageSize))
+
+	// Each hash page holds a few key/value pairs, whose values are off-page.
+	const pairsPerPage = 4
+
+	for i := 0; i < len(headers); i += pairsPerPage {
+		hp := newPage(bdbPageHash)
+		end := pageSize
+
+		var entries int
+
+		for _, header := range headers[i:min(i+pairsPerPage, len(headers))] {
+			// The key: the package's number.
+			end -= 5
+			hp[end] = 1
+			order.PutUint32(hp[end+1:], uint32(entries/2+1))
+			order.PutUint16(hp[bdbPageHeaderSize+2*entries:], uint16(end))
+			entries++
+
+			end -= 12
+			hp[end] = bdbItemOffPage
+			order.PutUint32(hp[end+8:], uint32(len(header)))
+			order.PutUint16(hp[bdbPageHeaderSize+2*entries:], uint16(end))
+			entries++
+
+			item := end
+			prev := -1
+
+			for rest := header; len(rest) > 0; {
+				op := newPage(bdbPageOverflow)
+				n := copy(op[bdbPageHeaderSize:], rest)
+				order.PutUint16(op[22:], uint16(n))
+				rest = rest[n:]
+
+				if prev < 0 {
+					order.PutUint32(hp[item+4:], uint32(len(pages)-1))
+				} else {
+					order.PutUint32(pages[prev][16:], uint32(len(pages)-1))
+				}
+
+				prev = len(pages) - 1
+			}
+		}
+
+		order.PutUint16(hp[20:], uint16(entries))
+	}
+
+	order.PutUint32(meta[32:], uint32(len(pages)-1))
+
+	return bytes.Join(pages, nil)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func TestRpmdbPackages(t *testing.T) {
+	pkgs, headers := testRpmPackages(20)
+
+	sqlite, err := ioutil.ReadFile("testdata/rpmdb.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlitePkgs, _ := testRpmPackages(200)
+
+	for _, tc := range []struct {
+		name string
+		db   []byte
+		want []sbomPackage
+	}{
+		{"bdb little-endian", testBDB(binary.LittleEndian, 512, headers), pkgs},
+		{"bdb big-endian", testBDB(binary.BigEndian, 4096, headers), pkgs},
+		{"ndb", testNDB(headers), pkgs},
+		{"sqlite", sqlite, sqlitePkgs},
+	} {
+		got, err := rpmdbPackages(tc.db)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %d packages, want %d: %+v", tc.name, len(got), len(tc.want), got)
+		}
+	}
+}
+
+func TestRpmdbPackagesMalformed(t *testing.T) {
+	_, headers := testRpmPackages(20)
+
+	sqlite, err := ioutil.ReadFile("testdata/rpmdb.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := map[string][]byte{
+		"bdb":    testBDB(binary.LittleEndian, 512, headers),
+		"ndb":    testNDB(headers),
+		"sqlite": sqlite,
+	}
+
+	if _, err := rpmdbPackages([]byte("not an rpm database")); !errors.Is(err, errInvalidRpmdb) {
+		t.Errorf("garbage: error %v, want %v", err, errInvalidRpmdb)
+	}
+
+	for name, db := range dbs {
+		// Truncated within its magic, its first page and its packages.
+		for _, n := range []int{4, 100, 600, len(db) / 2, len(db) - 20} {
+			if _, err := rpmdbPackages(db[:n]); !errors.Is(err, errInvalidRpmdb) {
+				t.Errorf("%s truncated to %d bytes: error %v, want %v", name, n, err, errInvalidRpmdb)
+			}
+		}
+
+		// Corruption anywhere must be an error, or go unnoticed, but never
+		// panic.
+		rng := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 2000; i++ {
+			corrupt := append([]byte{}, db...)
+			for j := 0; j < 1+rng.Intn(8); j++ {
+				corrupt[rng.Intn(len(corrupt))] = byte(rng.Intn(256))
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s corrupted (%d): panic: %v", name, i, r)
+					}
+				}()
+
+				rpmdbPackages(corrupt)
+			}()
+		}
+	}
+}
+
+func TestBDBHeadersOutOfRange(t *testing.T) {
+	_, headers := testRpmPackages(1)
+	db := testBDB(binary.LittleEndian, 512, headers)
+
+	for name, corrupt := range map[string]func(db []byte){
+		// Whose product with the page size overflows.
+		"last page": func(db []byte) { binary.LittleEndian.PutUint32(db[32:], 0xffffffff) },
+		"page size": func(db []byte) { binary.LittleEndian.PutUint32(db[20:], 0xffffffff) },
+		"length": func(db []byte) {
+			hp := db[512:]
+			off := binary.LittleEndian.Uint16(hp[bdbPageHeaderSize+2:])
+			binary.LittleEndian.PutUint32(hp[off+8:], 0xffffffff)
+		},
+	} {
+		b := append([]byte{}, db...)
+		corrupt(b)
+
+		if _, err := bdbHeaders(b); !errors.Is(err, errInvalidRpmdb) {
+			t.Errorf("%s: error %v, want %v", name, err, errInvalidRpmdb)
+		}
+	}
+}
+
+func TestRpmHeaderPackage(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   sbomPackage
+		err    error
+	}{
+		{
+			name: "without a release",
+			header: testRpmHeader(
+				testRpmTag{rpmTagName, "bash"},
+				testRpmTag{rpmTagVersion, "5.1"},
+				testRpmTag{rpmTagEpoch, 2},
+			),
+			want: sbomPackage{Type: "rpm", Name: "bash", Version: "5.1", Epoch: "2"},
+		},
+		{
+			name:   "without a name",
+			header: testRpmHeader(testRpmTag{rpmTagVersion, "5.1"}),
+			err:    errInvalidRpmdb,
+		},
+		{
+			name:   "short",
+			header: []byte{0, 0, 0},
+			err:    errInvalidRpmdb,
+		},
+		{
+			name:   "entries overrunning",
+			header: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			err:    errInvalidRpmdb,
+		},
+	} {
+		got, err := rpmHeaderPackage(tc.header)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+
+		if err == nil && got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	// An entry's data offset out of range is ignored.
+	header := testRpmHeader(testRpmTag{rpmTagName, "bash"}, testRpmTag{rpmTagLicense, "GPLv3+"})
+	binary.BigEndian.PutUint32(header[8+rpmHeaderEntrySize+8:], 0x7fffffff)
+
+	if got, err := rpmHeaderPackage(header); err != nil || got.License != "" {
+		t.Errorf("license out of range: got %+v, %v", got, err)
+	}
+}
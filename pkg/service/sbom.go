@@ -0,0 +1,496 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/in-toto/in-toto-golang/in_toto"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// SBOMFormat selects the format of the software bills of materials generated
+// during Copy.
+type SBOMFormat string
+
+const (
+	// SBOMNone generates no SBOMs.
+	SBOMNone SBOMFormat = ""
+	// SBOMSPDX generates SPDX 2.2 JSON documents.
+	SBOMSPDX SBOMFormat = "spdx"
+	// SBOMCycloneDX generates CycloneDX 1.4 JSON documents.
+	SBOMCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// SBOMPredicateCycloneDX is the in-toto predicate type of CycloneDX SBOMs.
+const SBOMPredicateCycloneDX = "https://cyclonedx.org/bom"
+
+var ErrInvalidSBOMFormat = errors.New("invalid SBOM format")
+
+func (f SBOMFormat) validate() error {
+	switch f {
+	case SBOMNone, SBOMSPDX, SBOMCycloneDX:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidSBOMFormat, f)
+}
+
+// SBOM is the software bill of materials of a promoted image.
+type SBOM struct {
+	// Digest is that of the promoted image. For indexes, there is an SBOM for
+	// each of the images within.
+	Digest        v1.Hash
+	PredicateType string
+	Document      interface{}
+}
+
+// imageScan catalogues the packages of an image (and/or inspects it) from its
+// layers as they stream through Copy.
+type imageScan struct {
+	layers []*scannedLayer
+	// image is the (mutated) image written to the destination.
+	image v1.Image
+}
+
+// scanImage rewrites img with its filesystem layers catalogued (and/or
+// inspected, if there is an inspection) whenever they are read. Nothing else
+// about the image changes.
+func scanImage(img v1.Image, packages bool, inspection *layerInspection) (v1.Image, *imageScan, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting layers: %w", err)
+	}
+
+	scan := &imageScan{}
+	opts := layerScanOpts{packages: packages, inspect: inspection != nil}
+
+	for i, l := range layers {
+		c, ok := layerCompressions[m.Layers[i].MediaType]
+		if !ok {
+			continue
+		}
+
+		sl := &scannedLayer{Layer: l, compression: c, opts: opts, inspection: inspection}
+		scan.layers = append(scan.layers, sl)
+
+		// Retain the ability to cross-repository mount blobs on write.
+		if ml, ok := l.(*remote.MountableLayer); ok {
+			sl.Layer = ml.Layer
+			layers[i] = &remote.MountableLayer{Layer: sl, Reference: ml.Reference}
+
+			continue
+		}
+
+		layers[i] = sl
+	}
+
+	return &scanningImage{Image: img, layers: layers}, scan, nil
+}
+
+// packages returns the packages of the image, reading any layers that were not
+// streamed through in full (e.g. those mounted from another repository, or
+// already present in the destination).
+func (s *imageScan) packages() ([]sbomPackage, map[string]string, error) {
+	contents := make([]*layerContents, len(s.layers))
+
+	for i, l := range s.layers {
+		var err error
+		if contents[i], err = l.scanned(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pkgs, release := mergeLayerContents(contents)
+
+	return pkgs, release, nil
+}
+
+// sbom returns the SBOM of the scanned image within the repository.
+func (s *imageScan) sbom(repo name.Repository, f SBOMFormat) (*SBOM, error) {
+	d, err := s.image.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("getting digest: %w", err)
+	}
+
+	pkgs, release, err := s.packages()
+	if err != nil {
+		return nil, fmt.Errorf("cataloguing packages: %w", err)
+	}
+
+	image := repo.Digest(d.String()).Name()
+
+	serial, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	switch f {
+	case SBOMSPDX:
+		return &SBOM{d, in_toto.PredicateSPDX, spdxSBOM(image, serial, created, pkgs, release)}, nil
+	case SBOMCycloneDX:
+		return &SBOM{d, SBOMPredicateCycloneDX, cycloneDXSBOM(image, serial, created, pkgs, release)}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrInvalidSBOMFormat, f)
+}
+
+// recordSBOMs records the SBOMs of the images scanned during the copy in the
+// promotion record, if there is one.
+func (o *copyOpts) recordSBOMs(repo name.Repository) error {
+	if o.promotion == nil || o.sbom == SBOMNone {
+		return nil
+	}
+
+	for _, scan := range o.scans {
+		sbom, err := scan.sbom(repo, o.sbom)
+		if err != nil {
+			return fmt.Errorf("generating SBOM: %w", err)
+		}
+
+		o.promotion.SBOMs = append(o.promotion.SBOMs, *sbom)
+	}
+
+	return nil
+}
+
+// scanningImage is a v1.Image whose layers are swapped for scanned ones.
+type scanningImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (i *scanningImage) Layers() ([]v1.Layer, error) { return i.layers, nil }
+
+func (i *scanningImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+
+	return i.Image.LayerByDigest(h)
+}
+
+func (i *scanningImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.DiffID(); err == nil && d == h {
+			return l, nil
+		}
+	}
+
+	return i.Image.LayerByDiffID(h)
+}
+
+// scannedLayer is a v1.Layer whose contents are catalogued, on the side, the
+// first time they are read in full.
+type scannedLayer struct {
+	v1.Layer
+	compression LayerCompression
+	opts        layerScanOpts
+	inspection  *layerInspection
+
+	mu       sync.Mutex
+	contents *layerContents
+	err      error
+}
+
+func (l *scannedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.tee(rc, l.compression), nil
+}
+
+func (l *scannedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.tee(rc, CompressionNone), nil
+}
+
+// tee returns rc with everything read from it catalogued in the background.
+func (l *scannedLayer) tee(rc io.ReadCloser, c LayerCompression) io.ReadCloser {
+	if l.done() {
+		return rc
+	}
+
+	pr, pw := io.Pipe()
+	t := &teeReadCloser{rc: rc, pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(t.done)
+
+		contents, err := catalogLayer(ioutil.NopCloser(pr), c, l.opts)
+
+		// Whatever is left must still be drained for the reader's sake.
+		io.Copy(ioutil.Discard, pr)
+
+		if t.eof {
+			l.record(contents, err)
+		}
+	}()
+
+	return t
+}
+
+func (l *scannedLayer) done() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.contents != nil || l.err != nil
+}
+
+func (l *scannedLayer) record(contents *layerContents, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.contents == nil && l.err == nil {
+		l.contents, l.err = contents, err
+	}
+}
+
+// scanned returns the catalogued contents of the layer, reading it if it has
+// not been already.
+func (l *scannedLayer) scanned() (*layerContents, error) {
+	if !l.done() {
+		rc, err := l.Layer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		l.record(catalogLayer(rc, CompressionNone, l.opts))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.contents, l.err
+}
+
+// teeReadCloser copies everything read from rc to pw, noting whether rc was
+// read in full.
+type teeReadCloser struct {
+	rc   io.ReadCloser
+	pw   *io.PipeWriter
+	eof  bool
+	done chan struct{}
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		// The catalogue drains whatever it has no use for, so this only
+		// fails once the pipe has been closed.
+		t.pw.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		t.eof = true
+	}
+
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	if t.eof {
+		t.pw.Close()
+	} else {
+		t.pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+
+	<-t.done
+
+	return t.rc.Close()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// spdxDocument is an SPDX 2.2 document, as far as packages go.
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages []spdxPackage `json:"packages"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+const spdxNoAssertion = "NOASSERTION"
+
+func spdxSBOM(image, serial, created string, pkgs []sbomPackage, release map[string]string) *spdxDocument {
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              image,
+		DocumentNamespace: ProvenanceBuilderID + "/spdx/" + serial,
+		Packages:          make([]spdxPackage, len(pkgs)),
+	}
+
+	doc.CreationInfo.Created = created
+	doc.CreationInfo.Creators = []string{"Tool: ocistow"}
+
+	for i, p := range pkgs {
+		// Package managers' licenses are seldom SPDX license expressions.
+		var comment string
+		if p.License != "" {
+			comment = "License: " + p.License
+		}
+
+		doc.Packages[i] = spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i),
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+			Comment:          comment,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.purl(release),
+			}},
+		}
+	}
+
+	return doc
+}
+
+// cycloneDXDocument is a CycloneDX 1.4 BOM, as far as components go.
+type cycloneDXDocument struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string             `json:"timestamp"`
+		Tools     []cycloneDXTool    `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	} `json:"metadata"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	BOMRef   string             `json:"bom-ref,omitempty"`
+	Type     string             `json:"type"`
+	Name     string             `json:"name"`
+	Version  string             `json:"version,omitempty"`
+	PURL     string             `json:"purl,omitempty"`
+	Licenses []cycloneDXLicense `json:"licenses,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+func cycloneDXSBOM(image, serial, created string, pkgs []sbomPackage, release map[string]string) *cycloneDXDocument {
+	doc := &cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Components:   make([]cycloneDXComponent, len(pkgs)),
+	}
+
+	doc.Metadata.Timestamp = created
+	doc.Metadata.Tools = []cycloneDXTool{{Vendor: "martinbaillie", Name: "ocistow"}}
+	doc.Metadata.Component = cycloneDXComponent{Type: "container", Name: image}
+
+	for i, p := range pkgs {
+		purl := p.purl(release)
+
+		doc.Components[i] = cycloneDXComponent{
+			BOMRef:  purl,
+			Type:    "library",
+			Name:    p.Name,
+			Version: p.Version,
+			PURL:    purl,
+		}
+
+		if p.License != "" {
+			var l cycloneDXLicense
+			l.License.Name = p.License
+			doc.Components[i].Licenses = []cycloneDXLicense{l}
+		}
+	}
+
+	return doc
+}
+
+// sortPackages orders packages by their type, name and version.
+func sortPackages(pkgs []sbomPackage) {
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Type != pkgs[j].Type {
+			return pkgs[i].Type < pkgs[j].Type
+		}
+
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+
+		return pkgs[i].Version < pkgs[j].Version
+	})
+}
@@ -1,19 +1,20 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
 	"github.com/sigstore/cosign/pkg/oci"
-	"github.com/sigstore/cosign/pkg/oci/static"
 	"github.com/sigstore/cosign/pkg/oci/walk"
+	"github.com/sigstore/sigstore/pkg/signature"
 	"github.com/sigstore/sigstore/pkg/signature/payload"
 
 	"github.com/martinbaillie/ocistow/pkg/backend"
@@ -22,7 +23,6 @@ import (
 	cosremote "github.com/sigstore/cosign/pkg/cosign/remote"
 	ocimutate "github.com/sigstore/cosign/pkg/oci/mutate"
 	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
-	sigopts "github.com/sigstore/sigstore/pkg/signature/options"
 )
 
 var (
@@ -42,8 +42,20 @@ func parseOCIReference(ref string) (name.Reference, error) {
 }
 
 type Service interface {
-	Copy(ctx context.Context, src, dst string, annotations map[string]string) error
-	Sign(ctx context.Context, dst string, annotations map[string]string) error
+	Copy(ctx context.Context, src, dst string, annotations map[string]string, opts ...CopyOption) error
+	Sign(ctx context.Context, dst string, annotations map[string]string, opts ...SignOption) error
+	Verify(ctx context.Context, dst string, opts ...SignOption) error
+	Attest(ctx context.Context, dst, predicateType string, predicate interface{}, opts ...SignOption) error
+	AttestScan(ctx context.Context, dst string, opts ...SignOption) error
+	Resign(
+		ctx context.Context, repos []string, oldKeyRef, newKeyRef string, signOpts []SignOption, opts ...ResignOption,
+	) error
+	Unsign(
+		ctx context.Context, dst, keyRef string, signOpts []SignOption, opts ...UnsignOption,
+	) ([]RemovedSignature, error)
+	Refresh(
+		ctx context.Context, repos []string, keyRef string, within time.Duration, signOpts []SignOption, opts ...ResignOption,
+	) error
 }
 
 type service struct {
@@ -54,7 +66,37 @@ func NewService(b backend.Backend) Service {
 	return &service{b}
 }
 
-func (s *service) Copy(ctx context.Context, src, dst string, annotations map[string]string) error {
+func (s *service) Copy(
+	ctx context.Context, src, dst string, annotations map[string]string, opts ...CopyOption,
+) error {
+	started := time.Now()
+
+	o := makeCopyOpts(opts...)
+
+	if err := o.conversion.validate(); err != nil {
+		return err
+	}
+
+	if err := o.compression.validate(); err != nil {
+		return err
+	}
+
+	if err := o.sbom.validate(); err != nil {
+		return err
+	}
+
+	if err := o.inspection.mode.validate(); err != nil {
+		return err
+	}
+
+	if err := o.validateEstargz(); err != nil {
+		return err
+	}
+
+	if err := o.validateLayerEncryption(); err != nil {
+		return err
+	}
+
 	srcRef, err := parseOCIReference(src)
 	if err != nil {
 		return fmt.Errorf("parsing source reference %q: %w", src, err)
@@ -70,15 +112,120 @@ func (s *service) Copy(ctx context.Context, src, dst string, annotations map[str
 		return fmt.Errorf("fetching %q: %w", src, err)
 	}
 
-	// TODO: Handle multi-arch.
+	// Policy is enforced on the source, as is, before anything is written.
+	if err = enforcePolicy(o.policy, srcRef, srcDesc, dstRef, annotations); err != nil {
+		return err
+	}
+
+	if !srcDesc.MediaType.IsIndex() {
+		image, err := isImage(srcDesc.MediaType, srcDesc.Manifest)
+		if err != nil {
+			return fmt.Errorf("inspecting %q: %w", src, err)
+		}
+
+		// Other OCI artifacts are copied verbatim, their annotations aside,
+		// whatever the options.
+		if !image {
+			if err := s.writeArtifact(ctx, srcRef, srcDesc, dstRef, annotations); err != nil {
+				return err
+			}
+
+			return s.recordPromotion(ctx, o.promotion, srcRef, srcDesc, dstRef, annotations, nil, started)
+		}
+	}
+
+	if err = s.write(ctx, srcDesc, dstRef, annotations, o); err != nil {
+		return err
+	}
+
+	if o.soci {
+		if err = s.writeSOCIIndexes(ctx, dstRef, o.sociMinLayerSize); err != nil {
+			return fmt.Errorf("generating SOCI indexes: %w", err)
+		}
+	}
+
+	if err = s.recordPromotion(
+		ctx, o.promotion, srcRef, srcDesc, dstRef, annotations, o.mutations(), started,
+	); err != nil {
+		return err
+	}
+
+	if err = o.recordSBOMs(dstRef.Context()); err != nil {
+		return err
+	}
+
+	return o.recordInspections()
+}
+
+// write mutates the source image (or index) and writes it to the destination.
+func (s *service) write(
+	ctx context.Context,
+	srcDesc *remote.Descriptor,
+	dstRef name.Reference,
+	annotations map[string]string,
+	o *copyOpts,
+) error {
+	if srcDesc.MediaType.IsIndex() {
+		srcIdx, err := srcDesc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("pulling index: %w", err)
+		}
+
+		if srcIdx, err = s.mutateIndex(ctx, dstRef.Context(), srcIdx, annotations, o); err != nil {
+			return err
+		}
+
+		if err = remote.WriteIndex(dstRef, srcIdx, s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("writing destination index %q: %w", dstRef.Name(), err)
+		}
+
+		return nil
+	}
+
 	srcImg, err := srcDesc.Image()
 	if err != nil {
-		return fmt.Errorf("pulling linux/amd64 manifest: %w", err)
+		return fmt.Errorf("pulling image: %w", err)
+	}
+
+	if srcImg, err = mutateImage(srcImg, annotations, o); err != nil {
+		return err
+	}
+
+	if srcImg, err = s.writeInspected(ctx, dstRef.Context(), srcImg, o); err != nil {
+		return err
+	}
+
+	if err = remote.Write(dstRef, srcImg, s.backend.RemoteOpts(ctx)...); err != nil {
+		return fmt.Errorf("writing destination image %q: %w", dstRef.Name(), err)
 	}
 
-	cfg, err := srcImg.ConfigFile()
+	return nil
+}
+
+func mutateImage(img v1.Image, annotations map[string]string, o *copyOpts) (v1.Image, error) {
+	// Decryption happens first so that everything else acts on plain layers.
+	img, err := decryptImage(img, o.encryption.decrypt)
 	if err != nil {
-		return fmt.Errorf("getting config: %w", err)
+		return nil, fmt.Errorf("decrypting layers: %w", err)
+	}
+
+	// Packages are catalogued (and layers inspected) from the plain layers as
+	// they stream through.
+	var scan *imageScan
+	if o.sbom != SBOMNone || o.inspection.mode != InspectNone {
+		var inspection *layerInspection
+		if o.inspection.mode != InspectNone {
+			inspection = &o.inspection
+		}
+
+		if img, scan, err = scanImage(img, o.sbom != SBOMNone, inspection); err != nil {
+			return nil, fmt.Errorf("scanning layers: %w", err)
+		}
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("getting config: %w", err)
 	}
 
 	// Copy the existing config, merging the annotations with any existing
@@ -93,41 +240,259 @@ func (s *service) Copy(ctx context.Context, src, dst string, annotations map[str
 		cfg.Config.Labels[k] = v
 	}
 
-	srcImg, err = mutate.Config(srcImg, cfg.Config)
+	img, err = mutate.Config(img, cfg.Config)
 	if err != nil {
-		return fmt.Errorf("mutating config: %w", err)
+		return nil, fmt.Errorf("mutating config: %w", err)
 	}
 
-	srcImg = mutate.Annotations(srcImg, annotations).(v1.Image)
+	img = mutate.Annotations(img, annotations).(v1.Image)
 
-	if err = remote.Write(dstRef, srcImg, s.backend.RemoteOpts(ctx)...); err != nil {
-		return fmt.Errorf("writing destination image %q: %w", dstRef.Name(), err)
+	// Conversion, recompression and encryption happen last so that the digest
+	// written (and subsequently signed) is that of the final image.
+	if img, err = convertImage(img, o.conversion); err != nil {
+		return nil, fmt.Errorf("converting media types: %w", err)
 	}
 
-	return nil
+	if o.estargz {
+		if img, err = estargzImage(img, o.estargzPrioritizedFiles); err != nil {
+			return nil, fmt.Errorf("converting layers to eStargz: %w", err)
+		}
+	} else if img, err = recompressImage(img, o.compression); err != nil {
+		return nil, fmt.Errorf("recompressing layers: %w", err)
+	}
+
+	if img, err = encryptImage(img, &o.encryption); err != nil {
+		return nil, fmt.Errorf("encrypting layers: %w", err)
+	}
+
+	if scan != nil {
+		scan.image = img
+		o.scans = append(o.scans, scan)
+	}
+
+	return img, nil
 }
 
-func (s *service) Sign(ctx context.Context, dst string, annotations map[string]string) error {
+// BuildKit attaches the attestations (e.g. SBOMs and provenance) of an index's
+// images as further image manifests of the index, which it annotates with the
+// digest of the image they are about.
+const (
+	dockerReferenceTypeAnnotation   = "vnd.docker.reference.type"
+	dockerReferenceDigestAnnotation = "vnd.docker.reference.digest"
+	dockerAttestationManifest       = "attestation-manifest"
+)
+
+// mutateIndex rebuilds idx with each of its child manifests mutated in the same
+// manner as a single image.
+//
+// The Go container registry index writer needs to know the digest of every
+// child manifest up front, so any streamed layers of child images (e.g. those
+// being recompressed) are written to the destination repository as they are
+// encountered, after which their digests are known.
+//
+// BuildKit attestation manifests are not images to mutate (nor could their
+// in-toto layers be converted), so are copied unchanged, only referring to the
+// mutated digest of the image they are about.
+func (s *service) mutateIndex(
+	ctx context.Context,
+	dst name.Repository,
+	idx v1.ImageIndex,
+	annotations map[string]string,
+	o *copyOpts,
+) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting index manifest: %w", err)
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("getting index media type: %w", err)
+	}
+
+	if mt, err = o.conversion.mediaType(mt); err != nil {
+		return nil, fmt.Errorf("converting media types: %w", err)
+	}
+
+	adds := make([]mutate.IndexAddendum, len(im.Manifests))
+
+	// The digests of the mutated child manifests, by those of the originals.
+	digests := make(map[v1.Hash]v1.Hash, len(im.Manifests))
+
+	for i, desc := range im.Manifests {
+		if desc.Annotations[dockerReferenceTypeAnnotation] == dockerAttestationManifest {
+			continue
+		}
+
+		var add mutate.Appendable
+		{
+			switch {
+			case desc.MediaType.IsIndex():
+				child, err := idx.ImageIndex(desc.Digest)
+				if err != nil {
+					return nil, fmt.Errorf("pulling index %q: %w", desc.Digest, err)
+				}
+
+				if add, err = s.mutateIndex(ctx, dst, child, annotations, o); err != nil {
+					return nil, err
+				}
+			case desc.MediaType.IsImage():
+				child, err := idx.Image(desc.Digest)
+				if err != nil {
+					return nil, fmt.Errorf("pulling image %q: %w", desc.Digest, err)
+				}
+
+				mutated, err := mutateImage(child, annotations, o)
+				if err != nil {
+					return nil, err
+				}
+
+				if mutated, err = s.writeInspected(ctx, dst, mutated, o); err != nil {
+					return nil, err
+				}
+
+				if err = s.writeStreamedLayers(ctx, dst, mutated); err != nil {
+					return nil, err
+				}
+
+				add = mutated
+			default:
+				return nil, fmt.Errorf("unsupported manifest %q media type %q", desc.Digest, desc.MediaType)
+			}
+		}
+
+		d, err := add.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("getting digest of mutated manifest %q: %w", desc.Digest, err)
+		}
+
+		digests[desc.Digest] = d
+
+		adds[i] = mutate.IndexAddendum{
+			Add: add,
+			Descriptor: v1.Descriptor{
+				URLs:        desc.URLs,
+				Annotations: desc.Annotations,
+				Platform:    desc.Platform,
+			},
+		}
+	}
+
+	for i, desc := range im.Manifests {
+		if desc.Annotations[dockerReferenceTypeAnnotation] != dockerAttestationManifest {
+			continue
+		}
+
+		att, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("pulling attestation manifest %q: %w", desc.Digest, err)
+		}
+
+		descAnnotations := make(map[string]string, len(desc.Annotations))
+		for k, v := range desc.Annotations {
+			descAnnotations[k] = v
+		}
+
+		if ref, err := v1.NewHash(desc.Annotations[dockerReferenceDigestAnnotation]); err == nil {
+			if d, ok := digests[ref]; ok {
+				descAnnotations[dockerReferenceDigestAnnotation] = d.String()
+			}
+		}
+
+		adds[i] = mutate.IndexAddendum{
+			Add: att,
+			Descriptor: v1.Descriptor{
+				URLs:        desc.URLs,
+				Annotations: descAnnotations,
+				Platform:    desc.Platform,
+			},
+		}
+	}
+
+	mutated := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, mt), adds...)
+
+	merged := make(map[string]string, len(im.Annotations)+len(annotations))
+	for k, v := range im.Annotations {
+		merged[k] = v
+	}
+
+	for k, v := range annotations {
+		merged[k] = v
+	}
+
+	return mutate.Annotations(mutated, merged).(v1.ImageIndex), nil
+}
+
+func (s *service) Sign(
+	ctx context.Context, dst string, annotations map[string]string, opts ...SignOption,
+) error {
+	o := makeSignOpts(opts...)
+
+	if err := ValidateSignatureAnnotations(annotations); err != nil {
+		return err
+	}
+
+	for _, a := range o.attestations {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return err
+	}
+
 	dstRef, err := parseOCIReference(dst)
 	if err != nil {
 		return fmt.Errorf("parsing destination reference %q: %w", dst, err)
 	}
 
-	k, err := s.backend.SignerVerifier(ctx)
+	sigRepo, err := o.signatureRepository(dstRef.Context())
 	if err != nil {
-		return fmt.Errorf("discovering signing key: %w", err)
+		return err
 	}
 
-	dd := cosremote.NewDupeDetector(k)
+	// NOTE: A signature suffix allows for multiple tags in an AWS ECR with
+	// immutable tags to point at the same digest.
+	sigSuffix, err := o.signatureSuffix(dstRef, sigRepo)
+	if err != nil {
+		return err
+	}
 
-	// NOTE: Wrt. `ociremote` options, a signature suffix should be used to
-	// allow for multiple tags in an AWS ECR to point at the same digest. This
-	// currently breaks cosign verify though, as it has no suffix option.
+	var keyRef string
+	if len(o.keyRoutes) > 0 {
+		if keyRef, err = o.keyRoutes.Route(dst, annotations); err != nil {
+			return err
+		}
+	}
 
-	se, err := ociremote.SignedEntity(
-		dstRef,
-		ociremote.WithRemoteOptions(s.backend.RemoteOpts(ctx)...),
-	)
+	k, err := s.signerVerifier(ctx, keyRef)
+	if err != nil {
+		return err
+	}
+
+	coKs, err := s.coSignerVerifiers(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	ks := append([]signature.SignerVerifier{k}, coKs...)
+
+	// Every manifest signed claims the same window.
+	var window *validity
+	if o.validity > 0 {
+		v := newValidity(time.Now(), o.validity)
+		window = &v
+	}
+
+	// Duplicates are detected per key, so that a signature by one key does not
+	// stand in for that of another.
+	dds := make([]ocimutate.DupeDetector, len(ks))
+	for i, k := range ks {
+		dds[i] = cosremote.NewDupeDetector(k)
+	}
+
+	se, err := ociremote.SignedEntity(dstRef, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
 	if err != nil {
 		return fmt.Errorf("discovering existing signed entities: %w", err)
 	}
@@ -145,6 +510,10 @@ func (s *service) Sign(ctx context.Context, dst string, annotations map[string]s
 			downscaledAnnotations[k] = v
 		}
 
+		if window != nil {
+			window.claim(downscaledAnnotations)
+		}
+
 		payload, err := (&payload.Cosign{
 			Image:       digest,
 			Annotations: map[string]interface{}(downscaledAnnotations),
@@ -153,31 +522,69 @@ func (s *service) Sign(ctx context.Context, dst string, annotations map[string]s
 			return err
 		}
 
-		signature, err := k.SignMessage(bytes.NewReader(payload), sigopts.WithContext(ctx))
-		if err != nil {
+		if o.referrers {
+			subject, err := signedEntityDescriptor(se)
+			if err != nil {
+				return err
+			}
+
+			if err := s.signReferrer(ctx, ks, sigRepo, subject, payload); err != nil || !o.replace {
+				return err
+			}
+
+			// Earlier signatures are only removed once replaced, so that the
+			// digest is never left unsigned.
+			_, err = s.removeReferrerSignatures(ctx, sigRepo, subject.Digest, staleSignature(ks, d, payload))
+
 			return err
 		}
 
-		b64sig := base64.StdEncoding.EncodeToString(signature)
+		if o.replace {
+			return s.replaceSignatures(ctx, ks, se, d, payload, sigRepo, sigSuffix)
+		}
 
-		sig, err := static.NewSignature(payload, b64sig)
-		if err != nil {
-			return err
+		// Every key signs before any signature is attached, so that the
+		// signatures of the digest are written at once or not at all.
+		sigs := make([]oci.Signature, len(ks))
+		for i, k := range ks {
+			if sigs[i], err = signPayload(ctx, k, payload); err != nil {
+				return err
+			}
 		}
 
-		newSE, err := ocimutate.AttachSignatureToEntity(se, sig, ocimutate.WithDupeDetector(dd))
-		if err != nil {
-			return err
+		newSE := se
+		for i, sig := range sigs {
+			if newSE, err = ocimutate.AttachSignatureToEntity(
+				newSE, sig, ocimutate.WithDupeDetector(dds[i]),
+			); err != nil {
+				return err
+			}
 		}
 
-		return ociremote.WriteSignatures(
-			digest.Repository,
-			newSE,
-			ociremote.WithRemoteOptions(s.backend.RemoteOpts(ctx)...),
-		)
+		return ociremote.WriteSignatures(sigRepo, newSE, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
 	}); err != nil {
 		return fmt.Errorf("writing signatures: %w", err)
 	}
 
+	return s.attestEntities(ctx, ks[0], dstRef, se, sigRepo, sigSuffix, o)
+}
+
+// writeStreamedLayers writes the layers of img whose digests are not yet known.
+func (s *service) writeStreamedLayers(ctx context.Context, dst name.Repository, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("getting layers: %w", err)
+	}
+
+	for _, l := range layers {
+		if _, err := l.Digest(); err != stream.ErrNotComputed {
+			continue
+		}
+
+		if err := remote.WriteLayer(dst, l, s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("writing streamed layer: %w", err)
+		}
+	}
+
 	return nil
 }
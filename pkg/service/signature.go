@@ -0,0 +1,686 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/cosign/pkg/oci/static"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ggcrstatic "github.com/google/go-containerregistry/pkg/v1/static"
+	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
+	sigopts "github.com/sigstore/sigstore/pkg/signature/options"
+)
+
+const (
+	// SignatureArtifactType is the artifact type of cosign signatures stored as
+	// OCI 1.1 referrers.
+	SignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	// emptyJSONMediaType is the config media type of artifacts that have no
+	// need for a config.
+	emptyJSONMediaType types.MediaType = "application/vnd.oci.empty.v1+json"
+
+	// SignatureSuffixTagPlaceholder is replaced by the tag of the signed
+	// reference in signature suffixes.
+	SignatureSuffixTagPlaceholder = "{tag}"
+)
+
+var (
+	ErrNoValidSignatures          = errors.New("no valid signatures")
+	ErrInvalidSignatureRepository = errors.New("invalid signature repository")
+	ErrInvalidSignatureSuffix     = errors.New("invalid signature suffix")
+
+	emptyJSON = []byte("{}")
+)
+
+// referrerManifest is an OCI 1.1 image manifest, which unlike those of the Go
+// container registry libraries can carry an artifact type and subject.
+type referrerManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// signatureRepository returns the repository that signatures of the entities
+// in repo are stored in.
+func (o *signOpts) signatureRepository(repo name.Repository) (name.Repository, error) {
+	if o.repository == "" {
+		return repo, nil
+	}
+
+	sigRepo, err := name.NewRepository(o.repository)
+	if err != nil {
+		return name.Repository{}, fmt.Errorf("%w: %q: %v", ErrInvalidSignatureRepository, o.repository, err)
+	}
+
+	return sigRepo, nil
+}
+
+// signatureSuffix returns the suffix of the cosign signature tag of the
+// entities at ref, with any tag placeholder replaced by the tag of ref.
+func (o *signOpts) signatureSuffix(ref name.Reference, sigRepo name.Repository) (string, error) {
+	suffix := o.suffix
+	if suffix == "" {
+		return ociremote.SignatureTagSuffix, nil
+	}
+
+	if strings.Contains(suffix, SignatureSuffixTagPlaceholder) {
+		tag, ok := ref.(name.Tag)
+		if !ok {
+			return "", fmt.Errorf(
+				"%w: %q needs a tagged reference, not %q", ErrInvalidSignatureSuffix, suffix, ref.Name(),
+			)
+		}
+
+		suffix = strings.ReplaceAll(suffix, SignatureSuffixTagPlaceholder, tag.TagStr())
+	}
+
+	// The longest possible signature tag must still be a valid tag.
+	if _, err := name.NewTag(
+		fmt.Sprintf("%s:sha256-%064d%s", sigRepo, 0, suffix), name.StrictValidation,
+	); err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrInvalidSignatureSuffix, suffix, err)
+	}
+
+	return suffix, nil
+}
+
+func (s *service) signatureRemoteOpts(
+	ctx context.Context, sigRepo name.Repository, sigSuffix string,
+) []ociremote.Option {
+	return []ociremote.Option{
+		ociremote.WithRemoteOptions(s.backend.RemoteOpts(ctx)...),
+		ociremote.WithTargetRepository(sigRepo),
+		ociremote.WithSignatureSuffix(sigSuffix),
+		ociremote.WithAttestationSuffix(attestationSuffix(sigSuffix)),
+	}
+}
+
+// signedEntityDescriptor returns the descriptor of a signed image or index.
+func signedEntityDescriptor(se oci.SignedEntity) (v1.Descriptor, error) {
+	e, ok := se.(interface {
+		Digest() (v1.Hash, error)
+		MediaType() (types.MediaType, error)
+		Size() (int64, error)
+	})
+	if !ok {
+		return v1.Descriptor{}, fmt.Errorf("unsupported signed entity %T", se)
+	}
+
+	var (
+		desc v1.Descriptor
+		err  error
+	)
+
+	if desc.Digest, err = e.Digest(); err != nil {
+		return desc, err
+	}
+
+	if desc.MediaType, err = e.MediaType(); err != nil {
+		return desc, err
+	}
+
+	desc.Size, err = e.Size()
+
+	return desc, err
+}
+
+// signerVerifier returns the key of the key ref, or the backend's key if none.
+func (s *service) signerVerifier(ctx context.Context, keyRef string) (signature.SignerVerifier, error) {
+	if keyRef == "" {
+		k, err := s.backend.SignerVerifier(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("discovering signing key: %w", err)
+		}
+
+		return k, nil
+	}
+
+	k, err := s.backend.KeySignerVerifier(ctx, keyRef)
+	if err != nil {
+		return nil, fmt.Errorf("discovering signing key %q: %w", keyRef, err)
+	}
+
+	return k, nil
+}
+
+// routedSignerVerifier returns the key that signs the image (or index) at the
+// reference after the fact, e.g. for attestations: that routed to by the
+// annotations of its manifest, which are those Sign routed by when it was
+// promoted, or the backend's key when there are no routes.
+func (s *service) routedSignerVerifier(
+	ctx context.Context, ref name.Reference, o *signOpts,
+) (signature.SignerVerifier, error) {
+	if len(o.keyRoutes) == 0 {
+		return s.signerVerifier(ctx, "")
+	}
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return nil, err
+	}
+
+	desc, err := remote.Get(ref, s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %q: %w", ref, err)
+	}
+
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest of %q: %w", ref, err)
+	}
+
+	keyRef, err := o.keyRoutes.route(ref.Context(), m.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.signerVerifier(ctx, keyRef)
+}
+
+// coSignerVerifiers returns the co-signing keys.
+func (s *service) coSignerVerifiers(ctx context.Context, o *signOpts) ([]signature.SignerVerifier, error) {
+	ks := make([]signature.SignerVerifier, len(o.coSigningKeys))
+
+	for i, keyRef := range o.coSigningKeys {
+		k, err := s.backend.KeySignerVerifier(ctx, keyRef)
+		if err != nil {
+			return nil, fmt.Errorf("discovering co-signing key %q: %w", keyRef, err)
+		}
+
+		ks[i] = k
+	}
+
+	return ks, nil
+}
+
+// signPayload signs the payload with the key.
+func signPayload(ctx context.Context, k signature.Signer, payload []byte) (oci.Signature, error) {
+	b, err := k.SignMessage(bytes.NewReader(payload), sigopts.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return static.NewSignature(payload, base64.StdEncoding.EncodeToString(b))
+}
+
+// signReferrer signs the payload for the subject with each of the keys that
+// has not already signed an equivalent payload, and writes their signatures
+// as one referrer of it.
+func (s *service) signReferrer(
+	ctx context.Context,
+	ks []signature.SignerVerifier,
+	repo name.Repository,
+	subject v1.Descriptor,
+	payload []byte,
+) error {
+	existing, err := s.referrerSignatures(ctx, repo, subject.Digest)
+	if err != nil {
+		return err
+	}
+
+	var sigs []oci.Signature
+
+	for _, k := range ks {
+		if signedBy(k, payload, existing) {
+			continue
+		}
+
+		sig, err := signPayload(ctx, k, payload)
+		if err != nil {
+			return err
+		}
+
+		sigs = append(sigs, sig)
+	}
+
+	if len(sigs) == 0 {
+		return nil
+	}
+
+	return s.writeArtifactReferrer(ctx, repo, subject, SignatureArtifactType, sigs...)
+}
+
+// replaceSignatures signs the payload for the signed entity with each of the
+// keys that has not already signed it, replacing their earlier signatures of
+// other payloads under its cosign signature tag.
+func (s *service) replaceSignatures(
+	ctx context.Context,
+	ks []signature.SignerVerifier,
+	se oci.SignedEntity,
+	digest v1.Hash,
+	payload []byte,
+	sigRepo name.Repository,
+	sigSuffix string,
+) error {
+	sigs, err := tagSignatures(se)
+	if err != nil {
+		return fmt.Errorf("discovering tag signatures: %w", err)
+	}
+
+	var newSigs []oci.Signature
+
+	for _, k := range ks {
+		if signedBy(k, payload, sigs) {
+			continue
+		}
+
+		sig, err := signPayload(ctx, k, payload)
+		if err != nil {
+			return err
+		}
+
+		newSigs = append(newSigs, sig)
+	}
+
+	kept, stale := partitionSignatures(sigs, staleSignature(ks, digest, payload))
+	if len(newSigs) == 0 && len(stale) == 0 {
+		return nil
+	}
+
+	return s.replaceTagSignatures(ctx, se, sigRepo, sigSuffix, append(kept, newSigs...))
+}
+
+// staleSignature returns whether a signature is by one of the keys over a
+// payload for the digest other than the current one.
+func staleSignature(ks []signature.SignerVerifier, digest v1.Hash, payload []byte) func(oci.Signature) bool {
+	return func(sig oci.Signature) bool {
+		if p, err := sig.Payload(); err != nil || bytes.Equal(p, payload) {
+			return false
+		}
+
+		for _, k := range ks {
+			if verifyDigestSignature(k, digest, sig) == nil {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// writeArtifactReferrer writes the signatures (or attestations) as a referrer
+// of the subject with the given artifact type.
+func (s *service) writeArtifactReferrer(
+	ctx context.Context,
+	repo name.Repository,
+	subject v1.Descriptor,
+	artifactType string,
+	sigs ...oci.Signature,
+) error {
+	if err := remote.WriteLayer(
+		repo, ggcrstatic.NewLayer(emptyJSON, emptyJSONMediaType), s.backend.RemoteOpts(ctx)...,
+	); err != nil {
+		return fmt.Errorf("writing signature config: %w", err)
+	}
+
+	layers := make([]v1.Descriptor, len(sigs))
+
+	for i, sig := range sigs {
+		if err := remote.WriteLayer(repo, sig, s.backend.RemoteOpts(ctx)...); err != nil {
+			return fmt.Errorf("writing signature payload: %w", err)
+		}
+
+		desc, err := signatureDescriptor(sig)
+		if err != nil {
+			return err
+		}
+
+		layers[i] = desc
+	}
+
+	cfg, _, err := v1.SHA256(bytes.NewReader(emptyJSON))
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&referrerManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  artifactType,
+		Config: v1.Descriptor{
+			MediaType: emptyJSONMediaType,
+			Digest:    cfg,
+			Size:      int64(len(emptyJSON)),
+		},
+		Layers: layers,
+		Subject: &v1.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.writeReferrer(ctx, repo, b, types.OCIManifestSchema1, artifactType, subject.Digest)
+}
+
+func signatureDescriptor(sig oci.Signature) (v1.Descriptor, error) {
+	var (
+		desc v1.Descriptor
+		err  error
+	)
+
+	if desc.MediaType, err = sig.MediaType(); err != nil {
+		return desc, err
+	}
+
+	if desc.Digest, err = sig.Digest(); err != nil {
+		return desc, err
+	}
+
+	if desc.Size, err = sig.Size(); err != nil {
+		return desc, err
+	}
+
+	desc.Annotations, err = sig.Annotations()
+
+	return desc, err
+}
+
+// referrerSignatures returns the signatures stored as referrers of the subject.
+func (s *service) referrerSignatures(
+	ctx context.Context, repo name.Repository, subject v1.Hash,
+) ([]oci.Signature, error) {
+	descs, err := s.referrers(ctx, repo, subject, SignatureArtifactType)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []oci.Signature
+
+	for _, desc := range descs {
+		_, layerSigs, err := s.referrerManifestSignatures(ctx, repo, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sig := range layerSigs {
+			if sig != nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+
+	return sigs, nil
+}
+
+// referrerManifestSignatures returns the signature referrer manifest of the
+// digest, and the signatures of its layers (nil for those that are not).
+func (s *service) referrerManifestSignatures(
+	ctx context.Context, repo name.Repository, digest v1.Hash,
+) (*referrerManifest, []oci.Signature, error) {
+	d, err := remote.Get(repo.Digest(digest.String()), s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching signature %q: %w", digest, err)
+	}
+
+	var m referrerManifest
+	if err := json.Unmarshal(d.Manifest, &m); err != nil {
+		return nil, nil, fmt.Errorf("parsing signature %q: %w", digest, err)
+	}
+
+	sigs := make([]oci.Signature, len(m.Layers))
+
+	for i, layer := range m.Layers {
+		b64sig, ok := layer.Annotations[static.SignatureAnnotationKey]
+		if !ok {
+			continue
+		}
+
+		l, err := remote.Layer(repo.Digest(layer.Digest.String()), s.backend.RemoteOpts(ctx)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching signature payload %q: %w", layer.Digest, err)
+		}
+
+		p, err := readBlob(l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading signature payload %q: %w", layer.Digest, err)
+		}
+
+		if sigs[i], err = static.NewSignature(p, b64sig); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &m, sigs, nil
+}
+
+// tagSignatures returns the signatures stored under the cosign signature tag of
+// the signed entity.
+func tagSignatures(se oci.SignedEntity) ([]oci.Signature, error) {
+	sigs, err := se.Signatures()
+	if err != nil {
+		return nil, err
+	}
+
+	return sigs.Get()
+}
+
+// readBlob reads the layer's blob as is.
+func readBlob(l v1.Layer) ([]byte, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// verifySignature verifies the signature against its payload.
+func verifySignature(v signature.Verifier, sig oci.Signature) error {
+	b64sig, err := sig.Base64Signature()
+	if err != nil {
+		return err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(b64sig)
+	if err != nil {
+		return err
+	}
+
+	p, err := sig.Payload()
+	if err != nil {
+		return err
+	}
+
+	return v.VerifySignature(bytes.NewReader(b), bytes.NewReader(p))
+}
+
+// verifyDigestSignature verifies the signature against its payload, and that
+// the payload is for the digest.
+func verifyDigestSignature(v signature.Verifier, digest v1.Hash, sig oci.Signature) error {
+	if err := verifySignature(v, sig); err != nil {
+		return err
+	}
+
+	p, err := sig.Payload()
+	if err != nil {
+		return err
+	}
+
+	var cp payload.Cosign
+	if err := json.Unmarshal(p, &cp); err != nil {
+		return err
+	}
+
+	if cp.Image.DigestStr() != digest.String() {
+		return fmt.Errorf("payload is for %q", cp.Image.DigestStr())
+	}
+
+	return nil
+}
+
+// verifySignatures returns the first of the signatures that was made by the
+// key over a payload for the digest, and is valid now as per the window it
+// claims, which must have an end if bounded.
+func verifySignatures(
+	v signature.Verifier, digest v1.Hash, sigs []oci.Signature, bounded bool,
+) (oci.Signature, error) {
+	var (
+		errs []string
+		now  = time.Now()
+	)
+
+	for _, sig := range sigs {
+		if err := verifyDigestSignature(v, digest, sig); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if err := verifyValidity(sig, now, bounded); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		return sig, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("%w: no signatures found", ErrNoValidSignatures)
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrNoValidSignatures, errs)
+}
+
+// signaturesBy returns those of the signatures that were made by the key over
+// a payload for the digest.
+func signaturesBy(v signature.Verifier, digest v1.Hash, sigs []oci.Signature) []oci.Signature {
+	var by []oci.Signature
+
+	for _, sig := range sigs {
+		if verifyDigestSignature(v, digest, sig) == nil {
+			by = append(by, sig)
+		}
+	}
+
+	return by
+}
+
+// signedBy returns whether any of the signatures is of the payload by the key.
+func signedBy(v signature.Verifier, payload []byte, sigs []oci.Signature) bool {
+	for _, sig := range sigs {
+		if p, err := sig.Payload(); err == nil && bytes.Equal(p, payload) && verifySignature(v, sig) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Verify checks that the image (or index) at dst has a valid signature by the
+// backend's (or the routed) key, and each co-signing key, whether stored under
+// the cosign signature tag or as an OCI 1.1 referrer.
+//
+// Verification takes the same options as signing, so that signatures are
+// looked for wherever they were written.
+func (s *service) Verify(ctx context.Context, dst string, opts ...SignOption) error {
+	o := makeSignOpts(opts...)
+
+	dstRef, err := parseOCIReference(dst)
+	if err != nil {
+		return fmt.Errorf("parsing destination reference %q: %w", dst, err)
+	}
+
+	sigRepo, err := o.signatureRepository(dstRef.Context())
+	if err != nil {
+		return err
+	}
+
+	sigSuffix, err := o.signatureSuffix(dstRef, sigRepo)
+	if err != nil {
+		return err
+	}
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return err
+	}
+
+	routes, err := o.keyRoutes.of(dstRef.Context())
+	if err != nil {
+		return err
+	}
+
+	coKs, err := s.coSignerVerifiers(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	se, err := ociremote.SignedEntity(dstRef, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
+	if err != nil {
+		return fmt.Errorf("discovering signed entity: %w", err)
+	}
+
+	desc, err := signedEntityDescriptor(se)
+	if err != nil {
+		return err
+	}
+
+	sigs, err := tagSignatures(se)
+	if err != nil {
+		return fmt.Errorf("discovering tag signatures: %w", err)
+	}
+
+	referrerSigs, err := s.referrerSignatures(ctx, sigRepo, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("discovering referrer signatures: %w", err)
+	}
+
+	sigs = append(sigs, referrerSigs...)
+	signed := dstRef.Context().Digest(desc.Digest.String()).Name()
+
+	// Once signatures claim a window, those that don't (e.g. legacy ones) are
+	// only accepted if opted into.
+	bounded := o.validity > 0 && !o.unboundedSignatures
+
+	// A signature is only accepted by the key that the annotations it was
+	// signed with route to, as signing would have routed them.
+	keys, routed := routes.signatures(sigs)
+
+	verified := fmt.Errorf("%w: no signatures found", ErrNoValidSignatures)
+
+	for _, keyRef := range keys {
+		k, err := s.signerVerifier(ctx, keyRef)
+		if err != nil {
+			return err
+		}
+
+		if _, verified = verifySignatures(k, desc.Digest, routed[keyRef], bounded); verified == nil {
+			break
+		}
+	}
+
+	if verified != nil {
+		return fmt.Errorf("verifying %q: %w", signed, verified)
+	}
+
+	for i, k := range coKs {
+		if _, err := verifySignatures(k, desc.Digest, sigs, bounded); err != nil {
+			return fmt.Errorf("verifying %q: co-signing key %q: %w", signed, o.coSigningKeys[i], err)
+		}
+	}
+
+	return nil
+}
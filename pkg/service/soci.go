@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/martinbaillie/ocistow/pkg/soci"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// writeSOCIIndexes generates a SOCI index for the image (or each image of the
+// index) at ref and writes it alongside as a referrer.
+//
+// The destination is read back rather than indexing layers as they are copied
+// so that the indexes describe exactly what was written (e.g. after
+// recompression) and the copy itself is not slowed down.
+func (s *service) writeSOCIIndexes(ctx context.Context, ref name.Reference, minLayerSize int64) error {
+	desc, err := remote.Get(ref, s.backend.RemoteOpts(ctx)...)
+	if err != nil {
+		return fmt.Errorf("fetching %q: %w", ref.Name(), err)
+	}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return fmt.Errorf("pulling image: %w", err)
+		}
+
+		return s.writeSOCIIndex(ctx, ref.Context(), desc.Descriptor, img, minLayerSize)
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return fmt.Errorf("pulling index: %w", err)
+	}
+
+	return s.writeIndexSOCIIndexes(ctx, ref.Context(), idx, minLayerSize)
+}
+
+func (s *service) writeIndexSOCIIndexes(
+	ctx context.Context, repo name.Repository, idx v1.ImageIndex, minLayerSize int64,
+) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("getting index manifest: %w", err)
+	}
+
+	for _, desc := range im.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("pulling index %q: %w", desc.Digest, err)
+			}
+
+			if err := s.writeIndexSOCIIndexes(ctx, repo, child, minLayerSize); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("pulling image %q: %w", desc.Digest, err)
+			}
+
+			if err := s.writeSOCIIndex(ctx, repo, desc, child, minLayerSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeSOCIIndex builds ztocs for the gzip compressed layers of img that are
+// at least minLayerSize and writes them, along with a SOCI index referring to
+// img. Nothing is written should no layers qualify.
+func (s *service) writeSOCIIndex(
+	ctx context.Context, repo name.Repository, subject v1.Descriptor, img v1.Image, minLayerSize int64,
+) error {
+	m, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("getting manifest: %w", err)
+	}
+
+	var ztocs []v1.Descriptor
+
+	for _, desc := range m.Layers {
+		if desc.MediaType != types.DockerLayer && desc.MediaType != types.OCILayer {
+			continue
+		}
+
+		if desc.Size < minLayerSize {
+			continue
+		}
+
+		ztocDesc, err := s.writeZtoc(ctx, repo, img, desc)
+		if err != nil {
+			return fmt.Errorf("indexing layer %q: %w", desc.Digest, err)
+		}
+
+		ztocs = append(ztocs, ztocDesc)
+	}
+
+	if len(ztocs) == 0 {
+		return nil
+	}
+
+	if err := remote.WriteLayer(
+		repo, static.NewLayer(soci.ConfigBlob, soci.IndexArtifactType), s.backend.RemoteOpts(ctx)...,
+	); err != nil {
+		return fmt.Errorf("writing SOCI index config: %w", err)
+	}
+
+	b, err := soci.NewIndex(ztocs, subject, soci.DefaultBuildToolIdentifier).Manifest()
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeReferrer(
+		ctx, repo, b, types.OCIManifestSchema1, string(soci.IndexArtifactType), subject.Digest,
+	); err != nil {
+		return fmt.Errorf("writing SOCI index: %w", err)
+	}
+
+	return nil
+}
+
+func (s *service) writeZtoc(
+	ctx context.Context, repo name.Repository, img v1.Image, desc v1.Descriptor,
+) (v1.Descriptor, error) {
+	l, err := img.LayerByDigest(desc.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer rc.Close()
+
+	ztoc, err := soci.BuildZtoc(rc, soci.DefaultSpanSize, soci.DefaultBuildToolIdentifier)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	ztocDesc, err := soci.ZtocDescriptor(ztoc, desc)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if err := remote.WriteLayer(
+		repo, static.NewLayer(ztoc, soci.ZtocMediaType), s.backend.RemoteOpts(ctx)...,
+	); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("writing ztoc: %w", err)
+	}
+
+	return ztocDesc, nil
+}
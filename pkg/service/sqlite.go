@@ -0,0 +1,341 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// NOTE: Only as much of the SQLite file format
+// (https://www.sqlite.org/fileformat.html) is read here as is needed to
+// catalogue rpm databases without a SQLite driver: the rows of a table, found
+// by name in the schema table. Anything only in the write-ahead log, which rpm
+// checkpoints on closing the database, is not seen.
+
+// SQLite b-tree page types.
+const (
+	sqlitePageTableInterior = 0x05
+	sqlitePageTableLeaf     = 0x0d
+
+	sqliteHeaderSize = 100
+	// sqliteMinUsableSize is the least usable size of a page that SQLite
+	// allows, below which the b-tree payload arithmetic does not hold.
+	sqliteMinUsableSize = 480
+)
+
+var errInvalidSQLite = errors.New("invalid SQLite database")
+
+// sqliteDB is a SQLite database file.
+type sqliteDB struct {
+	b          []byte
+	pageSize   int
+	usableSize int
+	pages      int
+}
+
+// sqliteTableRows returns the rows of the table of the SQLite database, each
+// of its column values: nil, int64, float64, string or []byte.
+func sqliteTableRows(b []byte, table string) ([][]interface{}, error) {
+	if len(b) < sqliteHeaderSize {
+		return nil, fmt.Errorf("%w: truncated", errInvalidSQLite)
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(b[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("%w: page size %d", errInvalidSQLite, pageSize)
+	}
+
+	db := &sqliteDB{
+		b:          b,
+		pageSize:   pageSize,
+		usableSize: pageSize - int(b[20]),
+		pages:      len(b) / pageSize,
+	}
+
+	if db.usableSize < sqliteMinUsableSize {
+		return nil, fmt.Errorf("%w: usable page size %d", errInvalidSQLite, db.usableSize)
+	}
+
+	// The schema table's rows are (type, name, tbl_name, rootpage, sql).
+	schema, err := db.rows(1)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err)
+	}
+
+	for _, row := range schema {
+		if len(row) < 4 || row[0] != "table" || row[1] != table {
+			continue
+		}
+
+		root, ok := row[3].(int64)
+		if !ok {
+			return nil, fmt.Errorf("%w: table %q has no root page", errInvalidSQLite, table)
+		}
+
+		rows, err := db.rows(int(root))
+		if err != nil {
+			return nil, fmt.Errorf("reading table %q: %w", table, err)
+		}
+
+		return rows, nil
+	}
+
+	return nil, fmt.Errorf("%w: no table %q", errInvalidSQLite, table)
+}
+
+// page returns the (1-indexed) page.
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	if n < 1 || n > db.pages {
+		return nil, fmt.Errorf("%w: page %d out of range", errInvalidSQLite, n)
+	}
+
+	return db.b[(n-1)*db.pageSize : n*db.pageSize], nil
+}
+
+// rows returns the rows of the table b-tree rooted at the page, walking it
+// depth first so that they are in rowid order.
+func (db *sqliteDB) rows(root int) ([][]interface{}, error) {
+	var (
+		rows    [][]interface{}
+		visited = make(map[int]bool)
+	)
+
+	var walk func(n int) error
+	walk = func(n int) error {
+		if visited[n] {
+			return fmt.Errorf("%w: page %d is in a cycle", errInvalidSQLite, n)
+		}
+
+		visited[n] = true
+
+		page, err := db.page(n)
+		if err != nil {
+			return err
+		}
+
+		// The first page's b-tree follows the database header.
+		hdr := page
+		if n == 1 {
+			hdr = page[sqliteHeaderSize:]
+		}
+
+		cells := int(binary.BigEndian.Uint16(hdr[3:]))
+
+		switch hdr[0] {
+		case sqlitePageTableLeaf:
+			if 8+2*cells > len(hdr) {
+				return fmt.Errorf("%w: %d cells overrun page %d", errInvalidSQLite, cells, n)
+			}
+
+			for i := 0; i < cells; i++ {
+				off := int(binary.BigEndian.Uint16(hdr[8+2*i:]))
+				if off >= len(page) {
+					return fmt.Errorf("%w: cell %d of page %d out of range", errInvalidSQLite, i, n)
+				}
+
+				payload, err := db.payload(page[off:])
+				if err != nil {
+					return fmt.Errorf("page %d: %w", n, err)
+				}
+
+				row, err := sqliteRecord(payload)
+				if err != nil {
+					return fmt.Errorf("page %d: %w", n, err)
+				}
+
+				rows = append(rows, row)
+			}
+		case sqlitePageTableInterior:
+			if 12+2*cells > len(hdr) {
+				return fmt.Errorf("%w: %d cells overrun page %d", errInvalidSQLite, cells, n)
+			}
+
+			for i := 0; i < cells; i++ {
+				off := int(binary.BigEndian.Uint16(hdr[12+2*i:]))
+				if off+4 > len(page) {
+					return fmt.Errorf("%w: cell %d of page %d out of range", errInvalidSQLite, i, n)
+				}
+
+				if err := walk(int(binary.BigEndian.Uint32(page[off:]))); err != nil {
+					return err
+				}
+			}
+
+			return walk(int(binary.BigEndian.Uint32(hdr[8:])))
+		default:
+			return fmt.Errorf("%w: page %d is not of a table b-tree", errInvalidSQLite, n)
+		}
+
+		return nil
+	}
+
+	return rows, walk(root)
+}
+
+// payload returns the record of the table leaf cell, following its overflow
+// pages should it spill onto them.
+func (db *sqliteDB) payload(cell []byte) ([]byte, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 {
+		return nil, fmt.Errorf("%w: truncated cell", errInvalidSQLite)
+	}
+
+	// The rowid is of no interest.
+	_, m := sqliteVarint(cell[n:])
+	if m == 0 {
+		return nil, fmt.Errorf("%w: truncated cell", errInvalidSQLite)
+	}
+
+	cell = cell[n+m:]
+
+	// No payload can be larger than the database holding it.
+	if size > uint64(len(db.b)) {
+		return nil, fmt.Errorf("%w: payload of %d bytes out of range", errInvalidSQLite, size)
+	}
+
+	// How much of the payload is stored in the cell itself.
+	local := int(size)
+	if maxLocal := db.usableSize - 35; local > maxLocal {
+		minLocal := (db.usableSize-12)*32/255 - 23
+		if local = minLocal + (int(size)-minLocal)%(db.usableSize-4); local > maxLocal {
+			local = minLocal
+		}
+	}
+
+	if local > len(cell) || (local < int(size) && local+4 > len(cell)) {
+		return nil, fmt.Errorf("%w: truncated cell", errInvalidSQLite)
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+
+	if local == int(size) {
+		return payload, nil
+	}
+
+	next := int(binary.BigEndian.Uint32(cell[local:]))
+
+	for hops := 0; len(payload) < int(size); hops++ {
+		if hops > db.pages {
+			return nil, fmt.Errorf("%w: overflow pages in a cycle", errInvalidSQLite)
+		}
+
+		page, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := page[4:db.usableSize]
+		if rest := int(size) - len(payload); len(chunk) > rest {
+			chunk = chunk[:rest]
+		}
+
+		payload = append(payload, chunk...)
+		next = int(binary.BigEndian.Uint32(page))
+	}
+
+	return payload, nil
+}
+
+// sqliteRecord returns the column values of the record.
+func sqliteRecord(b []byte) ([]interface{}, error) {
+	hdrSize, n := sqliteVarint(b)
+	if n == 0 || hdrSize > uint64(len(b)) || hdrSize < uint64(n) {
+		return nil, fmt.Errorf("%w: bad record header", errInvalidSQLite)
+	}
+
+	var (
+		hdr    = b[n:hdrSize]
+		body   = b[hdrSize:]
+		values []interface{}
+	)
+
+	for len(hdr) > 0 {
+		typ, n := sqliteVarint(hdr)
+		if n == 0 {
+			return nil, fmt.Errorf("%w: bad record header", errInvalidSQLite)
+		}
+
+		hdr = hdr[n:]
+
+		var size uint64
+		{
+			switch {
+			case typ >= 12 && typ%2 == 0:
+				size = (typ - 12) / 2
+			case typ >= 13:
+				size = (typ - 13) / 2
+			case typ >= 1 && typ <= 4:
+				size = typ
+			case typ == 5:
+				size = 6
+			case typ == 6 || typ == 7:
+				size = 8
+			case typ == 10 || typ == 11:
+				return nil, fmt.Errorf("%w: reserved serial type %d", errInvalidSQLite, typ)
+			}
+		}
+
+		if size > uint64(len(body)) {
+			return nil, fmt.Errorf("%w: truncated record", errInvalidSQLite)
+		}
+
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ == 8 || typ == 9:
+			values = append(values, int64(typ-8))
+		case typ == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case typ <= 6:
+			// Integers are big-endian two's complement of their size.
+			var i int64
+			if v[0]&0x80 != 0 {
+				i = -1
+			}
+
+			for _, c := range v {
+				i = i<<8 | int64(c)
+			}
+
+			values = append(values, i)
+		case typ%2 == 0:
+			values = append(values, v)
+		default:
+			values = append(values, string(v))
+		}
+	}
+
+	return values, nil
+}
+
+// sqliteVarint decodes the big-endian variable length integer, returning it
+// and its length, which is 0 should it be truncated.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+
+	return v, 9
+}
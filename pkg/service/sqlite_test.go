@@ -0,0 +1,196 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testdata/rpmdb.sqlite was made with Python's sqlite3 module: the schema of
+// rpm's SQLite database, with a page size of 1024 so that the Packages table
+// spans interior pages and the long license of the seventh package overflows,
+// and the headers of testRpmPackages(200) inserted in order.
+
+func testSQLite(t *testing.T) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile("testdata/rpmdb.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestSQLiteTableRows(t *testing.T) {
+	db := testSQLite(t)
+
+	rows, err := sqliteTableRows(db, "Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, headers := testRpmPackages(200)
+	if len(rows) != len(headers) {
+		t.Fatalf("%d rows, want %d", len(rows), len(headers))
+	}
+
+	for i, row := range rows {
+		// The INTEGER PRIMARY KEY is an alias of the rowid, so stored as null.
+		if want := []interface{}{nil, headers[i]}; !reflect.DeepEqual(row, want) {
+			t.Fatalf("row %d is %v, want %v", i, row, want)
+		}
+	}
+
+	names, err := sqliteTableRows(db, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 200 || !reflect.DeepEqual(names[7], []interface{}{"pkg-007", int64(8), int64(0)}) {
+		t.Errorf("Name rows %v", names[:8])
+	}
+
+	if _, err := sqliteTableRows(db, "Basenames"); !errors.Is(err, errInvalidSQLite) {
+		t.Errorf("missing table: error %v, want %v", err, errInvalidSQLite)
+	}
+
+	// An index is not a table.
+	if _, err := sqliteTableRows(db, "sqlite_autoindex_Name_1"); !errors.Is(err, errInvalidSQLite) {
+		t.Errorf("index: error %v, want %v", err, errInvalidSQLite)
+	}
+}
+
+func TestSQLiteTableRowsMalformed(t *testing.T) {
+	db := testSQLite(t)
+	pageSize := int(binary.BigEndian.Uint16(db[16:]))
+
+	// The Packages table is rooted at page 2.
+	root := func(b []byte) []byte { return b[pageSize : 2*pageSize] }
+
+	for name, corrupt := range map[string]func(b []byte) []byte{
+		"truncated header":    func(b []byte) []byte { return b[:50] },
+		"truncated page 1":    func(b []byte) []byte { return b[:pageSize-1] },
+		"truncated table":     func(b []byte) []byte { return b[:pageSize+pageSize/2] },
+		"truncated overflow":  func(b []byte) []byte { return b[:len(b)/4] },
+		"page size":           func(b []byte) []byte { binary.BigEndian.PutUint16(b[16:], 1000); return b },
+		"reserved page space": func(b []byte) []byte { b[20] = 255; b[16], b[17] = 2, 0; return b },
+		"page type":           func(b []byte) []byte { root(b)[0] = 0x0a; return b },
+		"cell count": func(b []byte) []byte {
+			binary.BigEndian.PutUint16(root(b)[3:], 0xffff)
+			return b
+		},
+		"cell pointer": func(b []byte) []byte {
+			binary.BigEndian.PutUint16(root(b)[12:], 0xffff)
+			return b
+		},
+		"child page": func(b []byte) []byte {
+			binary.BigEndian.PutUint32(root(b)[8:], 0xffffffff)
+			return b
+		},
+		"cycle": func(b []byte) []byte {
+			binary.BigEndian.PutUint32(root(b)[8:], 2)
+			return b
+		},
+	} {
+		if _, err := sqliteTableRows(corrupt(append([]byte{}, db...)), "Packages"); !errors.Is(err, errInvalidSQLite) {
+			t.Errorf("%s: error %v, want %v", name, err, errInvalidSQLite)
+		}
+	}
+
+	// Corruption anywhere must be an error, or go unnoticed, but never panic.
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		corrupt := append([]byte{}, db...)
+		for j := 0; j < 1+rng.Intn(8); j++ {
+			corrupt[rng.Intn(len(corrupt))] = byte(rng.Intn(256))
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("corruption %d: panic: %v", i, r)
+				}
+			}()
+
+			sqliteTableRows(corrupt, "Packages")
+		}()
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	// A header of 10 bytes (its size, then a serial type per column) and the
+	// columns.
+	record := []byte{
+		10,
+		0,    // null
+		1,    // 8-bit integer
+		3,    // 24-bit integer
+		6,    // 64-bit integer
+		7,    // float
+		8, 9, // the integers 0 and 1
+		12 + 2*3, // a 3 byte blob
+		13 + 2*2, // a 2 byte string
+		0xfe,
+		0xff, 0xfe, 0xfd,
+		0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18,
+		'r', 'p', 'm',
+		'o', 'k',
+	}
+
+	got, err := sqliteRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []interface{}{
+		nil, int64(-2), int64(-259), int64(math.MaxInt64), math.Pi, int64(0), int64(1), []byte("rpm"), "ok",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for name, record := range map[string][]byte{
+		"empty":              {},
+		"header overrun":     {0x7f, 1},
+		"header underrun":    {0},
+		"truncated varint":   {2, 0x81},
+		"reserved type":      {2, 10},
+		"truncated column":   {2, 6, 1, 2, 3},
+		"truncated string":   {2, 13 + 2*4, 'r', 'p', 'm'},
+		"negative sized":     {10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf1, 'x'},
+		"huge header":        {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0},
+		"huge serial length": {6, 0x8f, 0xff, 0xff, 0xff, 0x7f, 'x'},
+	} {
+		if _, err := sqliteRecord(record); !errors.Is(err, errInvalidSQLite) {
+			t.Errorf("%s: error %v, want %v", name, err, errInvalidSQLite)
+		}
+	}
+}
+
+func TestSQLiteVarint(t *testing.T) {
+	for _, tc := range []struct {
+		b    []byte
+		v    uint64
+		size int
+	}{
+		{[]byte{0x00}, 0, 1},
+		{[]byte{0x7f, 0xff}, 0x7f, 1},
+		{[]byte{0x81, 0x00}, 0x80, 2},
+		{[]byte{0x82, 0x80, 0x01}, 0x8001, 3},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, math.MaxUint64, 9},
+		{[]byte{0x81}, 0, 0},
+		{nil, 0, 0},
+	} {
+		if v, size := sqliteVarint(tc.b); v != tc.v || size != tc.size {
+			t.Errorf("% x: got %#x (%d bytes), want %#x (%d bytes)", tc.b, v, size, tc.v, tc.size)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/sigstore/pkg/signature"
+
+	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
+)
+
+// RevocationPredicateType is the in-toto predicate type of revocation records
+// of removed signatures.
+const RevocationPredicateType = "https://github.com/martinbaillie/ocistow/revocation@v1"
+
+// RemovedSignature is a signature removed from an image (or index).
+type RemovedSignature struct {
+	// Digest is that of the image (or index) that was signed.
+	Digest    string          `json:"digest"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// Revocation is the predicate of a revocation record: the signatures removed,
+// why and by whom.
+type Revocation struct {
+	Reason     string             `json:"reason,omitempty"`
+	Revoker    string             `json:"revoker,omitempty"`
+	RevokedOn  time.Time          `json:"revokedOn"`
+	Signatures []RemovedSignature `json:"signatures"`
+}
+
+// Unsign withdraws trust in the image (or index) at dst, without deleting it,
+// by removing its signatures by the key, or by the backend's (or a routed) key
+// if none, or all of its signatures given WithAllSignatures. Signatures are
+// removed both from under the cosign signature tag and as referrers, as either
+// would verify, and the signature manifest is deleted outright once empty. The
+// signatures of an index's images are left alone, as they may be shared.
+//
+// Unsign takes the same options as signing, so that signatures are looked for
+// wherever they were written, and returns the signatures removed. Given
+// WithRevocation, those are attested to by a revocation record, signed as
+// attestations are.
+func (s *service) Unsign(
+	ctx context.Context, dst, keyRef string, signOpts []SignOption, opts ...UnsignOption,
+) ([]RemovedSignature, error) {
+	o, uo := makeSignOpts(signOpts...), makeUnsignOpts(opts...)
+
+	if err := o.keyRoutes.validate(); err != nil {
+		return nil, err
+	}
+
+	dstRef, err := parseOCIReference(dst)
+	if err != nil {
+		return nil, fmt.Errorf("parsing destination reference %q: %w", dst, err)
+	}
+
+	sigRepo, err := o.signatureRepository(dstRef.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	sigSuffix, err := o.signatureSuffix(dstRef, sigRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	var k signature.SignerVerifier
+
+	switch {
+	case uo.allSignatures:
+	case keyRef == "":
+		k, err = s.routedSignerVerifier(ctx, dstRef, o)
+	default:
+		k, err = s.signerVerifier(ctx, keyRef)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	se, err := ociremote.SignedEntity(dstRef, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
+	if err != nil {
+		return nil, fmt.Errorf("discovering signed entity: %w", err)
+	}
+
+	desc, err := signedEntityDescriptor(se)
+	if err != nil {
+		return nil, err
+	}
+
+	remove := func(sig oci.Signature) bool {
+		return k == nil || verifyDigestSignature(k, desc.Digest, sig) == nil
+	}
+
+	sigs, err := tagSignatures(se)
+	if err != nil {
+		return nil, fmt.Errorf("discovering tag signatures: %w", err)
+	}
+
+	kept, removedSigs := partitionSignatures(sigs, remove)
+	if len(removedSigs) > 0 {
+		if err := s.replaceTagSignatures(ctx, se, sigRepo, sigSuffix, kept); err != nil {
+			return nil, fmt.Errorf("removing tag signatures: %w", err)
+		}
+	}
+
+	referrerSigs, err := s.removeReferrerSignatures(ctx, sigRepo, desc.Digest, remove)
+	if err != nil {
+		return nil, fmt.Errorf("removing referrer signatures: %w", err)
+	}
+
+	removed, err := removedSignatures(desc.Digest.String(), append(removedSigs, referrerSigs...))
+	if err != nil {
+		return nil, err
+	}
+
+	if uo.revocation == nil || len(removed) == 0 {
+		return removed, nil
+	}
+
+	attK, err := s.routedSignerVerifier(ctx, dstRef, o)
+	if err != nil {
+		return removed, err
+	}
+
+	revocation := *uo.revocation
+	revocation.RevokedOn = time.Now().UTC()
+	revocation.Signatures = removed
+
+	return removed, s.attest(
+		ctx, attK, dstRef.Context(), se, sigRepo, sigSuffix, o.referrers, RevocationPredicateType, &revocation,
+	)
+}
+
+// removedSignatures returns the signatures of the digest as removed.
+func removedSignatures(digest string, sigs []oci.Signature) ([]RemovedSignature, error) {
+	removed := make([]RemovedSignature, len(sigs))
+
+	for i, sig := range sigs {
+		p, err := sig.Payload()
+		if err != nil {
+			return nil, err
+		}
+
+		b64sig, err := sig.Base64Signature()
+		if err != nil {
+			return nil, err
+		}
+
+		removed[i] = RemovedSignature{Digest: digest, Payload: p, Signature: b64sig}
+	}
+
+	return removed, nil
+}
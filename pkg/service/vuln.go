@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/pkg/oci"
+	"github.com/sigstore/cosign/pkg/oci/walk"
+
+	"github.com/martinbaillie/ocistow/pkg/backend"
+
+	ociremote "github.com/sigstore/cosign/pkg/oci/remote"
+)
+
+const (
+	// VulnPredicateType is the predicate type of cosign vulnerability scan
+	// attestations.
+	VulnPredicateType = "https://cosign.sigstore.dev/attestation/vuln/v1"
+	// VEXPredicateType is the predicate type of OpenVEX document attestations.
+	VEXPredicateType = "https://openvex.dev/ns"
+
+	scanPollInterval = 10 * time.Second
+)
+
+// vulnPredicate is a cosign vulnerability scan attestation predicate.
+type vulnPredicate struct {
+	Invocation vulnInvocation `json:"invocation"`
+	Scanner    vulnScanner    `json:"scanner"`
+	Metadata   vulnMetadata   `json:"metadata"`
+}
+
+type vulnInvocation struct {
+	Parameters interface{} `json:"parameters"`
+	URI        string      `json:"uri"`
+	EventID    string      `json:"event_id"`
+	BuilderID  string      `json:"builder.id"`
+}
+
+type vulnScanner struct {
+	URI     string      `json:"uri"`
+	Version string      `json:"version"`
+	DB      vulnDB      `json:"db"`
+	Result  interface{} `json:"result"`
+}
+
+type vulnDB struct {
+	URI     string `json:"uri"`
+	Version string `json:"version"`
+}
+
+type vulnMetadata struct {
+	ScanStartedOn  time.Time `json:"scanStartedOn"`
+	ScanFinishedOn time.Time `json:"scanFinishedOn"`
+}
+
+func newVulnPredicate(f *backend.ScanFindings) *vulnPredicate {
+	return &vulnPredicate{
+		Invocation: vulnInvocation{BuilderID: ProvenanceBuilderID},
+		Scanner: vulnScanner{
+			URI:     f.ScannerURI,
+			Version: f.ScannerVersion,
+			DB:      vulnDB{URI: f.DatabaseURI, Version: f.DatabaseVersion},
+			Result:  f.Findings,
+		},
+		Metadata: vulnMetadata{ScanStartedOn: f.StartedOn, ScanFinishedOn: f.FinishedOn},
+	}
+}
+
+// AttestScan attaches the registry's vulnerability scan findings of the image
+// (or of each image of the index) at dst as signed cosign vulnerability
+// attestations, along with any other attestations of the options (e.g. VEX
+// documents of the findings). Attestations are stored alongside signatures, as
+// per the options.
+func (s *service) AttestScan(ctx context.Context, dst string, opts ...SignOption) error {
+	o := makeSignOpts(opts...)
+
+	for _, a := range o.attestations {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+
+	dstRef, err := parseOCIReference(dst)
+	if err != nil {
+		return fmt.Errorf("parsing destination reference %q: %w", dst, err)
+	}
+
+	sigRepo, err := o.signatureRepository(dstRef.Context())
+	if err != nil {
+		return err
+	}
+
+	sigSuffix, err := o.signatureSuffix(dstRef, sigRepo)
+	if err != nil {
+		return err
+	}
+
+	k, err := s.routedSignerVerifier(ctx, dstRef, o)
+	if err != nil {
+		return err
+	}
+
+	se, err := ociremote.SignedEntity(dstRef, s.signatureRemoteOpts(ctx, sigRepo, sigSuffix)...)
+	if err != nil {
+		return fmt.Errorf("discovering signed entity: %w", err)
+	}
+
+	// Registries scan images rather than indexes.
+	if err := walk.SignedEntity(ctx, se, func(ctx context.Context, se oci.SignedEntity) error {
+		if _, ok := se.(oci.SignedImage); !ok {
+			return nil
+		}
+
+		desc, err := signedEntityDescriptor(se)
+		if err != nil {
+			return err
+		}
+
+		findings, err := s.scanFindings(ctx, dstRef.Context().Digest(desc.Digest.String()), o.scanTimeout)
+		if err != nil {
+			return err
+		}
+
+		predicate, err := json.Marshal(newVulnPredicate(findings))
+		if err != nil {
+			return err
+		}
+
+		o.attestations = append(o.attestations, attestation{
+			subject:       desc.Digest,
+			predicateType: VulnPredicateType,
+			predicate:     predicate,
+		})
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("getting scan findings: %w", err)
+	}
+
+	return s.attestEntities(ctx, k, dstRef, se, sigRepo, sigSuffix, o)
+}
+
+// scanFindings returns the scan findings of the image, waiting up to the
+// timeout for a scan in progress to finish.
+func (s *service) scanFindings(ctx context.Context, img name.Digest, timeout time.Duration) (*backend.ScanFindings, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		findings, err := s.backend.ScanFindings(ctx, img)
+		if !errors.Is(err, backend.ErrScanInProgress) || time.Now().Add(scanPollInterval).After(deadline) {
+			if err != nil {
+				return nil, fmt.Errorf("scan of %q: %w", img, err)
+			}
+
+			return findings, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for scan of %q: %w", img, ctx.Err())
+		case <-time.After(scanPollInterval):
+		}
+	}
+}
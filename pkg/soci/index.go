@@ -0,0 +1,103 @@
+// Package soci builds Seekable OCI (SOCI) indexes, which allow runtimes such as
+// AWS Fargate and the SOCI snapshotter to lazily pull the gzip compressed
+// layers of an image without it having to be converted.
+//
+// See: https://github.com/awslabs/soci-snapshotter
+package soci
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// IndexArtifactType is the (config) media type of a SOCI index manifest.
+	IndexArtifactType types.MediaType = "application/vnd.amazon.soci.index.v1+json"
+	// ZtocMediaType is the media type of the ztoc blobs referenced by a SOCI
+	// index.
+	ZtocMediaType types.MediaType = "application/octet-stream"
+
+	AnnotationImageLayerMediaType = "com.amazon.soci.image-layer-mediaType"
+	AnnotationImageLayerDigest    = "com.amazon.soci.image-layer-digest"
+	AnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
+
+	DefaultBuildToolIdentifier = "ocistow"
+	// DefaultSpanSize is the approximate distance between checkpoints in the
+	// uncompressed layer.
+	DefaultSpanSize int64 = 1 << 22
+	// DefaultMinLayerSize is the compressed size below which layers are not
+	// worth lazily pulling.
+	DefaultMinLayerSize int64 = 10 << 20
+)
+
+var (
+	// ConfigBlob is the content of the config of a SOCI index manifest. It is
+	// never used by SOCI, but registries require it to exist.
+	ConfigBlob = []byte("{}")
+
+	configDescriptor = v1.Descriptor{
+		MediaType: IndexArtifactType,
+		Digest: v1.Hash{
+			Algorithm: "sha256",
+			Hex:       "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		},
+		Size: int64(len(ConfigBlob)),
+	}
+)
+
+// Index is a SOCI index, serialised as an OCI image manifest that refers to
+// the image it indexes through its subject.
+type Index struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// NewIndex returns a SOCI index of the given ztocs for the subject image
+// manifest.
+func NewIndex(ztocs []v1.Descriptor, subject v1.Descriptor, buildToolIdentifier string) *Index {
+	return &Index{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        configDescriptor,
+		Layers:        ztocs,
+		Subject: &v1.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Annotations: map[string]string{
+			AnnotationBuildToolIdentifier: buildToolIdentifier,
+		},
+	}
+}
+
+// ZtocDescriptor returns the descriptor of a ztoc within a SOCI index.
+func ZtocDescriptor(ztoc []byte, layer v1.Descriptor) (v1.Descriptor, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(ztoc))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{
+		MediaType: ZtocMediaType,
+		Digest:    h,
+		Size:      int64(len(ztoc)),
+		Annotations: map[string]string{
+			AnnotationImageLayerMediaType: string(layer.MediaType),
+			AnnotationImageLayerDigest:    layer.Digest.String(),
+		},
+	}, nil
+}
+
+// Manifest returns the serialised SOCI index.
+func (i *Index) Manifest() ([]byte, error) {
+	return json.Marshal(i)
+}
@@ -0,0 +1,734 @@
+package soci
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// NOTE: The checkpoint ("zinfo") format produced here matches that of the SOCI
+// snapshotter, which in turn is derived from zlib's zran.c example. Rather
+// than cgo and zlib, a small pure Go inflater is used so that layers can be
+// indexed as they stream (and so that cross-compiling for Lambda still works).
+
+const (
+	zinfoVersion      = 2
+	windowSize        = 1 << 15
+	maxCodeBits       = 15
+	checkpointBlobLen = 8 + 8 + 1 + windowSize
+)
+
+var ErrInvalidGzip = errors.New("invalid gzip stream")
+
+// checkpoint records the state needed to resume decompression at a deflate
+// block boundary.
+type checkpoint struct {
+	in     int64 // Offset in the compressed stream of the first full byte.
+	out    int64 // Offset in the uncompressed stream.
+	bits   uint8 // Number of bits (1-7) from the byte at in-1, or 0.
+	window []byte
+}
+
+// zinfo is the collection of checkpoints for a gzip stream, along with the
+// digests of the compressed spans between them.
+type zinfo struct {
+	spanSize    int64
+	checkpoints []checkpoint
+	spanDigests []string
+}
+
+// blob serialises the zinfo in the little endian format understood by the
+// SOCI snapshotter.
+func (z *zinfo) blob() []byte {
+	var buf bytes.Buffer
+	buf.Grow(4 + 8 + len(z.checkpoints)*checkpointBlobLen)
+
+	binary.Write(&buf, binary.LittleEndian, int32(len(z.checkpoints)))
+	binary.Write(&buf, binary.LittleEndian, z.spanSize)
+
+	for _, cp := range z.checkpoints {
+		binary.Write(&buf, binary.LittleEndian, cp.in)
+		binary.Write(&buf, binary.LittleEndian, cp.out)
+		buf.WriteByte(cp.bits)
+		buf.Write(cp.window)
+	}
+
+	return buf.Bytes()
+}
+
+// gzipIndexer decompresses a gzip stream of one or more members, writing the
+// uncompressed data to out whilst recording checkpoints at deflate block
+// boundaries that are at least spanSize apart, and at the start of each member.
+type gzipIndexer struct {
+	spanSize int64
+	out      io.Writer
+
+	// Compressed input. Everything read from the source is retained in span
+	// from spanStart onwards so that the span digests can be computed
+	// without a second pass.
+	src       *bufio.Reader
+	span      []byte
+	spanStart int64
+	bitBuf    uint64
+	bitCount  uint
+	consumed  int64 // Bytes pulled into the bit buffer.
+
+	// Uncompressed output, of which that of the current member starts at
+	// memberStart and has the CRC-32 crc.
+	window      [windowSize]byte
+	total       int64
+	pending     []byte
+	memberStart int64
+	crc         uint32
+
+	zinfo zinfo
+}
+
+func newGzipIndexer(r io.Reader, out io.Writer, spanSize int64) *gzipIndexer {
+	gi := &gzipIndexer{
+		spanSize: spanSize,
+		out:      out,
+		pending:  make([]byte, 0, windowSize),
+		zinfo:    zinfo{spanSize: spanSize},
+	}
+
+	gi.src = bufio.NewReader(&spanRecorder{r: r, gi: gi})
+
+	return gi
+}
+
+// spanRecorder retains everything read from the compressed source.
+type spanRecorder struct {
+	r  io.Reader
+	gi *gzipIndexer
+}
+
+func (sr *spanRecorder) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.gi.span = append(sr.gi.span, p[:n]...)
+
+	return n, err
+}
+
+// index runs the indexer to completion, returning the zinfo and the total size
+// of the compressed stream.
+func (gi *gzipIndexer) index() (*zinfo, int64, error) {
+	// Concatenated members (as written by e.g. pigz) decompress as one
+	// stream, as they do for runtimes, so anything following a member must be
+	// another.
+	for {
+		// Members (and so their trailers) end byte aligned.
+		start := gi.consumed
+
+		if err := gi.member(); err != nil {
+			if start > 0 {
+				err = fmt.Errorf("member at %d: %w", start, err)
+			}
+
+			return nil, 0, err
+		}
+
+		if _, err := gi.src.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	size := gi.spanStart + int64(len(gi.span))
+	gi.closeSpan(size)
+
+	return &gi.zinfo, size, nil
+}
+
+// member decompresses a gzip member. As with zran.c, the first checkpoint
+// sits just after the first member's header. So too does one after each
+// following member's, as its deflate stream starts afresh there.
+func (gi *gzipIndexer) member() error {
+	if err := gi.header(); err != nil {
+		return err
+	}
+
+	gi.memberStart, gi.crc = gi.total, 0
+	gi.checkpoint()
+
+	if err := gi.inflate(); err != nil {
+		return err
+	}
+
+	if err := gi.flush(); err != nil {
+		return err
+	}
+
+	return gi.trailer()
+}
+
+func (gi *gzipIndexer) readByte() (byte, error) {
+	c, err := gi.src.ReadByte()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	gi.consumed++
+
+	return c, err
+}
+
+// header consumes a RFC 1952 gzip member header.
+func (gi *gzipIndexer) header() error {
+	var hdr [10]byte
+	for i := range hdr {
+		c, err := gi.readByte()
+		if err != nil {
+			return err
+		}
+
+		hdr[i] = c
+	}
+
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return fmt.Errorf("%w: bad header", ErrInvalidGzip)
+	}
+
+	const (
+		fhcrc    = 1 << 1
+		fextra   = 1 << 2
+		fname    = 1 << 3
+		fcomment = 1 << 4
+	)
+
+	flags := hdr[3]
+
+	if flags&fextra != 0 {
+		lo, err := gi.readByte()
+		if err != nil {
+			return err
+		}
+
+		hi, err := gi.readByte()
+		if err != nil {
+			return err
+		}
+
+		for n := int(lo) | int(hi)<<8; n > 0; n-- {
+			if _, err := gi.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, flag := range []byte{fname, fcomment} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		for {
+			c, err := gi.readByte()
+			if err != nil {
+				return err
+			}
+
+			if c == 0 {
+				break
+			}
+		}
+	}
+
+	if flags&fhcrc != 0 {
+		for i := 0; i < 2; i++ {
+			if _, err := gi.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// trailer verifies the CRC-32 and size of the uncompressed data.
+func (gi *gzipIndexer) trailer() error {
+	// Discard the bits remaining in the final partial byte.
+	gi.bitBuf >>= gi.bitCount % 8
+	gi.bitCount -= gi.bitCount % 8
+
+	var trl [8]byte
+	for i := range trl {
+		if gi.bitCount >= 8 {
+			trl[i] = byte(gi.bitBuf)
+			gi.bitBuf >>= 8
+			gi.bitCount -= 8
+
+			continue
+		}
+
+		c, err := gi.readByte()
+		if err != nil {
+			return err
+		}
+
+		trl[i] = c
+	}
+
+	if binary.LittleEndian.Uint32(trl[:4]) != gi.crc ||
+		binary.LittleEndian.Uint32(trl[4:]) != uint32(gi.total-gi.memberStart) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidGzip)
+	}
+
+	return nil
+}
+
+// need ensures at least n bits are buffered.
+func (gi *gzipIndexer) need(n uint) error {
+	for gi.bitCount < n {
+		c, err := gi.readByte()
+		if err != nil {
+			return err
+		}
+
+		gi.bitBuf |= uint64(c) << gi.bitCount
+		gi.bitCount += 8
+	}
+
+	return nil
+}
+
+func (gi *gzipIndexer) bits(n uint) (uint32, error) {
+	if err := gi.need(n); err != nil {
+		return 0, err
+	}
+
+	v := uint32(gi.bitBuf & (1<<n - 1))
+	gi.bitBuf >>= n
+	gi.bitCount -= n
+
+	return v, nil
+}
+
+// checkpoint records the current position, which must be a block boundary.
+func (gi *gzipIndexer) checkpoint() {
+	// Whole bytes are only ever buffered on demand, so fewer than eight bits
+	// of the last byte pulled remain unused.
+	cp := checkpoint{
+		in:     gi.consumed,
+		out:    gi.total,
+		bits:   uint8(gi.bitCount),
+		window: make([]byte, windowSize),
+	}
+
+	// The window is the preceding 32KiB of uncompressed data, zero padded at
+	// the front.
+	pos := int(gi.total % windowSize)
+	copy(cp.window, gi.window[pos:])
+	copy(cp.window[windowSize-pos:], gi.window[:pos])
+
+	start := cp.in
+	if cp.bits != 0 {
+		start--
+	}
+
+	if len(gi.zinfo.checkpoints) > 0 {
+		gi.closeSpan(cp.in)
+	}
+
+	// Drop the compressed data preceding the new span.
+	gi.span = append(gi.span[:0], gi.span[start-gi.spanStart:]...)
+	gi.spanStart = start
+
+	gi.zinfo.checkpoints = append(gi.zinfo.checkpoints, cp)
+}
+
+// closeSpan digests the current span, which ends at the given offset.
+func (gi *gzipIndexer) closeSpan(end int64) {
+	sum := sha256.Sum256(gi.span[:end-gi.spanStart])
+	gi.zinfo.spanDigests = append(gi.zinfo.spanDigests, "sha256:"+hex.EncodeToString(sum[:]))
+}
+
+func (gi *gzipIndexer) emit(c byte) error {
+	gi.window[gi.total%windowSize] = c
+	gi.total++
+	gi.pending = append(gi.pending, c)
+
+	if len(gi.pending) == cap(gi.pending) {
+		return gi.flush()
+	}
+
+	return nil
+}
+
+func (gi *gzipIndexer) flush() error {
+	gi.crc = crc32.Update(gi.crc, crc32.IEEETable, gi.pending)
+
+	_, err := gi.out.Write(gi.pending)
+	gi.pending = gi.pending[:0]
+
+	return err
+}
+
+// inflate decodes the raw deflate stream (RFC 1951).
+func (gi *gzipIndexer) inflate() error {
+	last := gi.total
+
+	for {
+		final, err := gi.bits(1)
+		if err != nil {
+			return err
+		}
+
+		typ, err := gi.bits(2)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case 0:
+			err = gi.stored()
+		case 1:
+			err = gi.codes(&fixedLiteralHuffman, &fixedDistanceHuffman)
+		case 2:
+			var lit, dist huffman
+			if err = gi.dynamic(&lit, &dist); err == nil {
+				err = gi.codes(&lit, &dist)
+			}
+		default:
+			err = fmt.Errorf("%w: invalid block type", ErrInvalidGzip)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if final == 1 {
+			return nil
+		}
+
+		if gi.total == 0 || gi.total-last > gi.spanSize {
+			gi.checkpoint()
+			last = gi.total
+		}
+	}
+}
+
+func (gi *gzipIndexer) stored() error {
+	// Skip to the byte boundary.
+	gi.bitBuf >>= gi.bitCount % 8
+	gi.bitCount -= gi.bitCount % 8
+
+	n, err := gi.bits(16)
+	if err != nil {
+		return err
+	}
+
+	nn, err := gi.bits(16)
+	if err != nil {
+		return err
+	}
+
+	if uint16(n) != ^uint16(nn) {
+		return fmt.Errorf("%w: stored block length mismatch", ErrInvalidGzip)
+	}
+
+	for ; n > 0; n-- {
+		c, err := gi.bits(8)
+		if err != nil {
+			return err
+		}
+
+		if err := gi.emit(byte(c)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	lengthBase  = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// Order in which code length code lengths are stored.
+	codeLengthOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	fixedLiteralHuffman, fixedDistanceHuffman huffman
+)
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+
+	if err := fixedLiteralHuffman.init(lengths[:]); err != nil {
+		panic(err)
+	}
+
+	var distLengths [30]uint8
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+
+	if err := fixedDistanceHuffman.init(distLengths[:]); err != nil {
+		panic(err)
+	}
+}
+
+// huffman is a canonical Huffman decoding table indexed by the next maxBits
+// bits of input (bit-reversed, as deflate packs codes most significant bit
+// first). Each entry holds the symbol and code length.
+type huffman struct {
+	maxBits uint
+	table   []uint32
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	var count [maxCodeBits + 1]int
+	for _, l := range lengths {
+		count[l]++
+	}
+
+	count[0] = 0
+
+	h.maxBits = 0
+	for l := maxCodeBits; l > 0; l-- {
+		if count[l] != 0 {
+			h.maxBits = uint(l)
+			break
+		}
+	}
+
+	// Check for an over-subscribed code.
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		if left -= count[l]; left < 0 {
+			return fmt.Errorf("%w: over-subscribed Huffman code", ErrInvalidGzip)
+		}
+	}
+
+	var next [maxCodeBits + 2]int
+	for l := 1; l <= maxCodeBits; l++ {
+		next[l+1] = (next[l] + count[l]) << 1
+	}
+
+	h.table = make([]uint32, 1<<h.maxBits)
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+
+		code := next[l]
+		next[l]++
+
+		// Reverse the code bits and fill every table slot it prefixes.
+		var rev int
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (code>>i)&1
+		}
+
+		for i := rev; i < len(h.table); i += 1 << l {
+			h.table[i] = uint32(sym)<<4 | uint32(l)
+		}
+	}
+
+	return nil
+}
+
+// decode reads the next symbol, only consuming whole bytes from the source as
+// they are required for the code actually being decoded.
+func (gi *gzipIndexer) decode(h *huffman) (int, error) {
+	for {
+		entry := h.table[gi.bitBuf&(1<<h.maxBits-1)]
+		if l := uint(entry & 0xf); l != 0 && l <= gi.bitCount {
+			gi.bitBuf >>= l
+			gi.bitCount -= l
+
+			return int(entry >> 4), nil
+		}
+
+		if gi.bitCount >= h.maxBits {
+			return 0, fmt.Errorf("%w: invalid Huffman code", ErrInvalidGzip)
+		}
+
+		c, err := gi.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		gi.bitBuf |= uint64(c) << gi.bitCount
+		gi.bitCount += 8
+	}
+}
+
+func (gi *gzipIndexer) dynamic(lit, dist *huffman) error {
+	nlen, err := gi.bits(5)
+	if err != nil {
+		return err
+	}
+
+	ndist, err := gi.bits(5)
+	if err != nil {
+		return err
+	}
+
+	ncode, err := gi.bits(4)
+	if err != nil {
+		return err
+	}
+
+	nlen, ndist, ncode = nlen+257, ndist+1, ncode+4
+	if nlen > 286 || ndist > 30 {
+		return fmt.Errorf("%w: bad dynamic block counts", ErrInvalidGzip)
+	}
+
+	var codeLengths [19]uint8
+	for i := uint32(0); i < ncode; i++ {
+		l, err := gi.bits(3)
+		if err != nil {
+			return err
+		}
+
+		codeLengths[codeLengthOrder[i]] = uint8(l)
+	}
+
+	var lengthHuffman huffman
+	if err := lengthHuffman.init(codeLengths[:]); err != nil {
+		return err
+	}
+
+	lengths := make([]uint8, nlen+ndist)
+	for i := 0; i < len(lengths); {
+		sym, err := gi.decode(&lengthHuffman)
+		if err != nil {
+			return err
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+
+			continue
+		}
+
+		var (
+			repeat uint32
+			value  uint8
+		)
+
+		switch sym {
+		case 16:
+			if i == 0 {
+				return fmt.Errorf("%w: repeat with no previous length", ErrInvalidGzip)
+			}
+
+			value = lengths[i-1]
+			repeat, err = gi.bits(2)
+			repeat += 3
+		case 17:
+			repeat, err = gi.bits(3)
+			repeat += 3
+		default:
+			repeat, err = gi.bits(7)
+			repeat += 11
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if i+int(repeat) > len(lengths) {
+			return fmt.Errorf("%w: too many code lengths", ErrInvalidGzip)
+		}
+
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return fmt.Errorf("%w: missing end-of-block code", ErrInvalidGzip)
+	}
+
+	if err := lit.init(lengths[:nlen]); err != nil {
+		return err
+	}
+
+	return dist.init(lengths[nlen:])
+}
+
+func (gi *gzipIndexer) codes(lit, dist *huffman) error {
+	for {
+		sym, err := gi.decode(lit)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case sym < 256:
+			if err := gi.emit(byte(sym)); err != nil {
+				return err
+			}
+
+			continue
+		case sym == 256:
+			return nil
+		case sym > 285:
+			return fmt.Errorf("%w: invalid length symbol", ErrInvalidGzip)
+		}
+
+		sym -= 257
+
+		extra, err := gi.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+
+		length := int(lengthBase[sym]) + int(extra)
+
+		if dist.maxBits == 0 {
+			return fmt.Errorf("%w: no distance codes", ErrInvalidGzip)
+		}
+
+		dsym, err := gi.decode(dist)
+		if err != nil {
+			return err
+		}
+
+		if dsym > 29 {
+			return fmt.Errorf("%w: invalid distance symbol", ErrInvalidGzip)
+		}
+
+		if extra, err = gi.bits(uint(distExtra[dsym])); err != nil {
+			return err
+		}
+
+		// Members cannot refer back to those before them.
+		d := int64(distBase[dsym]) + int64(extra)
+		if d > gi.total-gi.memberStart {
+			return fmt.Errorf("%w: distance too far back", ErrInvalidGzip)
+		}
+
+		for ; length > 0; length-- {
+			if err := gi.emit(gi.window[(gi.total-d)%windowSize]); err != nil {
+				return err
+			}
+		}
+	}
+}
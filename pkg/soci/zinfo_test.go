@@ -0,0 +1,368 @@
+package soci
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testData returns n bytes that compress somewhat (so that the stream has a
+// mix of literals and back references) but not so well that each deflate
+// block covers all of it.
+func testData(t *testing.T, n int) []byte {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(int64(n)))
+	words := []string{"ocistow ", "soci ", "ztoc ", "gzip ", "checkpoint ", "span ", "layer\n"}
+
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		if rng.Intn(4) == 0 {
+			b := make([]byte, rng.Intn(64))
+			rng.Read(b)
+			buf.Write(b)
+
+			continue
+		}
+
+		buf.WriteString(words[rng.Intn(len(words))])
+	}
+
+	return buf.Bytes()[:n]
+}
+
+func gzipData(t *testing.T, data []byte, level int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zw.Name = "layer.tar"
+
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// extract inflates the compressed stream from the checkpoint, as the SOCI
+// snapshotter does (through zlib's inflatePrime and inflateSetDictionary), by
+// realigning the stream to the checkpoint's first unused bit.
+func extract(t *testing.T, compressed []byte, cp checkpoint) io.Reader {
+	t.Helper()
+
+	var stream []byte
+	if cp.bits == 0 {
+		stream = compressed[cp.in:]
+	} else {
+		shift := 8 - cp.bits
+		src := compressed[cp.in-1:]
+		stream = make([]byte, len(src))
+
+		for i := range src {
+			stream[i] = src[i] >> shift
+			if i+1 < len(src) {
+				stream[i] |= src[i+1] << (8 - shift)
+			}
+		}
+	}
+
+	return flate.NewReaderDict(bytes.NewReader(stream), cp.window)
+}
+
+func TestGzipIndexerRoundTrip(t *testing.T) {
+	const spanSize = 64 << 10
+
+	for _, tc := range []struct {
+		name  string
+		size  int
+		level int
+	}{
+		{"empty", 0, gzip.DefaultCompression},
+		{"small", 1000, gzip.DefaultCompression},
+		{"default", 1 << 20, gzip.DefaultCompression},
+		{"best speed", 1 << 20, gzip.BestSpeed},
+		{"best compression", 1 << 20, gzip.BestCompression},
+		{"huffman only", 1 << 20, gzip.HuffmanOnly},
+		{"stored", 1 << 20, gzip.NoCompression},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := testData(t, tc.size)
+			compressed := gzipData(t, data, tc.level)
+
+			var out bytes.Buffer
+
+			z, size, err := newGzipIndexer(bytes.NewReader(compressed), &out, spanSize).index()
+			if err != nil {
+				t.Fatalf("indexing: %v", err)
+			}
+
+			if size != int64(len(compressed)) {
+				t.Errorf("compressed size: got %d, want %d", size, len(compressed))
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("uncompressed data differs")
+			}
+
+			if len(z.spanDigests) != len(z.checkpoints) {
+				t.Fatalf("got %d span digests for %d checkpoints", len(z.spanDigests), len(z.checkpoints))
+			}
+
+			// Checkpoints can only be at block boundaries, which the best
+			// compression places far apart.
+			if tc.size > 4*spanSize && len(z.checkpoints) < 2 {
+				t.Errorf("got %d checkpoints for %d bytes in %d spans", len(z.checkpoints), tc.size, spanSize)
+			}
+
+			for i, cp := range z.checkpoints {
+				if i > 0 && cp.out <= z.checkpoints[i-1].out {
+					t.Errorf("checkpoint %d: out %d not after %d", i, cp.out, z.checkpoints[i-1].out)
+				}
+
+				if cp.bits > 7 {
+					t.Errorf("checkpoint %d: %d bits", i, cp.bits)
+				}
+
+				// The window is the preceding (zero padded) 32KiB.
+				want := make([]byte, windowSize)
+				copy(want[windowSize-min64(cp.out, windowSize):], data[max64(cp.out-windowSize, 0):cp.out])
+
+				if !bytes.Equal(cp.window, want) {
+					t.Errorf("checkpoint %d: window differs", i)
+				}
+
+				// Each span is digested from its (partial) first byte.
+				start := cp.in
+				if cp.bits != 0 {
+					start--
+				}
+
+				end := size
+				if i+1 < len(z.checkpoints) {
+					end = z.checkpoints[i+1].in
+				}
+
+				sum := sha256.Sum256(compressed[start:end])
+				if got, want := z.spanDigests[i], "sha256:"+hex.EncodeToString(sum[:]); got != want {
+					t.Errorf("checkpoint %d: span digest %s, want %s", i, got, want)
+				}
+			}
+
+			// Extract at random offsets, from the last checkpoint preceding
+			// each.
+			rng := rand.New(rand.NewSource(1))
+
+			for i := 0; i < 50 && len(data) > 0; i++ {
+				off := rng.Int63n(int64(len(data)))
+				n := min64(rng.Int63n(8<<10)+1, int64(len(data))-off)
+
+				cp := z.checkpoints[0]
+				for _, c := range z.checkpoints {
+					if c.out <= off {
+						cp = c
+					}
+				}
+
+				r := extract(t, compressed, cp)
+
+				if _, err := io.CopyN(io.Discard, r, off-cp.out); err != nil {
+					t.Fatalf("skipping to %d from checkpoint at %d: %v", off, cp.out, err)
+				}
+
+				got := make([]byte, n)
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatalf("extracting %d bytes at %d: %v", n, off, err)
+				}
+
+				if !bytes.Equal(got, data[off:off+n]) {
+					t.Fatalf("extracting %d bytes at %d from checkpoint at %d: data differs", n, off, cp.out)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipIndexerMembers(t *testing.T) {
+	data := testData(t, 512<<10)
+
+	// Concatenated members, of which each starts afresh.
+	starts := []int64{0, 100 << 10, 101 << 10}
+
+	var compressed []byte
+	for i, start := range starts {
+		end := int64(len(data))
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+
+		compressed = append(compressed, gzipData(t, data[start:end], gzip.DefaultCompression)...)
+	}
+
+	var out bytes.Buffer
+
+	z, size, err := newGzipIndexer(bytes.NewReader(compressed), &out, 64<<10).index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != int64(len(compressed)) {
+		t.Errorf("compressed size: got %d, want %d", size, len(compressed))
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("uncompressed data differs")
+	}
+
+	// Each member's deflate stream has a checkpoint at its start, from which
+	// the rest of the member extracts.
+	for _, start := range starts {
+		var cp *checkpoint
+		for i := range z.checkpoints {
+			if z.checkpoints[i].out == start {
+				cp = &z.checkpoints[i]
+			}
+		}
+
+		if cp == nil {
+			t.Errorf("no checkpoint at the member at %d", start)
+			continue
+		}
+
+		if cp.bits != 0 {
+			t.Errorf("member at %d: checkpoint at %d bits", start, cp.bits)
+		}
+
+		end := int64(len(data))
+		for _, s := range starts {
+			if s > start {
+				end = min64(end, s)
+			}
+		}
+
+		got, err := io.ReadAll(extract(t, compressed, *cp))
+		if err != nil {
+			t.Errorf("member at %d: %v", start, err)
+		}
+
+		if !bytes.Equal(got, data[start:end]) {
+			t.Errorf("member at %d: extracted data differs", start)
+		}
+	}
+
+	// Anything but another member after one is invalid.
+	for name, tc := range map[string]struct {
+		trailing []byte
+		err      error
+	}{
+		"garbage":   {[]byte("not a gzip member"), ErrInvalidGzip},
+		"truncated": {compressed[:5], io.ErrUnexpectedEOF},
+	} {
+		blob := append(append([]byte(nil), compressed...), tc.trailing...)
+
+		if _, _, err := newGzipIndexer(bytes.NewReader(blob), io.Discard, 64<<10).index(); !errors.Is(err, tc.err) {
+			t.Errorf("%s after the last member: error %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+func TestGzipIndexerInvalid(t *testing.T) {
+	compressed := gzipData(t, testData(t, 100<<10), gzip.DefaultCompression)
+
+	for _, tc := range []struct {
+		name string
+		blob []byte
+		err  error
+	}{
+		{"not gzip", []byte("not a gzip stream"), ErrInvalidGzip},
+		{"truncated", compressed[:len(compressed)/2], io.ErrUnexpectedEOF},
+		{"bad checksum", func() []byte {
+			b := append([]byte(nil), compressed...)
+			b[len(b)-8] ^= 0xff
+
+			return b
+		}(), ErrInvalidGzip},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := newGzipIndexer(bytes.NewReader(tc.blob), io.Discard, 1<<10).index()
+			if !errors.Is(err, tc.err) {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestZinfoBlob(t *testing.T) {
+	compressed := gzipData(t, testData(t, 512<<10), gzip.DefaultCompression)
+
+	z, _, err := newGzipIndexer(bytes.NewReader(compressed), io.Discard, 64<<10).index()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := z.blob()
+
+	if want := 4 + 8 + len(z.checkpoints)*checkpointBlobLen; len(blob) != want {
+		t.Fatalf("blob is %d bytes, want %d", len(blob), want)
+	}
+
+	if n := int32(binary.LittleEndian.Uint32(blob)); int(n) != len(z.checkpoints) {
+		t.Errorf("blob has %d checkpoints, want %d", n, len(z.checkpoints))
+	}
+
+	if spanSize := int64(binary.LittleEndian.Uint64(blob[4:])); spanSize != z.spanSize {
+		t.Errorf("blob has span size %d, want %d", spanSize, z.spanSize)
+	}
+
+	for i, cp := range z.checkpoints {
+		b := blob[12+i*checkpointBlobLen:]
+
+		if in := int64(binary.LittleEndian.Uint64(b)); in != cp.in {
+			t.Errorf("checkpoint %d: in %d, want %d", i, in, cp.in)
+		}
+
+		if out := int64(binary.LittleEndian.Uint64(b[8:])); out != cp.out {
+			t.Errorf("checkpoint %d: out %d, want %d", i, out, cp.out)
+		}
+
+		if b[16] != cp.bits {
+			t.Errorf("checkpoint %d: bits %d, want %d", i, b[16], cp.bits)
+		}
+
+		if !bytes.Equal(b[17:17+windowSize], cp.window) {
+			t.Errorf("checkpoint %d: window differs", i)
+		}
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,282 @@
+package soci
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+const (
+	ztocVersion = "0.9"
+
+	// Compression algorithm enum of the ztoc flatbuffers schema.
+	compressionAlgorithmGzip int8 = 1
+)
+
+var ErrUnsupportedTarEntry = errors.New("unsupported tar entry")
+
+// fileMetadata is an entry in the table of contents of a layer.
+type fileMetadata struct {
+	name               string
+	typ                string
+	uncompressedOffset int64
+	uncompressedSize   int64
+	linkname           string
+	mode               int64
+	uid, gid           uint32
+	uname, gname       string
+	modTime            string
+	devmajor, devminor int64
+	xattrs             map[string]string
+}
+
+// ztoc is a table of contents of a gzip compressed layer, along with the
+// checkpoints needed to lazily decompress any of its files.
+type ztoc struct {
+	buildToolIdentifier     string
+	compressedArchiveSize   int64
+	uncompressedArchiveSize int64
+	metadata                []fileMetadata
+	zinfo                   *zinfo
+}
+
+// BuildZtoc reads a gzip compressed tar layer and returns its serialised
+// ztoc.
+func BuildZtoc(r io.Reader, spanSize int64, buildToolIdentifier string) ([]byte, error) {
+	pr, pw := io.Pipe()
+
+	type result struct {
+		zinfo *zinfo
+		size  int64
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		z, size, err := newGzipIndexer(r, pw, spanSize).index()
+		pw.CloseWithError(err)
+		done <- result{z, size, err}
+	}()
+
+	metadata, uncompressedSize, err := tableOfContents(pr)
+	if err == nil {
+		// Keep decompressing past the end of the archive so that the whole
+		// layer is checkpointed and verified.
+		_, err = io.Copy(io.Discard, pr)
+	}
+
+	// Unblock the indexer should the table of contents have failed.
+	pr.Close()
+
+	res := <-done
+	if res.err != nil && !errors.Is(res.err, io.ErrClosedPipe) {
+		return nil, fmt.Errorf("indexing gzip stream: %w", res.err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading tar: %w", err)
+	}
+
+	return (&ztoc{
+		buildToolIdentifier:     buildToolIdentifier,
+		compressedArchiveSize:   res.size,
+		uncompressedArchiveSize: uncompressedSize,
+		metadata:                metadata,
+		zinfo:                   res.zinfo,
+	}).marshal(), nil
+}
+
+func tableOfContents(r io.Reader) ([]fileMetadata, int64, error) {
+	pr := &positionReader{r: r}
+	tr := tar.NewReader(pr)
+
+	var metadata []fileMetadata
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		typ, err := entryType(hdr)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		modTime, err := hdr.ModTime.MarshalText()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		metadata = append(metadata, fileMetadata{
+			name:               hdr.Name,
+			typ:                typ,
+			uncompressedOffset: pr.pos,
+			uncompressedSize:   hdr.Size,
+			linkname:           hdr.Linkname,
+			mode:               hdr.Mode,
+			uid:                uint32(hdr.Uid),
+			gid:                uint32(hdr.Gid),
+			uname:              hdr.Uname,
+			gname:              hdr.Gname,
+			modTime:            string(modTime),
+			devmajor:           hdr.Devmajor,
+			devminor:           hdr.Devminor,
+			xattrs:             hdr.PAXRecords,
+		})
+	}
+
+	return metadata, pr.pos, nil
+}
+
+func entryType(hdr *tar.Header) (string, error) {
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		return "hardlink", nil
+	case tar.TypeSymlink:
+		return "symlink", nil
+	case tar.TypeDir:
+		return "dir", nil
+	case tar.TypeReg:
+		return "reg", nil
+	case tar.TypeChar:
+		return "char", nil
+	case tar.TypeBlock:
+		return "block", nil
+	case tar.TypeFifo:
+		return "fifo", nil
+	}
+
+	return "", fmt.Errorf("%w: %q (%q)", ErrUnsupportedTarEntry, hdr.Name, hdr.Typeflag)
+}
+
+// positionReader tracks the position in the uncompressed tar stream, which the
+// tar reader only ever consumes in whole headers and file contents.
+type positionReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (pr *positionReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.pos += int64(n)
+
+	return n, err
+}
+
+// marshal serialises the ztoc to flatbuffers, following the schema of the
+// SOCI snapshotter (ztoc/fbs/ztoc.fbs). The builder calls are equivalent to
+// those of flatc generated code.
+func (z *ztoc) marshal() []byte {
+	b := flatbuffers.NewBuilder(0)
+
+	version := b.CreateString(ztocVersion)
+	buildToolIdentifier := b.CreateString(z.buildToolIdentifier)
+
+	// TOC.
+	metadataOffsets := make([]flatbuffers.UOffsetT, len(z.metadata))
+	for i := len(z.metadata) - 1; i >= 0; i-- {
+		metadataOffsets[i] = z.metadata[i].marshal(b)
+	}
+
+	metadata := offsetVector(b, metadataOffsets)
+
+	b.StartObject(1)
+	b.PrependUOffsetTSlot(0, metadata, 0)
+	toc := b.EndObject()
+
+	// Compression info.
+	checkpoints := b.CreateByteVector(z.zinfo.blob())
+
+	digestOffsets := make([]flatbuffers.UOffsetT, len(z.zinfo.spanDigests))
+	for i, d := range z.zinfo.spanDigests {
+		digestOffsets[i] = b.CreateString(d)
+	}
+
+	spanDigests := offsetVector(b, digestOffsets)
+
+	b.StartObject(4)
+	b.PrependInt8Slot(0, compressionAlgorithmGzip, 1)
+	b.PrependInt32Slot(1, int32(len(z.zinfo.checkpoints)-1), 0)
+	b.PrependUOffsetTSlot(2, spanDigests, 0)
+	b.PrependUOffsetTSlot(3, checkpoints, 0)
+	compressionInfo := b.EndObject()
+
+	// Ztoc.
+	b.StartObject(6)
+	b.PrependUOffsetTSlot(0, version, 0)
+	b.PrependUOffsetTSlot(1, buildToolIdentifier, 0)
+	b.PrependInt64Slot(2, z.compressedArchiveSize, 0)
+	b.PrependInt64Slot(3, z.uncompressedArchiveSize, 0)
+	b.PrependUOffsetTSlot(4, toc, 0)
+	b.PrependUOffsetTSlot(5, compressionInfo, 0)
+	b.Finish(b.EndObject())
+
+	return b.FinishedBytes()
+}
+
+func (fm *fileMetadata) marshal(b *flatbuffers.Builder) flatbuffers.UOffsetT {
+	name := b.CreateString(fm.name)
+	typ := b.CreateString(fm.typ)
+	linkname := b.CreateString(fm.linkname)
+	uname := b.CreateString(fm.uname)
+	gname := b.CreateString(fm.gname)
+	modTime := b.CreateString(fm.modTime)
+
+	keys := make([]string, 0, len(fm.xattrs))
+	for k := range fm.xattrs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	xattrOffsets := make([]flatbuffers.UOffsetT, len(keys))
+	for i, k := range keys {
+		key := b.CreateString(k)
+		value := b.CreateString(fm.xattrs[k])
+
+		b.StartObject(2)
+		b.PrependUOffsetTSlot(0, key, 0)
+		b.PrependUOffsetTSlot(1, value, 0)
+		xattrOffsets[i] = b.EndObject()
+	}
+
+	xattrs := offsetVector(b, xattrOffsets)
+
+	b.StartObject(14)
+	b.PrependUOffsetTSlot(0, name, 0)
+	b.PrependUOffsetTSlot(1, typ, 0)
+	b.PrependInt64Slot(2, fm.uncompressedOffset, 0)
+	b.PrependInt64Slot(3, fm.uncompressedSize, 0)
+	b.PrependUOffsetTSlot(4, linkname, 0)
+	b.PrependInt64Slot(5, fm.mode, 0)
+	b.PrependUint32Slot(6, fm.uid, 0)
+	b.PrependUint32Slot(7, fm.gid, 0)
+	b.PrependUOffsetTSlot(8, uname, 0)
+	b.PrependUOffsetTSlot(9, gname, 0)
+	b.PrependUOffsetTSlot(10, modTime, 0)
+	b.PrependInt64Slot(11, fm.devmajor, 0)
+	b.PrependInt64Slot(12, fm.devminor, 0)
+	b.PrependUOffsetTSlot(13, xattrs, 0)
+
+	return b.EndObject()
+}
+
+func offsetVector(b *flatbuffers.Builder, offsets []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	b.StartVector(flatbuffers.SizeUOffsetT, len(offsets), flatbuffers.SizeUOffsetT)
+
+	for i := len(offsets) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(offsets[i])
+	}
+
+	return b.EndVector(len(offsets))
+}
@@ -0,0 +1,339 @@
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// table reads the fields of a flatbuffers table by their index in the SOCI
+// snapshotter's ztoc schema (ztoc/fbs/ztoc.fbs), as flatc generated code does,
+// so that the encoding is checked independently of marshal.
+type table struct{ flatbuffers.Table }
+
+func rootTable(buf []byte) table {
+	return table{flatbuffers.Table{Bytes: buf, Pos: flatbuffers.GetUOffsetT(buf)}}
+}
+
+func (t table) offset(field int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(t.Offset(flatbuffers.VOffsetT(4 + 2*field)))
+}
+
+func (t table) string(field int) string {
+	if o := t.offset(field); o != 0 {
+		return string(t.ByteVector(o + t.Pos))
+	}
+
+	return ""
+}
+
+func (t table) int64(field int) int64 {
+	if o := t.offset(field); o != 0 {
+		return t.GetInt64(o + t.Pos)
+	}
+
+	return 0
+}
+
+func (t table) table(field int) table {
+	o := t.offset(field)
+	if o == 0 {
+		return table{}
+	}
+
+	return table{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(o + t.Pos)}}
+}
+
+// vector returns the length and position of the vector field.
+func (t table) vector(field int) (int, flatbuffers.UOffsetT) {
+	o := t.offset(field)
+	if o == 0 {
+		return 0, 0
+	}
+
+	return t.VectorLen(o), t.Vector(o)
+}
+
+func (t table) tables(field int) []table {
+	n, pos := t.vector(field)
+	tables := make([]table, n)
+
+	for i := range tables {
+		elem := pos + flatbuffers.UOffsetT(i*flatbuffers.SizeUOffsetT)
+		tables[i] = table{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(elem)}}
+	}
+
+	return tables
+}
+
+func (t table) strings(field int) []string {
+	n, pos := t.vector(field)
+	strs := make([]string, n)
+
+	for i := range strs {
+		strs[i] = t.String(pos + flatbuffers.UOffsetT(i*flatbuffers.SizeUOffsetT))
+	}
+
+	return strs
+}
+
+type testEntry struct {
+	hdr  tar.Header
+	body []byte
+}
+
+func testLayer(t *testing.T, entries []testEntry) (tarball, layer []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.body))
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), gzipData(t, buf.Bytes(), gzip.DefaultCompression)
+}
+
+func TestBuildZtoc(t *testing.T) {
+	const spanSize = 64 << 10
+
+	modTime := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: modTime}},
+		{
+			hdr: tar.Header{
+				Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1, Gid: 2,
+				Uname: "daemon", Gname: "bin", ModTime: modTime,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.b": "2", "SCHILY.xattr.user.a": "1"},
+			},
+			body: []byte("NAME=ocistow\n"),
+		},
+		{hdr: tar.Header{Name: "usr/lib/big", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: modTime}, body: testData(t, 1<<20)},
+		{hdr: tar.Header{Name: "usr/lib/small", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: modTime}, body: testData(t, 3000)},
+		{hdr: tar.Header{Name: "usr/lib/link", Typeflag: tar.TypeSymlink, Linkname: "small", ModTime: modTime}},
+		{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3, ModTime: modTime}},
+	}
+
+	tarball, layer := testLayer(t, entries)
+
+	// The same tarball, compressed as two members split between entries, as
+	// pigz and others may.
+	prefix, _ := testLayer(t, entries[:3])
+	split := len(prefix) - 2*512
+
+	members := append(
+		gzipData(t, tarball[:split], gzip.BestSpeed),
+		gzipData(t, tarball[split:], gzip.DefaultCompression)...,
+	)
+
+	for _, tc := range []struct {
+		name    string
+		layer   []byte
+		members []int64
+	}{
+		{"single member", layer, []int64{0}},
+		{"two members", members, []int64{0, int64(split)}},
+	} {
+		layer := tc.layer
+
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := BuildZtoc(bytes.NewReader(layer), spanSize, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ztoc := rootTable(b)
+
+			if got := ztoc.string(0); got != ztocVersion {
+				t.Errorf("version: got %q, want %q", got, ztocVersion)
+			}
+
+			if got := ztoc.string(1); got != "test" {
+				t.Errorf("build tool identifier: got %q", got)
+			}
+
+			if got := ztoc.int64(2); got != int64(len(layer)) {
+				t.Errorf("compressed archive size: got %d, want %d", got, len(layer))
+			}
+
+			if got := ztoc.int64(3); got != int64(len(tarball)) {
+				t.Errorf("uncompressed archive size: got %d, want %d", got, len(tarball))
+			}
+
+			info := ztoc.table(5)
+
+			// The compression algorithm is omitted when it is the schema's default.
+			if o := info.offset(0); o != 0 && info.GetInt8(o+info.Pos) != compressionAlgorithmGzip {
+				t.Errorf("compression algorithm is not gzip")
+			}
+
+			maxSpanID := info.GetInt32(info.offset(1) + info.Pos)
+			spanDigests := info.strings(2)
+
+			if len(spanDigests) != int(maxSpanID)+1 {
+				t.Errorf("got %d span digests for max span ID %d", len(spanDigests), maxSpanID)
+			}
+
+			n, pos := info.vector(3)
+			blob := info.Bytes[pos : pos+flatbuffers.UOffsetT(n)]
+
+			if got := int(binary.LittleEndian.Uint32(blob)); got != int(maxSpanID)+1 {
+				t.Errorf("got %d checkpoints for max span ID %d", got, maxSpanID)
+			}
+
+			checkpoints := make([]checkpoint, maxSpanID+1)
+			for i := range checkpoints {
+				cb := blob[12+i*checkpointBlobLen:]
+				checkpoints[i] = checkpoint{
+					in:     int64(binary.LittleEndian.Uint64(cb)),
+					out:    int64(binary.LittleEndian.Uint64(cb[8:])),
+					bits:   cb[16],
+					window: cb[17 : 17+windowSize],
+				}
+			}
+
+			// Each member's deflate stream starts at a checkpoint.
+			for _, start := range tc.members {
+				var found bool
+				for _, cp := range checkpoints {
+					found = found || cp.out == start
+				}
+
+				if !found {
+					t.Errorf("no checkpoint at the member at %d", start)
+				}
+			}
+
+			metadata := ztoc.table(4).tables(0)
+			if len(metadata) != len(entries) {
+				t.Fatalf("got %d entries, want %d", len(metadata), len(entries))
+			}
+
+			for i, e := range entries {
+				fm := metadata[i]
+
+				for _, f := range []struct {
+					field     int
+					got, want string
+				}{
+					{0, fm.string(0), e.hdr.Name},
+					{4, fm.string(4), e.hdr.Linkname},
+					{8, fm.string(8), e.hdr.Uname},
+					{9, fm.string(9), e.hdr.Gname},
+					{10, fm.string(10), modTime.Format(time.RFC3339)},
+				} {
+					if f.got != f.want {
+						t.Errorf("%s: field %d: got %q, want %q", e.hdr.Name, f.field, f.got, f.want)
+					}
+				}
+
+				typ, err := entryType(&e.hdr)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := fm.string(1); got != typ {
+					t.Errorf("%s: type: got %q, want %q", e.hdr.Name, got, typ)
+				}
+
+				for _, f := range []struct {
+					field     int
+					got, want int64
+				}{
+					{3, fm.int64(3), int64(len(e.body))},
+					{5, fm.int64(5), e.hdr.Mode},
+					{11, fm.int64(11), e.hdr.Devmajor},
+					{12, fm.int64(12), e.hdr.Devminor},
+				} {
+					if f.got != f.want {
+						t.Errorf("%s: field %d: got %d, want %d", e.hdr.Name, f.field, f.got, f.want)
+					}
+				}
+
+				if o := fm.offset(6); o != 0 && int(fm.GetUint32(o+fm.Pos)) != e.hdr.Uid {
+					t.Errorf("%s: uid: got %d, want %d", e.hdr.Name, fm.GetUint32(o+fm.Pos), e.hdr.Uid)
+				}
+
+				// Xattrs are sorted by key.
+				var xattrs []string
+				for _, x := range fm.tables(13) {
+					xattrs = append(xattrs, x.string(0)+"="+x.string(1))
+				}
+
+				if len(e.hdr.PAXRecords) > 0 {
+					if got, want := xattrs, []string{"SCHILY.xattr.user.a=1", "SCHILY.xattr.user.b=2"}; len(got) != 2 ||
+						got[0] != want[0] || got[1] != want[1] {
+						t.Errorf("%s: xattrs: got %v, want %v", e.hdr.Name, got, want)
+					}
+				}
+
+				// Each file's contents can be extracted from the layer with the
+				// ztoc alone, as the SOCI snapshotter does.
+				off, size := fm.int64(2), fm.int64(3)
+				if !bytes.Equal(tarball[off:off+size], e.body) {
+					t.Errorf("%s: uncompressed offset %d does not hold its contents", e.hdr.Name, off)
+
+					continue
+				}
+
+				cp := checkpoints[0]
+				for _, c := range checkpoints {
+					if c.out <= off {
+						cp = c
+					}
+				}
+
+				r := extract(t, layer, cp)
+				if _, err := io.CopyN(io.Discard, r, off-cp.out); err != nil {
+					t.Fatal(err)
+				}
+
+				got := make([]byte, size)
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, e.body) {
+					t.Errorf("%s: extracted contents differ", e.hdr.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZtocInvalid(t *testing.T) {
+	_, layer := testLayer(t, []testEntry{
+		{hdr: tar.Header{Name: "pipe", Typeflag: tar.TypeFifo}},
+		{hdr: tar.Header{Name: "sock", Typeflag: tar.TypeCont}},
+	})
+
+	if _, err := BuildZtoc(bytes.NewReader(layer), 1<<10, "test"); !errors.Is(err, ErrUnsupportedTarEntry) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedTarEntry)
+	}
+
+	if _, err := BuildZtoc(bytes.NewReader([]byte("not a gzip stream")), 1<<10, "test"); !errors.Is(err, ErrInvalidGzip) {
+		t.Errorf("got %v, want %v", err, ErrInvalidGzip)
+	}
+}
@@ -2,17 +2,24 @@ package transport
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/user"
 	"time"
 
 	"github.com/aws/aws-xray-sdk-go/xray"
 
 	"github.com/martinbaillie/ocistow/pkg/config"
+	"github.com/martinbaillie/ocistow/pkg/policy"
 	"github.com/martinbaillie/ocistow/pkg/service"
 )
 
 type StowCLI interface {
-	Stow(src, dst string, annotations map[string]string) error
+	Stow(req StowRequest) error
+	Resign(req ResignRequest) error
+	Unsign(req UnsignRequest) error
+	Refresh(req RefreshRequest) error
 }
 
 type stowCLI struct {
@@ -24,7 +31,7 @@ func NewCLI(cfg *config.Config, svc service.Service) StowCLI {
 	return &stowCLI{service: svc, config: cfg}
 }
 
-func (c *stowCLI) Stow(src, dst string, annotations map[string]string) error {
+func (c *stowCLI) Stow(req StowRequest) error {
 	// Instantiate a few things like contexts and Xray segments that server
 	// transports like Lambda would by default.
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute*15))
@@ -45,17 +52,25 @@ func (c *stowCLI) Stow(src, dst string, annotations map[string]string) error {
 
 	ctx = logger.WithContext(ctx)
 
-	if *c.config.Copy {
-		if err := c.service.Copy(ctx, src, dst, annotations); err != nil {
-			return fmt.Errorf("failed copy: %w", err)
+	err := stow(ctx, c.config, c.service, req, invoker())
+
+	// Violations of policy are output as a Lambda response would be, though
+	// the CLI still fails.
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		if encErr := json.NewEncoder(os.Stdout).Encode(&StowResponse{Denied: true, Violations: denied.Violations}); encErr != nil {
+			return encErr
 		}
 	}
 
-	if *c.config.Sign {
-		if err := c.service.Sign(ctx, dst, annotations); err != nil {
-			return fmt.Errorf("failed sign: %w", err)
-		}
+	return err
+}
+
+// invoker returns the name of the user running the CLI.
+func invoker() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
 	}
 
-	return nil
+	return os.Getenv("USER")
 }
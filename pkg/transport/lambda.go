@@ -2,28 +2,32 @@ package transport
 
 import (
 	"context"
-	"fmt"
+	"errors"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-xray-sdk-go/header"
 	"github.com/aws/aws-xray-sdk-go/xray"
 
 	"github.com/martinbaillie/ocistow/pkg/config"
+	"github.com/martinbaillie/ocistow/pkg/policy"
 	"github.com/martinbaillie/ocistow/pkg/service"
 )
 
-type StowRequest struct {
-	SrcImgRef   string            `json:"SrcImageRef"`
-	DstImgRef   string            `json:"DstImageRef"`
-	Annotations map[string]string `json:"Annotations"`
-}
-
-type StowLambdaHandler func(context.Context, StowRequest) error
+type StowLambdaHandler func(context.Context, StowRequest) (*StowResponse, error)
 
+// NewStowLambdaHandler returns a Lambda handler of stow requests. Requests
+// denied by policy fail like any other, unless they opt into a Denied response
+// (see StowRequest.DeniedResponse) to get the violations structured rather than
+// as an error message.
 func NewStowLambdaHandler(cfg *config.Config, svc service.Service) StowLambdaHandler {
-	return func(ctx context.Context, req StowRequest) error {
+	return func(ctx context.Context, req StowRequest) (*StowResponse, error) {
 		logger := cfg.Logger()
 
+		var requestID string
+		if lc, ok := lambdacontext.FromContext(ctx); ok {
+			requestID = lc.AwsRequestID
+		}
+
 		if *cfg.AWSXray {
 			// Extract key Lambda invoke information.
 			var traceID string
@@ -33,11 +37,9 @@ func NewStowLambdaHandler(cfg *config.Config, svc service.Service) StowLambdaHan
 					traceID = header.FromString(traceHeader).TraceID
 				}
 			}
-			lc, _ := lambdacontext.FromContext(ctx)
-
 			// And create a contextual Lambda invoke-local logger.
 			ll := logger.With().
-				Str("aws_request_id", lc.AwsRequestID).
+				Str("aws_request_id", requestID).
 				Str("trace_id", traceID).
 				Logger()
 
@@ -46,18 +48,13 @@ func NewStowLambdaHandler(cfg *config.Config, svc service.Service) StowLambdaHan
 
 		ctx = logger.WithContext(ctx)
 
-		if *cfg.Copy {
-			if err := svc.Copy(ctx, req.SrcImgRef, req.DstImgRef, req.Annotations); err != nil {
-				return fmt.Errorf("failed copy: %w", err)
-			}
-		}
+		err := stow(ctx, cfg, svc, req, requestID)
 
-		if *cfg.Sign {
-			if err := svc.Sign(ctx, req.DstImgRef, req.Annotations); err != nil {
-				return fmt.Errorf("failed sign: %w", err)
-			}
+		var denied *policy.DeniedError
+		if req.DeniedResponse && errors.As(err, &denied) {
+			return &StowResponse{Denied: true, Violations: denied.Violations}, nil
 		}
 
-		return nil
+		return &StowResponse{}, err
 	}
 }
@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/rs/zerolog"
+
+	"github.com/martinbaillie/ocistow/pkg/service"
+)
+
+// ResignRequest is a request to re-sign the repositories' images that are
+// signed by the old key with the new key, e.g. when rotating keys.
+type ResignRequest struct {
+	Repositories []string
+	OldKey       string
+	// NewKey defaults to the configured (or routed) signing key.
+	NewKey string
+	// RemoveOld removes the old key's signatures once re-signed.
+	RemoveOld bool
+	// Checkpoint is the path of a file of the references re-signed so far,
+	// which are skipped, so that an interrupted re-sign can be resumed.
+	Checkpoint string
+}
+
+// Resign re-signs, unlike Stow, without a deadline, as repositories can hold
+// any number of images.
+func (c *stowCLI) Resign(req ResignRequest) error {
+	ctx := context.Background()
+
+	logger := c.config.Logger()
+
+	if *c.config.AWSXray {
+		var seg *xray.Segment
+		ctx, seg = xray.BeginSegment(ctx, "Resign")
+
+		cliLogger := logger.With().Str("trace_id", seg.TraceID).Logger()
+
+		logger = &cliLogger
+
+		defer seg.Close(nil)
+	}
+
+	ctx = logger.WithContext(ctx)
+
+	keyRoutes, err := readKeyRoutes(*c.config.KeyRoutes)
+	if err != nil {
+		return fmt.Errorf("reading key routes: %w", err)
+	}
+
+	var opts []service.ResignOption
+
+	if req.RemoveOld {
+		opts = append(opts, service.WithOldSignatureRemoval())
+	}
+
+	checkpoint := func(service.ResignProgress) {}
+
+	if req.Checkpoint != "" {
+		done, err := readCheckpoint(req.Checkpoint)
+		if err != nil {
+			return fmt.Errorf("reading checkpoint: %w", err)
+		}
+
+		f, err := os.OpenFile(req.Checkpoint, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening checkpoint: %w", err)
+		}
+		defer f.Close()
+
+		opts = append(opts, service.WithResignSkip(func(ref string) bool { return done[ref] }))
+
+		checkpoint = func(p service.ResignProgress) {
+			if p.Outcome == service.ResignSkipped {
+				return
+			}
+
+			if _, err := fmt.Fprintln(f, p.Ref); err != nil {
+				logger.Warn().Err(err).Str("ref", p.Ref).Msg("checkpointing")
+			}
+		}
+	}
+
+	opts = append(opts, service.WithResignProgress(func(p service.ResignProgress) {
+		logResignProgress(logger, p)
+		checkpoint(p)
+	}))
+
+	return c.service.Resign(
+		ctx, req.Repositories, req.OldKey, req.NewKey, signOpts(c.config, StowRequest{}, keyRoutes), opts...,
+	)
+}
+
+// RefreshRequest is a request to refresh the repositories' signatures that
+// expire within a duration, once or periodically.
+type RefreshRequest struct {
+	Repositories []string
+	Within       time.Duration
+	// Expired refreshes signatures that have already expired too.
+	Expired bool
+	// Interval, if given, refreshes every interval until interrupted, logging
+	// rather than returning the errors of each refresh.
+	Interval time.Duration
+}
+
+// Refresh refreshes, like Resign, without a deadline.
+func (c *stowCLI) Refresh(req RefreshRequest) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	keyRoutes, err := readKeyRoutes(*c.config.KeyRoutes)
+	if err != nil {
+		return fmt.Errorf("reading key routes: %w", err)
+	}
+
+	for {
+		if err := c.refresh(ctx, req, keyRoutes); err != nil && req.Interval <= 0 {
+			return err
+		}
+
+		if req.Interval <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(req.Interval):
+		}
+	}
+}
+
+func (c *stowCLI) refresh(ctx context.Context, req RefreshRequest, keyRoutes service.KeyRoutes) error {
+	logger := c.config.Logger()
+
+	if *c.config.AWSXray {
+		var seg *xray.Segment
+		ctx, seg = xray.BeginSegment(ctx, "Refresh")
+
+		cliLogger := logger.With().Str("trace_id", seg.TraceID).Logger()
+
+		logger = &cliLogger
+
+		defer seg.Close(nil)
+	}
+
+	ctx = logger.WithContext(ctx)
+
+	opts := []service.ResignOption{
+		service.WithResignProgress(func(p service.ResignProgress) { logResignProgress(logger, p) }),
+	}
+
+	if req.Expired {
+		opts = append(opts, service.WithExpiredSignatureRefresh())
+	}
+
+	return c.service.Refresh(
+		ctx, req.Repositories, "", req.Within, signOpts(c.config, StowRequest{}, keyRoutes), opts...,
+	)
+}
+
+// logResignProgress logs the progress of a re-sign (or refresh).
+func logResignProgress(logger *zerolog.Logger, p service.ResignProgress) {
+	logger.Info().
+		Str("component", "transport").
+		Str("ref", p.Ref).
+		Str("outcome", string(p.Outcome)).
+		Int("signed", p.Signed).
+		Int("removed", p.Removed).
+		Str("progress", fmt.Sprintf("%d/%d", p.Done, p.Total)).
+		Msg("")
+}
+
+// readCheckpoint reads the references of a checkpoint file, should it exist.
+func readCheckpoint(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if ref := strings.TrimSpace(scanner.Text()); ref != "" {
+			done[ref] = true
+		}
+	}
+
+	return done, scanner.Err()
+}
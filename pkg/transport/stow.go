@@ -0,0 +1,481 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+
+	"github.com/martinbaillie/ocistow/pkg/config"
+	"github.com/martinbaillie/ocistow/pkg/policy"
+	"github.com/martinbaillie/ocistow/pkg/service"
+)
+
+// ErrInvalidRequest is returned for requests that are malformed.
+var ErrInvalidRequest = errors.New("invalid request")
+
+type StowRequest struct {
+	SrcImgRef   string            `json:"SrcImageRef"`
+	DstImgRef   string            `json:"DstImageRef"`
+	Annotations map[string]string `json:"Annotations"`
+
+	// Optional overrides of the deployment configuration.
+	ConvertMediaTypes string `json:"ConvertMediaTypes,omitempty"`
+	LayerCompression  string `json:"LayerCompression,omitempty"`
+	SOCIIndex         *bool  `json:"SOCIIndex,omitempty"`
+	SBOM              string `json:"SBOM,omitempty"`
+
+	Estargz                 *bool    `json:"Estargz,omitempty"`
+	EstargzPrioritizedFiles []string `json:"EstargzPrioritizedFiles,omitempty"`
+
+	// EncryptRecipients are inline PEM encoded public keys or JWKs.
+	EncryptRecipients []string `json:"EncryptRecipients,omitempty"`
+	EncryptLayers     []int    `json:"EncryptLayers,omitempty"`
+
+	SignatureReferrers  *bool  `json:"SignatureReferrers,omitempty"`
+	SignatureRepository string `json:"SignatureRepository,omitempty"`
+	SignatureSuffix     string `json:"SignatureSuffix,omitempty"`
+
+	Attestations []StowAttestation `json:"Attestations,omitempty"`
+
+	ScanFindings *bool `json:"ScanFindings,omitempty"`
+	// VEX are OpenVEX documents (or strings of them) of the vulnerabilities
+	// of the destination image, attested alongside its scan findings (or its
+	// signature if not attesting them).
+	VEX []json.RawMessage `json:"VEX,omitempty"`
+
+	// DeniedResponse has the Lambda respond to a policy denial as Denied, with
+	// its violations structured, rather than fail the invocation. Callers that
+	// set it must check for Denied, not just an error, before relying on the
+	// promotion.
+	DeniedResponse bool `json:"DeniedResponse,omitempty"`
+}
+
+// StowResponse is the outcome of a request that didn't fail outright.
+type StowResponse struct {
+	// Denied is whether the promotion policy denied the request, in which
+	// case nothing was promoted.
+	Denied bool `json:"Denied,omitempty"`
+	// Violations of the promotion policy that denied the request, if any.
+	Violations []policy.Violation `json:"Violations,omitempty"`
+}
+
+// StowAttestation is a predicate to attest about the destination image
+// alongside its signature.
+type StowAttestation struct {
+	PredicateType string `json:"PredicateType"`
+	// Predicate is either the predicate itself or a string of it (as JSON).
+	Predicate json.RawMessage `json:"Predicate"`
+}
+
+// stow runs the service methods enabled by configuration for a single request
+// and is shared by all transports. The invoker identifies who (or what) made
+// the request in provenance attestations.
+func stow(ctx context.Context, cfg *config.Config, svc service.Service, req StowRequest, invoker string) error {
+	var promotion service.Promotion
+
+	keyRoutes, err := readKeyRoutes(*cfg.KeyRoutes)
+	if err != nil {
+		return fmt.Errorf("reading key routes: %w", err)
+	}
+
+	scanFindings := *cfg.ScanFindings
+	if req.ScanFindings != nil {
+		scanFindings = *req.ScanFindings
+	}
+
+	// Requests may not claim signature validity windows of their own.
+	if err := service.ValidateSignatureAnnotations(req.Annotations); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+
+	if *cfg.Copy {
+		// Destinations that no key route signs are rejected before they are
+		// copied, rather than left unsigned.
+		if *cfg.Sign && len(keyRoutes) > 0 {
+			if _, err := keyRoutes.Route(req.DstImgRef, req.Annotations); err != nil {
+				return fmt.Errorf("failed copy: %w", err)
+			}
+		}
+
+		opts, err := copyOpts(cfg, req)
+		if err != nil {
+			return fmt.Errorf("failed copy: %w", err)
+		}
+
+		opts = append(opts, service.WithPromotionRecord(&promotion))
+
+		if err := svc.Copy(ctx, req.SrcImgRef, req.DstImgRef, req.Annotations, opts...); err != nil {
+			return fmt.Errorf("failed copy: %w", err)
+		}
+	}
+
+	if *cfg.Sign {
+		opts, err := attestationOpts(req)
+		if err != nil {
+			return fmt.Errorf("failed sign: %w", err)
+		}
+
+		if !scanFindings {
+			vex, err := vexOpts(req)
+			if err != nil {
+				return fmt.Errorf("failed sign: %w", err)
+			}
+
+			opts = append(opts, vex...)
+		}
+
+		if *cfg.Copy {
+			promotionOpts, err := promotionAttestationOpts(cfg, &promotion, invoker)
+			if err != nil {
+				return fmt.Errorf("failed sign: %w", err)
+			}
+
+			opts = append(opts, promotionOpts...)
+		}
+
+		if err := svc.Sign(ctx, req.DstImgRef, req.Annotations, append(signOpts(cfg, req, keyRoutes), opts...)...); err != nil {
+			return fmt.Errorf("failed sign: %w", err)
+		}
+	}
+
+	if scanFindings {
+		opts, err := vexOpts(req)
+		if err != nil {
+			return fmt.Errorf("failed scan attestation: %w", err)
+		}
+
+		opts = append(opts, service.WithScanTimeout(*cfg.ScanTimeout))
+
+		if err := svc.AttestScan(ctx, req.DstImgRef, append(signOpts(cfg, req, keyRoutes), opts...)...); err != nil {
+			return fmt.Errorf("failed scan attestation: %w", err)
+		}
+	}
+
+	if *cfg.Verify {
+		if err := svc.Verify(ctx, req.DstImgRef, signOpts(cfg, req, keyRoutes)...); err != nil {
+			return fmt.Errorf("failed verify: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func copyOpts(cfg *config.Config, req StowRequest) (opts []service.CopyOption, err error) {
+	conversion := *cfg.ConvertMediaTypes
+	if req.ConvertMediaTypes != "" {
+		conversion = req.ConvertMediaTypes
+	}
+
+	compression := *cfg.LayerCompression
+	if req.LayerCompression != "" {
+		compression = req.LayerCompression
+	}
+
+	opts = append(opts,
+		service.WithMediaTypeConversion(service.MediaTypeConversion(conversion)),
+		service.WithLayerCompression(service.LayerCompression(compression)),
+	)
+
+	sbom := *cfg.SBOM
+	if req.SBOM != "" {
+		sbom = req.SBOM
+	}
+
+	if sbom != "" {
+		opts = append(opts, service.WithSBOM(service.SBOMFormat(sbom)))
+	}
+
+	sociIndex := *cfg.SOCIIndex
+	if req.SOCIIndex != nil {
+		sociIndex = *req.SOCIIndex
+	}
+
+	if sociIndex {
+		opts = append(opts, service.WithSOCIIndex(*cfg.SOCIMinLayerSize))
+	}
+
+	estargz := *cfg.Estargz
+	if req.Estargz != nil {
+		estargz = *req.Estargz
+	}
+
+	prioritizedFiles := []string(*cfg.EstargzPrioritizedFiles)
+	if len(req.EstargzPrioritizedFiles) > 0 {
+		prioritizedFiles = req.EstargzPrioritizedFiles
+	}
+
+	if estargz {
+		opts = append(opts, service.WithEstargz(prioritizedFiles))
+	}
+
+	// NOTE: Recipients are only ever read from file when configured by the
+	// deployment; requests must give them inline.
+	var recipients [][]byte
+	if len(req.EncryptRecipients) > 0 {
+		recipients, err = parseKeys(req.EncryptRecipients)
+	} else {
+		recipients, err = readKeys(*cfg.EncryptRecipients)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption recipients: %w", err)
+	}
+
+	if len(recipients) > 0 {
+		layers := req.EncryptLayers
+		if len(layers) == 0 {
+			for _, l := range *cfg.EncryptLayers {
+				i, err := strconv.Atoi(l)
+				if err != nil {
+					return nil, fmt.Errorf("invalid encryption layer index %q: %w", l, err)
+				}
+
+				layers = append(layers, i)
+			}
+		}
+
+		opts = append(opts, service.WithLayerEncryption(recipients, layers))
+	}
+
+	// NOTE: Policy is deliberately only taken from the deployment.
+	if *cfg.Policy != "" {
+		p, err := readPolicy(*cfg.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("reading policy: %w", err)
+		}
+
+		opts = append(opts, service.WithPolicy(p))
+	}
+
+	// NOTE: As is layer inspection, lest a request opt out of it.
+	if *cfg.Inspect != "" {
+		opts = append(opts, service.WithLayerInspection(
+			service.InspectionMode(*cfg.Inspect), *cfg.InspectAllow,
+		))
+	}
+
+	// NOTE: Private keys are deliberately only taken from the deployment.
+	if len(*cfg.DecryptKeys) > 0 {
+		keys, err := readKeys(*cfg.DecryptKeys)
+		if err != nil {
+			return nil, fmt.Errorf("reading decryption keys: %w", err)
+		}
+
+		opts = append(opts, service.WithLayerDecryption(keys))
+	}
+
+	return opts, nil
+}
+
+func signOpts(cfg *config.Config, req StowRequest, keyRoutes service.KeyRoutes) (opts []service.SignOption) {
+	referrers := *cfg.SignatureReferrers
+	if req.SignatureReferrers != nil {
+		referrers = *req.SignatureReferrers
+	}
+
+	if referrers {
+		opts = append(opts, service.WithSignatureReferrers())
+	}
+
+	repository := *cfg.SignatureRepository
+	if req.SignatureRepository != "" {
+		repository = req.SignatureRepository
+	}
+
+	if repository != "" {
+		opts = append(opts, service.WithSignatureRepository(repository))
+	}
+
+	suffix := *cfg.SignatureSuffix
+	if req.SignatureSuffix != "" {
+		suffix = req.SignatureSuffix
+	}
+
+	if suffix != "" {
+		opts = append(opts, service.WithSignatureSuffix(suffix))
+	}
+
+	// NOTE: Key routes, co-signing keys, signature replacement and validity
+	// (and whether to accept signatures without it) are deliberately only
+	// taken from the deployment.
+	if len(keyRoutes) > 0 {
+		opts = append(opts, service.WithKeyRoutes(keyRoutes))
+	}
+
+	if len(*cfg.CoSigningKeys) > 0 {
+		opts = append(opts, service.WithCoSigningKeys(*cfg.CoSigningKeys...))
+	}
+
+	if *cfg.SignatureReplace {
+		opts = append(opts, service.WithSignatureReplacement())
+	}
+
+	if *cfg.SignatureValidity > 0 {
+		opts = append(opts, service.WithSignatureValidity(*cfg.SignatureValidity))
+	}
+
+	if *cfg.SignatureUnbounded {
+		opts = append(opts, service.WithUnboundedSignatures())
+	}
+
+	return opts
+}
+
+func attestationOpts(req StowRequest) (opts []service.SignOption, err error) {
+	for _, a := range req.Attestations {
+		predicate, err := parsePredicate(a.Predicate)
+		if err != nil {
+			return nil, fmt.Errorf("reading %q attestation predicate: %w", a.PredicateType, err)
+		}
+
+		opts = append(opts, service.WithAttestation(a.PredicateType, predicate))
+	}
+
+	return opts, nil
+}
+
+func vexOpts(req StowRequest) (opts []service.SignOption, err error) {
+	for _, v := range req.VEX {
+		vex, err := parsePredicate(v)
+		if err != nil {
+			return nil, fmt.Errorf("reading VEX document: %w", err)
+		}
+
+		opts = append(opts, service.WithAttestation(service.VEXPredicateType, vex))
+	}
+
+	return opts, nil
+}
+
+// promotionAttestationOpts attests the provenance, SBOMs and inspections of the
+// images that were copied, by digest in case the destination tag has moved
+// since.
+func promotionAttestationOpts(
+	cfg *config.Config, promotion *service.Promotion, invoker string,
+) (opts []service.SignOption, err error) {
+	if *cfg.Provenance {
+		predicate, err := json.Marshal(promotion.Provenance(invoker))
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, service.WithImageAttestation(
+			promotion.DestinationDigest, in_toto.PredicateSLSAProvenanceV01, predicate,
+		))
+	}
+
+	for _, sbom := range promotion.SBOMs {
+		predicate, err := json.Marshal(sbom.Document)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, service.WithImageAttestation(sbom.Digest, sbom.PredicateType, predicate))
+	}
+
+	for _, inspection := range promotion.Inspections {
+		predicate, err := json.Marshal(inspection.Predicate())
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, service.WithImageAttestation(
+			inspection.Digest, service.InspectionPredicateType, predicate,
+		))
+	}
+
+	return opts, nil
+}
+
+// parsePredicate returns the given attestation predicate, which is either the
+// predicate itself or a string of it (as JSON). Requests never name files.
+func parsePredicate(predicate json.RawMessage) (json.RawMessage, error) {
+	var s string
+	if err := json.Unmarshal(predicate, &s); err != nil {
+		return predicate, nil
+	}
+
+	if trimmed := strings.TrimSpace(s); !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") ||
+		!json.Valid([]byte(s)) {
+		return nil, fmt.Errorf("%w: predicate string is not JSON", ErrInvalidRequest)
+	}
+
+	return json.RawMessage(s), nil
+}
+
+// readPolicy returns the given JSON policy, reading it from file if it is
+// instead given as a path.
+func readPolicy(p string) (*policy.Policy, error) {
+	if strings.HasPrefix(strings.TrimSpace(p), "{") {
+		return policy.Parse([]byte(p))
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.Parse(b)
+}
+
+// readKeyRoutes returns the given JSON key routes, reading them from file if
+// they are instead given as a path.
+func readKeyRoutes(routes string) (service.KeyRoutes, error) {
+	if routes == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(routes), "[") {
+		return service.ParseKeyRoutes([]byte(routes))
+	}
+
+	b, err := ioutil.ReadFile(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ParseKeyRoutes(b)
+}
+
+// parseKeys returns the given inline PEM encoded keys or JWKs of a request,
+// which never reads files.
+func parseKeys(keys []string) ([][]byte, error) {
+	b := make([][]byte, len(keys))
+
+	for i, k := range keys {
+		trimmed := strings.TrimSpace(k)
+		if !strings.HasPrefix(trimmed, "-----BEGIN") && !strings.HasPrefix(trimmed, "{") {
+			return nil, fmt.Errorf("%w: key %d is neither PEM encoded nor a JWK", ErrInvalidRequest, i)
+		}
+
+		b[i] = []byte(k)
+	}
+
+	return b, nil
+}
+
+// readKeys returns the given PEM encoded keys (or JWKs) of the deployment,
+// reading any that are instead given as file paths.
+func readKeys(keys []string) ([][]byte, error) {
+	b := make([][]byte, len(keys))
+
+	for i, k := range keys {
+		if trimmed := strings.TrimSpace(k); strings.HasPrefix(trimmed, "-----BEGIN") || strings.HasPrefix(trimmed, "{") {
+			b[i] = []byte(k)
+			continue
+		}
+
+		var err error
+		if b[i], err = ioutil.ReadFile(k); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
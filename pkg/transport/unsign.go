@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/xray"
+
+	"github.com/martinbaillie/ocistow/pkg/service"
+)
+
+// UnsignRequest is a request to withdraw trust in a destination image by
+// removing its signatures.
+type UnsignRequest struct {
+	DstImgRef string
+	// Key is the ref of the key whose signatures are removed, which defaults
+	// to the configured (or routed) signing key.
+	Key string
+	// All removes every signature, whatever its key.
+	All bool
+	// Reason, if given, is recorded in a signed revocation record of the
+	// signatures removed.
+	Reason string
+}
+
+// UnsignResponse is the outcome of an UnsignRequest.
+type UnsignResponse struct {
+	Removed []service.RemovedSignature `json:"Removed"`
+}
+
+// Unsign removes the signatures of the request, outputting those removed.
+func (c *stowCLI) Unsign(req UnsignRequest) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute*15))
+	defer cancel()
+
+	logger := c.config.Logger()
+
+	if *c.config.AWSXray {
+		var seg *xray.Segment
+		ctx, seg = xray.BeginSegment(ctx, "Unsign")
+
+		cliLogger := logger.With().Str("trace_id", seg.TraceID).Logger()
+
+		logger = &cliLogger
+
+		defer seg.Close(nil)
+	}
+
+	ctx = logger.WithContext(ctx)
+
+	keyRoutes, err := readKeyRoutes(*c.config.KeyRoutes)
+	if err != nil {
+		return fmt.Errorf("reading key routes: %w", err)
+	}
+
+	var opts []service.UnsignOption
+
+	if req.All {
+		opts = append(opts, service.WithAllSignatures())
+	}
+
+	if req.Reason != "" {
+		opts = append(opts, service.WithRevocation(req.Reason, invoker()))
+	}
+
+	removed, err := c.service.Unsign(ctx, req.DstImgRef, req.Key, signOpts(c.config, StowRequest{}, keyRoutes), opts...)
+	if err != nil {
+		return fmt.Errorf("failed unsign: %w", err)
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(&UnsignResponse{Removed: removed})
+}